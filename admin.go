@@ -0,0 +1,88 @@
+package ooo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+// ErrAdminOnly the route is served by the admin listener
+var ErrAdminOnly = errors.New("ooo: served by the admin listener")
+
+// StartAdmin starts an additional listener on the address that serves the stats,
+// the api= endpoints (pool, subscriptions, orphans, openapi, import) and /health
+// but none of the data routes, while it's active the main listener only serves
+// the data routes and the clock, both use the same storage and stream,
+// it should be called after Start and is closed with the server
+func (app *Server) StartAdmin(address string) error {
+	if !app.Active() {
+		return errors.New("ooo: server not active")
+	}
+	if app.admin.Load() != nil {
+		return errors.New("ooo: admin listener already active")
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/", app.stats).Methods("GET")
+	router.HandleFunc("/", app.importData).Queries("api", "import").Methods("POST")
+	router.HandleFunc("/health", app.health).Methods("GET")
+	server := &http.Server{
+		WriteTimeout:      app.WriteTimeout,
+		ReadTimeout:       app.ReadTimeout,
+		ReadHeaderTimeout: app.ReadHeaderTimeout,
+		IdleTimeout:       app.IdleTimeout,
+		Addr:              address,
+		Handler:           app.corsHandler(handlers.CompressHandler(router))}
+	ln, err := app.ListenConfig.Listen(context.Background(), "tcp4", address)
+	if err != nil {
+		return err
+	}
+	app.AdminAddress = ln.Addr().String()
+	app.admin.Store(server)
+	go server.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+	app.Console.Log("admin[" + app.AdminAddress + "]")
+	return nil
+}
+
+func (app *Server) adminListening() bool {
+	return app.admin.Load() != nil
+}
+
+func (app *Server) closeAdmin() {
+	server := app.admin.Swap(nil)
+	if server != nil {
+		server.Shutdown(context.Background())
+	}
+}
+
+// public handles the admin routes of the main listener while there's no admin listener
+func (app *Server) public(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.adminListening() {
+			writeAdminOnly(w)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeAdminOnly(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "%s", ErrAdminOnly)
+}
+
+// health responds 200 while the server and its storage are active, 503 otherwise
+func (app *Server) health(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !app.Active() || !app.Storage.Active() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%s", `{"status":"unavailable"}`)
+		return
+	}
+	fmt.Fprintf(w, "%s", `{"status":"ok"}`)
+}
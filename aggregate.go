@@ -0,0 +1,99 @@
+package ooo
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gorilla/mux"
+)
+
+// Aggregate computes the result of an aggregate endpoint from the storage
+type Aggregate func(storage Database) (interface{}, error)
+
+// aggregateCache result of an aggregate endpoint reused during the ttl
+type aggregateCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	result  []byte
+	expires time.Time
+	// generation changes on every invalidation so a result
+	// computed before it is not stored
+	generation int64
+}
+
+func (c *aggregateCache) get() ([]byte, int64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.result == nil || !time.Now().Before(c.expires) {
+		return nil, c.generation, false
+	}
+	return c.result, c.generation, true
+}
+
+func (c *aggregateCache) set(result []byte, generation int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.result = result
+	c.expires = time.Now().Add(c.ttl)
+}
+
+func (c *aggregateCache) invalidate(event StorageEvent) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.result = nil
+	c.generation++
+}
+
+// AggregateEndpoint registers a read only GET route on the path (like "/stats/orders") that
+// responds the JSON of the result computed by fn over the read storage, the result is reused
+// during the ttl and a storage event of a key that matches one of the invalidate patterns
+// drops it, errors are not cached, it should be registered before the server starts
+// so the route takes precedence over the key routes
+func (app *Server) AggregateEndpoint(path string, ttl time.Duration, fn Aggregate, invalidate ...string) {
+	if app.Router == nil {
+		app.Router = mux.NewRouter()
+	}
+
+	cache := &aggregateCache{ttl: ttl}
+	for _, pattern := range invalidate {
+		app.OnEvent(pattern, cache.invalidate)
+	}
+
+	app.Router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if !app.Audit(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "%s", ErrNotAuthorized)
+			return
+		}
+
+		result, generation, ok := cache.get()
+		if !ok {
+			computed, err := fn(app.reads())
+			if err != nil {
+				if _, isHTTPError := asHTTPError(err); isHTTPError {
+					writeFilterError(w, err)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+			result, err = json.Marshal(computed)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+			cache.set(result, generation)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+	}).Methods("GET")
+}
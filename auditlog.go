@@ -0,0 +1,86 @@
+package ooo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/benitogf/ooo/key"
+)
+
+// ErrAuditLogKey the audit log can't be modified through the api
+var ErrAuditLogKey = errors.New("ooo: the audit log is read only")
+
+// AuditLogEntry record of a mutation made through the REST api, before
+// and after are the hashes of the stored data (empty when there's none)
+type AuditLogEntry struct {
+	Principal string `json:"principal"`
+	Method    string `json:"method"`
+	Key       string `json:"key"`
+	Timestamp int64  `json:"timestamp"`
+	Before    string `json:"before"`
+	After     string `json:"after"`
+}
+
+// auditLogged the key belongs to the audit log
+func (app *Server) auditLogged(_key string) bool {
+	return app.AuditLog && app.AuditLogSink == nil && key.Peer(app.AuditLogPath, _key)
+}
+
+// rejectAuditLog responds forbidden to mutations of the audit log
+func (app *Server) rejectAuditLog(w http.ResponseWriter, _key string) bool {
+	if !app.auditLogged(_key) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "%s", ErrAuditLogKey)
+	return true
+}
+
+// auditHash the hash of the data stored in the key
+func (app *Server) auditHash(_key string) string {
+	if !app.AuditLog {
+		return ""
+	}
+	raw, err := app.Storage.Get(_key)
+	if err != nil || len(raw) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditMutation records a successful mutation of the key
+func (app *Server) auditMutation(r *http.Request, _key string, before string) {
+	if !app.AuditLog {
+		return
+	}
+	entry := AuditLogEntry{
+		Principal: app.Principal(r),
+		Method:    r.Method,
+		Key:       _key,
+		Timestamp: time.Now().UTC().UnixNano(),
+		Before:    before,
+		After:     app.auditHash(_key),
+	}
+	if app.AuditLogSink != nil {
+		app.AuditLogSink(entry)
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		app.Console.Err("ooo: audit log", _key, err)
+		return
+	}
+	_, err = app.Storage.Set(key.Build(app.AuditLogPath), data)
+	if err != nil {
+		app.Console.Err("ooo: audit log", _key, err)
+	}
+}
@@ -2,22 +2,33 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/benitogf/ooo/key"
 	"github.com/benitogf/ooo/messages"
-	"github.com/benitogf/ooo/meta"
 	"github.com/gorilla/websocket"
 )
 
 var HandshakeTimeout time.Duration = time.Second * 2
 
+// ErrInitialTimeout the server didn't send a frame within the initial timeout of the subscription
+var ErrInitialTimeout = errors.New("client: no initial frame received within the timeout")
+
 type Meta[T any] struct {
 	Created int64  `json:"created"`
 	Updated int64  `json:"updated"`
@@ -26,16 +37,262 @@ type Meta[T any] struct {
 }
 type OnMessageCallback[T any] func([]Meta[T])
 
+// Server address of an ooo server
+type Server struct {
+	Protocol string
+	Host     string
+}
+
+// SubscribeConfig settings of a subscription
+//
+// Ctx: context that will close the subscription when done
+//
+// Server: protocol (ws or wss) and host of the server
+//
+// Header: headers sent on the websocket handshake
+//
+// RootCAs: certificate authorities used to verify the server certificate, defaults to the system pool
+//
+// Certificates: client certificates presented to the server (mTLS)
+//
+// InsecureSkipVerify: skip the server certificate verification, should only be used for testing
+//
+// OnReady: function called when the server confirms the subscription (Stream.SendReady), ready frames are ignored otherwise
+//
+// OnHeartbeat: function called with each heartbeat frame of the server (Stream.HeartbeatInterval), heartbeats are ignored otherwise
+//
+// InitialTimeout: time to wait for the first frame after the connection is stablished, when exceeded OnError is called with ErrInitialTimeout and the client reconnects, zero waits forever
+//
+// OnError: function called with the errors of the subscription that aren't otherwise observable (ErrInitialTimeout, failed reads of oversized updates)
+//
+// Validate: function to check the data of each update before it's applied, an invalid update is reported through OnError and discarded, the client reconnects to resync from a snapshot since the next patches build on the rejected state
+//
+// Stats: counters of the subscription updated while it runs
+//
+// ResumeToken: version of the last update the application processed (SubscriptionStats.ResumeToken) before a restart, the first connection skips the snapshot when the server version is the same and receives the next updates as snapshots, a different version delivers a fresh snapshot
+type SubscribeConfig struct {
+	Ctx                context.Context
+	Server             Server
+	Header             http.Header
+	RootCAs            *x509.CertPool
+	Certificates       []tls.Certificate
+	InsecureSkipVerify bool
+	OnReady            func()
+	OnHeartbeat        func()
+	InitialTimeout     time.Duration
+	OnError            func(error)
+	Validate           func(data []byte) error
+	Stats              *SubscriptionStats
+	ResumeToken        string
+}
+
+// SubscriptionStats counters of a subscription, safe to read while it runs
+type SubscriptionStats struct {
+	messages   atomic.Int64
+	reconnects atomic.Int64
+	version    atomic.Int64
+}
+
+// Messages number of updates delivered to the callback
+func (stats *SubscriptionStats) Messages() int64 {
+	return stats.messages.Load()
+}
+
+// Reconnects number of connections stablished after the first one
+func (stats *SubscriptionStats) Reconnects() int64 {
+	return stats.reconnects.Load()
+}
+
+// LastVersion version of the last update delivered to the callback
+func (stats *SubscriptionStats) LastVersion() int64 {
+	return stats.version.Load()
+}
+
+// ResumeToken token to resume the subscription from the last update delivered to the callback
+func (stats *SubscriptionStats) ResumeToken() string {
+	version := stats.version.Load()
+	if version == 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(version, 16)
+}
+
+// applied counts an update of the message version
+func (stats *SubscriptionStats) applied(messageVersion string) {
+	if stats == nil {
+		return
+	}
+	stats.messages.Add(1)
+	version, err := strconv.ParseInt(messageVersion, 16, 64)
+	if err == nil {
+		stats.version.Store(version)
+	}
+}
+
+// valid checks the data of an update with the Validate function of the config,
+// the error of an invalid update is reported through OnError
+func (cfg SubscribeConfig) valid(data ...[]byte) bool {
+	if cfg.Validate == nil {
+		return true
+	}
+	for _, item := range data {
+		err := cfg.Validate(item)
+		if err != nil {
+			if cfg.OnError != nil {
+				cfg.OnError(err)
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// restClient the http client of the rest reads of a subscription, the
+// idle connections are closed after a minute
+func (cfg SubscribeConfig) restClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: cfg.tlsConfig(),
+			IdleConnTimeout: time.Minute,
+		},
+	}
+}
+
+// fetch reads the data of a path through the rest api, used for
+// the updates that exceed the message size limit of the stream
+func (cfg SubscribeConfig) fetch(ctx context.Context, httpClient *http.Client, path string) (json.RawMessage, error) {
+	scheme := "http"
+	if cfg.Server.Protocol == "wss" {
+		scheme = "https"
+	}
+	restURL := url.URL{Scheme: scheme, Host: cfg.Server.Host, Path: path}
+	req, err := http.NewRequestWithContext(ctx, "GET", restURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range cfg.Header {
+		req.Header[name] = values
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("client: failed to fetch oversized data of %s, status %d", path, res.StatusCode)
+	}
+
+	return messages.DecodeReader(res.Body)
+}
+
+func (cfg SubscribeConfig) tlsConfig() *tls.Config {
+	if cfg.RootCAs == nil && len(cfg.Certificates) == 0 && !cfg.InsecureSkipVerify {
+		return nil
+	}
+
+	return &tls.Config{
+		RootCAs:            cfg.RootCAs,
+		Certificates:       cfg.Certificates,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+}
+
+// ErrInvalidURL the url can't be used to subscribe
+var ErrInvalidURL = errors.New("client: invalid subscription url")
+
+// ParseConfig builds the settings of a subscription from a url, returns the path to subscribe to
+//
+// the scheme (ws, wss) defines the protocol, credentials are sent as an Authorization header
+// (basic with user and password, bearer with only a user), the query params
+// insecureSkipVerify (bool) and initialTimeout (duration) set the config fields
+//
+// ws://user:pass@localhost:8800/devices/*?initialTimeout=5s
+func ParseConfig(rawurl string) (SubscribeConfig, string, error) {
+	cfg := SubscribeConfig{}
+	parsed, err := url.Parse(rawurl)
+	if err != nil {
+		return cfg, "", err
+	}
+	if (parsed.Scheme != "ws" && parsed.Scheme != "wss") || parsed.Host == "" {
+		return cfg, "", ErrInvalidURL
+	}
+	path := strings.TrimPrefix(parsed.Path, "/")
+	if path == "" {
+		return cfg, "", ErrInvalidURL
+	}
+
+	cfg.Server = Server{Protocol: parsed.Scheme, Host: parsed.Host}
+	if parsed.User != nil {
+		cfg.Header = http.Header{}
+		password, hasPassword := parsed.User.Password()
+		if hasPassword {
+			credentials := base64.StdEncoding.EncodeToString([]byte(parsed.User.Username() + ":" + password))
+			cfg.Header.Set("Authorization", "Basic "+credentials)
+		} else {
+			cfg.Header.Set("Authorization", "Bearer "+parsed.User.Username())
+		}
+	}
+
+	for name, values := range parsed.Query() {
+		value := values[len(values)-1]
+		switch name {
+		case "insecureSkipVerify":
+			cfg.InsecureSkipVerify, err = strconv.ParseBool(value)
+		case "initialTimeout":
+			cfg.InitialTimeout, err = time.ParseDuration(value)
+		default:
+			err = errors.New("client: unknown subscription url param " + name)
+		}
+		if err != nil {
+			return SubscribeConfig{}, "", err
+		}
+	}
+
+	return cfg, path, nil
+}
+
+// jitter adds up to half of the delay so clients
+// disconnected at the same time don't reconnect together
+func jitter(delay time.Duration) time.Duration {
+	return delay + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Subscribe to a path of the server on host
 func Subscribe[T any](ctx context.Context, protocol, host, path string, callback OnMessageCallback[T]) {
+	SubscribeWithConfig(SubscribeConfig{
+		Ctx: ctx,
+		Server: Server{
+			Protocol: protocol,
+			Host:     host,
+		},
+	}, path, callback)
+}
+
+// SubscribeWithConfig subscribe to a path using the provided settings
+func SubscribeWithConfig[T any](cfg SubscribeConfig, path string, callback OnMessageCallback[T]) {
+	ctx := cfg.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	protocol := cfg.Server.Protocol
+	host := cfg.Server.Host
 	retryCount := 0
 	var cache json.RawMessage
 	lastPath := key.LastIndex(path)
 	isList := lastPath == "*"
+	restClient := cfg.restClient()
+	defer restClient.CloseIdleConnections()
 	closingTime := atomic.Bool{}
 	wsURL := url.URL{Scheme: protocol, Host: host, Path: path}
 	muWsClient := sync.Mutex{}
 	var wsClient *websocket.Conn
 	_handShakeTimeout := HandshakeTimeout
+	connected := false
+	resumeToken := cfg.ResumeToken
 
 	go func(ct *atomic.Bool) {
 		<-ctx.Done()
@@ -55,35 +312,108 @@ func Subscribe[T any](ctx context.Context, protocol, host, path string, callback
 		quickDial := &websocket.Dialer{
 			Proxy:            http.ProxyFromEnvironment,
 			HandshakeTimeout: _handShakeTimeout,
+			TLSClientConfig:  cfg.tlsConfig(),
+		}
+
+		// without a cache to patch the resumed connection requests snapshots only
+		dialURL := wsURL
+		resuming := cache == nil && resumeToken != ""
+		if resuming {
+			dialURL.RawQuery = url.Values{"v": {resumeToken}, "patch": {"false"}}.Encode()
 		}
 
 		muWsClient.Lock()
-		wsClient, _, err = quickDial.Dial(wsURL.String(), nil)
+		wsClient, _, err = quickDial.Dial(dialURL.String(), cfg.Header)
 		if wsClient == nil || err != nil {
 			muWsClient.Unlock()
 			log.Println("subscribe["+host+"/"+path+"]: failed websocket dial ", err)
-			time.Sleep(2 * time.Second)
+			time.Sleep(jitter(2 * time.Second))
 			continue
 		}
 		muWsClient.Unlock()
 		log.Println("subscribe["+host+"/"+path+"]: client connection stablished", host, path)
+		if connected && cfg.Stats != nil {
+			cfg.Stats.reconnects.Add(1)
+		}
+		connected = true
 
+		// a resumed subscription doesn't receive a first frame when it's up to date
+		initial := cfg.InitialTimeout > 0 && !resuming
+		if initial {
+			wsClient.SetReadDeadline(time.Now().Add(cfg.InitialTimeout))
+		}
 		for {
-			_, message, err := wsClient.ReadMessage()
-			if err != nil || message == nil {
+			_, frame, err := wsClient.ReadMessage()
+			if err != nil || frame == nil {
 				log.Println("subscribe["+host+"/"+path+"]: failed websocket read connection ", err)
 				wsClient.Close()
+				var netErr net.Error
+				if initial && errors.As(err, &netErr) && netErr.Timeout() && !closingTime.Load() && cfg.OnError != nil {
+					cfg.OnError(ErrInitialTimeout)
+				}
 				break
 			}
+			if initial {
+				initial = false
+				wsClient.SetReadDeadline(time.Time{})
+			}
+
+			// the frame envelope is decoded once and the patch applied from it
+			message, err := messages.Decode(frame)
+			if err != nil {
+				log.Println("subscribe["+host+"/"+path+"]: failed to parse message from websocket", err)
+				break
+			}
+
+			if message.Ready {
+				if cfg.OnReady != nil {
+					cfg.OnReady()
+				}
+				continue
+			}
+
+			if message.Heartbeat {
+				if cfg.OnHeartbeat != nil {
+					cfg.OnHeartbeat()
+				}
+				continue
+			}
+
+			// the data of an oversized update is read through the rest api
+			// and applied as a snapshot, reconnecting would get the same frame
+			if message.Oversized {
+				message.Data, err = cfg.fetch(ctx, restClient, path)
+				if err != nil {
+					log.Println("subscribe["+host+"/"+path+"]: failed to fetch oversized data", err)
+					if !closingTime.Load() && cfg.OnError != nil {
+						cfg.OnError(err)
+					}
+					wsClient.Close()
+					break
+				}
+				message.Oversized = false
+				message.Snapshot = true
+			}
 
 			result := []Meta[T]{}
 			if isList {
-				var objs []meta.Object
-				cache, objs, err = messages.PatchList(message, cache)
+				candidate, objs, err := message.PatchList(cache)
 				if err != nil {
 					log.Println("subscribe["+host+"/"+path+"]: failed to parse message from websocket", err)
 					break
 				}
+				items := make([][]byte, len(objs))
+				for i, obj := range objs {
+					items[i] = obj.Data
+				}
+				if !cfg.valid(items...) {
+					// the next patches build on the rejected state, resync with a snapshot
+					log.Println("subscribe[" + host + "/" + path + "]: invalid update from websocket, resyncing")
+					cache = nil
+					wsClient.Close()
+					break
+				}
+				cache = candidate
 				for _, obj := range objs {
 					var item T
 					err = json.Unmarshal([]byte(obj.Data), &item)
@@ -99,16 +429,25 @@ func Subscribe[T any](ctx context.Context, protocol, host, path string, callback
 					})
 				}
 				retryCount = 0
+				cfg.Stats.applied(message.Version)
+				resumeToken = message.Version
 				callback(result)
 				continue
 			}
 
-			var obj meta.Object
-			cache, obj, err = messages.Patch(message, cache)
+			candidate, obj, err := message.Patch(cache)
 			if err != nil {
 				log.Println("subscribe["+host+"/"+path+"]: failed to parse message from websocket", err)
 				break
 			}
+			if !cfg.valid(obj.Data) {
+				// the next patches build on the rejected state, resync with a snapshot
+				log.Println("subscribe[" + host + "/" + path + "]: invalid update from websocket, resyncing")
+				cache = nil
+				wsClient.Close()
+				break
+			}
+			cache = candidate
 
 			var item T
 			err = json.Unmarshal([]byte(obj.Data), &item)
@@ -123,6 +462,8 @@ func Subscribe[T any](ctx context.Context, protocol, host, path string, callback
 				Data:    item,
 			})
 			retryCount = 0
+			cfg.Stats.applied(message.Version)
+			resumeToken = message.Version
 			callback(result)
 		}
 
@@ -135,17 +476,17 @@ func Subscribe[T any](ctx context.Context, protocol, host, path string, callback
 		retryCount++
 		if retryCount < 30 {
 			log.Println("subscribe["+host+"/"+path+"]: reconnecting...", host, path, err)
-			time.Sleep(300 * time.Millisecond)
+			time.Sleep(jitter(300 * time.Millisecond))
 			continue
 		}
 
 		if retryCount < 100 {
 			log.Println("subscribe["+host+"/"+path+"]: reconnecting in 2 seconds...", host, path, err)
-			time.Sleep(2 * time.Second)
+			time.Sleep(jitter(2 * time.Second))
 			continue
 		}
 
 		log.Println("subscribe["+host+"/"+path+"]: reconnecting in 10 seconds...", err)
-		time.Sleep(10 * time.Second)
+		time.Sleep(jitter(10 * time.Second))
 	}
 }
@@ -39,10 +39,22 @@ func (app *Server) clock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	interval := time.Duration(0)
+	if r.FormValue("tick") != "" {
+		var err error
+		interval, err = time.ParseDuration(r.FormValue("tick"))
+		if err != nil || interval < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", errors.New("ooo: invalid tick interval"))
+			return
+		}
+	}
+
 	client, err := app.Stream.New("", w, r)
 	if err != nil {
 		return
 	}
+	client.SetClockInterval(interval)
 
 	go app.Stream.WriteClock(client, Time())
 	app.Stream.Read("", client)
@@ -0,0 +1,50 @@
+package ooo
+
+import (
+	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+
+	"github.com/benitogf/ooo/meta"
+)
+
+// Compute returns the object with the fields computed on read
+type Compute func(obj meta.Object) (meta.Object, error)
+
+// ComputeReadFilter add a read filter that passes every object of the reads, subscription
+// snapshots and broadcasts of the path through fn (like an ageSeconds from Created), the
+// computed fields are not stored and are computed again on every read (it is the read
+// filter of the path, register it instead of OpenFilter)
+func (app *Server) ComputeReadFilter(path string, fn Compute) {
+	app.ReadFilter(path, func(index string, data json.RawMessage) (json.RawMessage, error) {
+		if !gjson.ParseBytes(data).IsArray() {
+			obj, err := meta.Decode(data)
+			if err != nil {
+				return nil, err
+			}
+			// missing key
+			if obj.Created == 0 {
+				return data, nil
+			}
+			computed, err := fn(obj)
+			if err != nil {
+				return nil, err
+			}
+			return meta.Encode(computed)
+		}
+
+		objs, err := meta.DecodeList(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(objs) == 0 {
+			return data, nil
+		}
+		for i := range objs {
+			objs[i], err = fn(objs[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return meta.Encode(objs)
+	})
+}
@@ -0,0 +1,59 @@
+package ooo
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/benitogf/ooo/key"
+	"github.com/rs/cors"
+)
+
+// corsPolicy cross domain options of the keys that match a path
+type corsPolicy struct {
+	path    string
+	handler *cors.Cors
+}
+
+// CORS defines the cross domain options of the requests to keys that match the path,
+// the first matching policy applies and the global options apply to the rest of the
+// requests, should be called before starting the server
+func (app *Server) CORS(path string, opts cors.Options) {
+	app.corsPolicies = append(app.corsPolicies, corsPolicy{
+		path:    path,
+		handler: cors.New(opts),
+	})
+}
+
+// corsHandler wraps the handler with the cross domain policy that matches the
+// request path, or the global one (none when DisableCORS is set)
+func (app *Server) corsHandler(handler http.Handler) http.Handler {
+	var global http.Handler = handler
+	if !app.DisableCORS {
+		global = cors.New(cors.Options{
+			AllowedMethods: app.AllowedMethods,
+			AllowedOrigins: app.AllowedOrigins,
+			AllowedHeaders: app.AllowedHeaders,
+			ExposedHeaders: app.ExposedHeaders,
+			// AllowCredentials: true,
+			// Debug:          true,
+		}).Handler(handler)
+	}
+	if len(app.corsPolicies) == 0 {
+		return global
+	}
+
+	policies := make([]http.Handler, len(app.corsPolicies))
+	for i, policy := range app.corsPolicies {
+		policies[i] = policy.handler.Handler(handler)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(r.URL.Path, "/")
+		for i, policy := range app.corsPolicies {
+			if key.Match(policy.path, path) {
+				policies[i].ServeHTTP(w, r)
+				return
+			}
+		}
+		global.ServeHTTP(w, r)
+	})
+}
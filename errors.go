@@ -0,0 +1,53 @@
+package ooo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// defaultErrorStatus status of the sentinel errors of the storage operations
+var defaultErrorStatus = []struct {
+	err    error
+	status int
+}{
+	{ErrNotFound, http.StatusNotFound},
+	{ErrNoop, http.StatusNotModified},
+	{ErrInvalidPath, http.StatusBadRequest},
+	{ErrInvalidSchema, http.StatusBadRequest},
+	{ErrNotAuthorized, http.StatusUnauthorized},
+	{ErrAuditLogKey, http.StatusForbidden},
+	{ErrPreconditionFailed, http.StatusPreconditionFailed},
+}
+
+// errorStatus the status of the error of a storage operation, the ErrorStatus
+// map of the server takes precedence over the defaults, other errors are a 500
+func (app *Server) errorStatus(err error) int {
+	for target, status := range app.ErrorStatus {
+		if errors.Is(err, target) {
+			return status
+		}
+	}
+	for _, mapping := range defaultErrorStatus {
+		if errors.Is(err, mapping.err) {
+			return mapping.status
+		}
+	}
+
+	return http.StatusInternalServerError
+}
+
+// writeStorageError responds the error of a storage operation with its status,
+// filter errors of the operation (derived patches) keep their own status
+func (app *Server) writeStorageError(w http.ResponseWriter, err error) {
+	if _, ok := asHTTPError(err); ok {
+		writeFilterError(w, err)
+		return
+	}
+	status := app.errorStatus(err)
+	w.WriteHeader(status)
+	if status == http.StatusNotModified {
+		return
+	}
+	fmt.Fprintf(w, "%s", err)
+}
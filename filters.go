@@ -1,11 +1,21 @@
 package ooo
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/goccy/go-json"
 
 	"github.com/benitogf/ooo/key"
+	"github.com/benitogf/ooo/merge"
+	"github.com/benitogf/ooo/meta"
+	"github.com/benitogf/ooo/stream"
 )
 
 // Apply filter function
@@ -17,6 +27,49 @@ import (
 // error: will prevent data to pass the filter
 type Apply func(key string, data json.RawMessage) (json.RawMessage, error)
 
+// HTTPError filter error that defines the status and
+// headers of the response instead of a bad request
+type HTTPError struct {
+	Status int
+	Msg    string
+	Header http.Header
+}
+
+func (e HTTPError) Error() string {
+	return e.Msg
+}
+
+// asHTTPError finds an HTTPError value or pointer in the error chain
+func asHTTPError(err error) (HTTPError, bool) {
+	var httpErrPtr *HTTPError
+	if errors.As(err, &httpErrPtr) && httpErrPtr != nil {
+		return *httpErrPtr, true
+	}
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr, true
+	}
+
+	return HTTPError{}, false
+}
+
+// writeFilterError responds a filter error, with the status and headers
+// of an HTTPError or a bad request for any other error
+func writeFilterError(w http.ResponseWriter, err error) {
+	httpErr, ok := asHTTPError(err)
+	status := http.StatusBadRequest
+	if ok && httpErr.Status != 0 {
+		status = httpErr.Status
+	}
+	for name, values := range httpErr.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s", err)
+}
+
 // ApplyDelete callback function
 type ApplyDelete func(key string) error
 
@@ -30,8 +83,9 @@ type hook struct {
 
 // Filter path -> match
 type filter struct {
-	path  string
-	apply Apply
+	path   string
+	method string
+	apply  Apply
 }
 
 type watch struct {
@@ -48,15 +102,70 @@ type watchers []watch
 
 // Filters read and write
 type filters struct {
-	Write      router
-	Read       router
-	Delete     hooks
-	AfterWrite watchers
+	Write       router
+	WriteMethod router
+	Read        router
+	Delete      hooks
+	AfterWrite  watchers
+	Dedupe      router
+	Derive      router
+	Migrate     migrations
+	MaxList     lists
+	References  references
+	Raw         matchers
+}
+
+// filterSet the filters currently applied
+func (app *Server) filterSet() filters {
+	app.filtersMutex.RLock()
+	defer app.filtersMutex.RUnlock()
+	return app.filters
+}
+
+// registering the filters that new filters are added to,
+// the staged filters while reloading
+func (app *Server) registering() *filters {
+	if app.staging != nil {
+		return app.staging
+	}
+	return &app.filters
+}
+
+// ReloadFilters replaces every filter with the ones registered by the reload
+// function, requests keep using the previous filters until it returns and
+// subscriptions stay connected, routes can't be removed while running, the
+// warmed paths are fetched and the subscribers get the data of their pools
+// through the new read filters
+func (app *Server) ReloadFilters(reload func(*Server)) {
+	app.reloadMutex.Lock()
+	defer app.reloadMutex.Unlock()
+	app.filtersMutex.Lock()
+	app.staging = &filters{}
+	app.filtersMutex.Unlock()
+
+	reload(app)
+
+	app.filtersMutex.Lock()
+	app.filters = *app.staging
+	app.staging = nil
+	app.filtersMutex.Unlock()
+
+	if atomic.LoadInt64(&app.active) == 1 {
+		app.warmCaches(app.warmPaths())
+		app.Stream.BroadcastPools(stream.BroadcastOpt{
+			Get: func(key string) ([]byte, error) {
+				return app.filteredData(app.Storage, key)
+			},
+		})
+	}
 }
 
 // DeleteFilter add a filter that runs before sending a read result
 func (app *Server) DeleteFilter(path string, apply ApplyDelete) {
-	app.filters.Delete = append(app.filters.Delete, hook{
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.Delete = append(set.Delete, hook{
 		path:  path,
 		apply: apply,
 	})
@@ -66,28 +175,744 @@ func (app *Server) DeleteFilter(path string, apply ApplyDelete) {
 
 // WriteFilter add a filter that triggers on write
 func (app *Server) WriteFilter(path string, apply Apply) {
-	app.filters.Write = append(app.filters.Write, filter{
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.Write = append(set.Write, filter{
 		path:  path,
 		apply: apply,
 	})
 }
 
+// WriteFilterMethod add a write filter that triggers only on writes of the method
+// (POST, PUT or PATCH), it runs before the write filter of the path
+func (app *Server) WriteFilterMethod(method string, path string, apply Apply) {
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.WriteMethod = append(set.WriteMethod, filter{
+		path:   path,
+		method: strings.ToUpper(method),
+		apply:  apply,
+	})
+}
+
+// method the filters of a method
+func (r router) method(method string) router {
+	res := router{}
+	for _, filter := range r {
+		if filter.method == method {
+			res = append(res, filter)
+		}
+	}
+
+	return res
+}
+
+// checkWrite runs the write filter of the method and then the write filter of the path,
+// in static mode a path with a filter for the method doesn't require a write filter
+func (f filters) checkWrite(method string, path string, data json.RawMessage, static bool) (json.RawMessage, error) {
+	scoped := f.WriteMethod.method(method)
+	if scoped.checkStatic(path, true) != nil {
+		return f.Write.check(path, data, static)
+	}
+
+	data, err := scoped.check(path, data, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Write.check(path, data, false)
+}
+
 // AfterWrite add a filter that triggers after a successful write
 func (app *Server) AfterWrite(path string, apply Notify) {
-	app.filters.AfterWrite = append(app.filters.AfterWrite, watch{
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.AfterWrite = append(set.AfterWrite, watch{
 		path:  path,
 		apply: apply,
 	})
 }
 
+// DedupeWriteFilter add a filter that skips writes (no storage or broadcast)
+// when the data is equal to the currently stored data, runs after the write filters
+func (app *Server) DedupeWriteFilter(path string) {
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.Dedupe = append(set.Dedupe, filter{
+		path: path,
+		apply: func(index string, data json.RawMessage) (json.RawMessage, error) {
+			raw, err := app.Storage.Get(index)
+			if err != nil {
+				return data, nil
+			}
+			obj, err := meta.Decode(raw)
+			if err != nil {
+				return data, nil
+			}
+			if canonical(obj.Data) != nil && bytes.Equal(canonical(obj.Data), canonical(data)) {
+				return nil, ErrNoop
+			}
+			return data, nil
+		},
+	})
+}
+
+// filterKind paths of the filters of a kind in registration order
+type filterKind struct {
+	name  string
+	paths []string
+}
+
+// kinds of the registered filters, the first match of a kind applies
+func (f filters) kinds() []filterKind {
+	routers := []struct {
+		name string
+		r    router
+	}{{"write", f.Write}, {"read", f.Read}, {"dedupe", f.Dedupe}, {"derive", f.Derive}}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch} {
+		routers = append(routers, struct {
+			name string
+			r    router
+		}{"write " + method, f.WriteMethod.method(method)})
+	}
+	kinds := []filterKind{}
+	for _, r := range routers {
+		kind := filterKind{name: r.name}
+		for _, filter := range r.r {
+			kind.paths = append(kind.paths, filter.path)
+		}
+		kinds = append(kinds, kind)
+	}
+	kind := filterKind{name: "delete"}
+	for _, hook := range f.Delete {
+		kind.paths = append(kind.paths, hook.path)
+	}
+	kinds = append(kinds, kind)
+	kind = filterKind{name: "after write"}
+	for _, watch := range f.AfterWrite {
+		kind.paths = append(kind.paths, watch.path)
+	}
+	kinds = append(kinds, kind)
+	kind = filterKind{name: "raw", paths: f.Raw}
+	kinds = append(kinds, kind)
+	kind = filterKind{name: "max list"}
+	for _, l := range f.MaxList {
+		kind.paths = append(kind.paths, l.path)
+	}
+
+	return append(kinds, kind)
+}
+
+// paths of every registered filter
+func (f filters) paths() []string {
+	paths := []string{}
+	for _, kind := range f.kinds() {
+		paths = append(paths, kind.paths...)
+	}
+	for _, migration := range f.Migrate {
+		paths = append(paths, migration.path)
+	}
+	for _, ref := range f.References {
+		paths = append(paths, ref.path)
+	}
+
+	return paths
+}
+
+// OrphanKeys lists the stored keys that don't match the path of any filter,
+// data stranded after its filter was removed (unreachable in static mode)
+func (app *Server) OrphanKeys() ([]string, error) {
+	raw, err := app.Storage.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var stats Stats
+	err = json.Unmarshal(raw, &stats)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := app.filterSet().paths()
+	orphans := []string{}
+	for _, stored := range stats.Keys {
+		orphan := true
+		for _, path := range paths {
+			if key.Match(path, stored) {
+				orphan = false
+				break
+			}
+		}
+		if orphan {
+			orphans = append(orphans, stored)
+		}
+	}
+
+	return orphans, nil
+}
+
+// Derive function that computes fields of the data
+type Derive func(data json.RawMessage) (json.RawMessage, error)
+
+// DeriveFilter add a filter that computes derived fields of the data written with POST, PUT
+// and PATCH, runs after the write filters and before storage, the patches (PATCH and PUT
+// with merge=true) are derived from the merged object, an error rejects the write
+func (app *Server) DeriveFilter(path string, derive Derive) {
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.Derive = append(set.Derive, filter{
+		path: path,
+		apply: func(index string, data json.RawMessage) (json.RawMessage, error) {
+			return derive(data)
+		},
+	})
+}
+
+// has a filter for the path
+func (r router) has(path string) bool {
+	for _, filter := range r {
+		if filter.path == path || key.Match(filter.path, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// patchDerived merges the data into the key (or the keys matching a glob) with the fields
+// of the derive filters computed on the merged object
+func (app *Server) patchDerived(_key string, data json.RawMessage) (string, error) {
+	derive := app.filterSet().Derive
+	if !derive.has(_key) {
+		return app.Storage.Patch(_key, data)
+	}
+
+	raw, err := app.Storage.Get(_key)
+	if err != nil {
+		return _key, err
+	}
+	if !strings.Contains(_key, "*") {
+		obj, err := meta.Decode(raw)
+		if err != nil {
+			return _key, err
+		}
+		derived, err := app.derivePatch(obj.Path, obj.Data, data)
+		if err != nil {
+			return _key, err
+		}
+		return app.Storage.Patch(_key, derived)
+	}
+
+	objs, err := meta.DecodeList(raw)
+	if err != nil {
+		return _key, err
+	}
+	for _, obj := range objs {
+		derived, err := app.derivePatch(obj.Path, obj.Data, data)
+		if err != nil {
+			return _key, err
+		}
+		_, err = app.Storage.Patch(obj.Path, derived)
+		if err != nil && err != ErrNoop {
+			return _key, err
+		}
+	}
+
+	return _key, nil
+}
+
+// derivePatch the patch with the top level fields that the derive filters
+// change (or remove, set to null) in the result of merging it into the stored data
+func (app *Server) derivePatch(path string, stored json.RawMessage, data json.RawMessage) (json.RawMessage, error) {
+	merged, _, err := merge.MergeBytes(stored, data)
+	if err != nil {
+		return nil, err
+	}
+	derived, err := app.filterSet().Derive.check(path, merged, false)
+	if err != nil {
+		if _, ok := asHTTPError(err); ok {
+			return nil, err
+		}
+		return nil, HTTPError{Status: http.StatusBadRequest, Msg: err.Error()}
+	}
+
+	var patchFields, mergedFields, derivedFields map[string]json.RawMessage
+	err = json.Unmarshal(data, &patchFields)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(merged, &mergedFields)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(derived, &derivedFields)
+	if err != nil {
+		return nil, err
+	}
+	for field, value := range derivedFields {
+		if !bytes.Equal(canonical(value), canonical(mergedFields[field])) {
+			patchFields[field] = value
+		}
+	}
+	for field := range mergedFields {
+		if _, found := derivedFields[field]; !found {
+			patchFields[field] = json.RawMessage("null")
+		}
+	}
+
+	return json.Marshal(patchFields)
+}
+
+// Policy of a list that reached its maximum size
+type Policy int
+
+const (
+	// Reject new items of a full list with a conflict status
+	Reject Policy = iota
+	// EvictOldest deletes the oldest items of a full list after a new item is stored
+	EvictOldest
+)
+
+// ErrListFull the list reached its maximum size
+var ErrListFull = errors.New("ooo: list is full")
+
+type list struct {
+	path   string
+	max    int
+	onFull Policy
+}
+
+type lists []list
+
+// MaxListFilter add a filter that limits the number of items of the list path,
+// writes of new items to a full list are rejected or evict the oldest items
+func (app *Server) MaxListFilter(path string, max int, onFull Policy) {
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.MaxList = append(set.MaxList, list{
+		path:   path,
+		max:    max,
+		onFull: onFull,
+	})
+}
+
+// match the first list of the path
+func (r lists) match(path string) (list, bool) {
+	for _, l := range r {
+		if key.Match(l.path, path) {
+			return l, true
+		}
+	}
+
+	return list{}, false
+}
+
+// reserveList checks the size of the list of the path before a write, the returned
+// function must be called after the write to evict the oldest items and release the list
+func (app *Server) reserveList(path string) (func(), error) {
+	l, ok := app.filterSet().MaxList.match(path)
+	if !ok {
+		return func() {}, nil
+	}
+
+	lock := app.listLock(l)
+	lock.Lock()
+	release := func() {
+		if l.onFull == EvictOldest {
+			app.evictOldest(l)
+		}
+		lock.Unlock()
+	}
+	if l.onFull != Reject {
+		return release, nil
+	}
+
+	err := app.listFull(l, path)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// checkList checks the size of the list of the path without reserving
+// it, a dry run of a write the list would reject responds the same
+func (app *Server) checkList(path string) error {
+	l, ok := app.filterSet().MaxList.match(path)
+	if !ok || l.onFull != Reject {
+		return nil
+	}
+
+	lock := app.listLock(l)
+	lock.Lock()
+	defer lock.Unlock()
+	return app.listFull(l, path)
+}
+
+// listLock the lock of the writes to a list, writes to other lists don't wait for it
+func (app *Server) listLock(l list) *sync.Mutex {
+	lock, _ := app.listLocks.LoadOrStore(l.path, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// listFull rejects a new item of a full list, requires the list lock
+func (app *Server) listFull(l list, path string) error {
+	_, err := app.Storage.Get(path)
+	if err == nil {
+		return nil
+	}
+	items, err := app.listSize(l.path)
+	if err != nil {
+		return err
+	}
+	if items >= l.max {
+		return HTTPError{Status: http.StatusConflict, Msg: ErrListFull.Error()}
+	}
+
+	return nil
+}
+
+// listSize number of items stored in the list path
+func (app *Server) listSize(path string) (int, error) {
+	raw, err := app.Storage.Get(path)
+	if err != nil {
+		return 0, err
+	}
+	objs, err := meta.DecodeList(raw)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(objs), nil
+}
+
+// evictOldest deletes the oldest items of the list over its maximum size
+func (app *Server) evictOldest(l list) {
+	raw, err := app.Storage.Get(l.path)
+	if err != nil {
+		app.Console.Err("ooo: evict list", l.path, err)
+		return
+	}
+	objs, err := meta.DecodeList(raw)
+	if err != nil {
+		app.Console.Err("ooo: evict list", l.path, err)
+		return
+	}
+	for i := 0; i < len(objs)-l.max; i++ {
+		err = app.Storage.Del(objs[i].Path)
+		if err != nil {
+			app.Console.Err("ooo: evict list", objs[i].Path, err)
+		}
+	}
+}
+
+type reference struct {
+	path     string
+	field    string
+	template string
+	required bool
+}
+
+type references []reference
+
+// ForeignKeyFilter add a filter that rejects with a 409 status the writes to the path
+// that reference a key that isn't stored, the referenced key is the template with
+// "{field}" replaced by the value of the field of the data, a write without the field
+// is rejected when required, every foreign key filter that matches the path applies
+func (app *Server) ForeignKeyFilter(path string, field string, template string, required bool) {
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.References = append(set.References, reference{
+		path:     path,
+		field:    field,
+		template: template,
+		required: required,
+	})
+}
+
+// checkReferences verifies that the keys referenced by the data are stored,
+// partial data (patch) only checks the fields it includes
+func (app *Server) checkReferences(path string, data json.RawMessage, partial bool) error {
+	refs := app.filterSet().References
+	if len(refs) == 0 {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	for _, ref := range refs {
+		if !key.Match(ref.path, path) {
+			continue
+		}
+		if fields == nil {
+			err := json.Unmarshal(data, &fields)
+			if err != nil {
+				return err
+			}
+		}
+
+		raw, found := fields[ref.field]
+		if !found || string(raw) == "null" {
+			if ref.required && !partial {
+				return errors.New("ooo: reference " + ref.field + " is required")
+			}
+			continue
+		}
+
+		var value interface{}
+		err := json.Unmarshal(raw, &value)
+		if err != nil {
+			return err
+		}
+		var id string
+		switch v := value.(type) {
+		case string:
+			id = v
+		case float64:
+			id = string(raw)
+		default:
+			return errors.New("ooo: reference " + ref.field + " must be a string or number")
+		}
+
+		refKey := strings.ReplaceAll(ref.template, "{"+ref.field+"}", id)
+		if !app.validKey(refKey) || strings.Contains(refKey, "*") {
+			return errors.New("ooo: reference " + ref.field + " is not a valid key")
+		}
+		_, err = app.Storage.Get(refKey)
+		if err == ErrNotFound {
+			return HTTPError{Status: http.StatusConflict, Msg: "ooo: reference " + refKey + " not found"}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchers paths of a flag
+type matchers []string
+
+// match the path with any of the matchers
+func (r matchers) match(path string) bool {
+	for _, m := range r {
+		if key.Match(m, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RawFilter add a filter that stores the body of the writes to the path verbatim without
+// requiring it to be JSON (it must be UTF-8 text), the data is stored as a JSON string
+// that other filters receive as is, reads of a key of the path respond the text
+func (app *Server) RawFilter(path string) {
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.Raw = append(set.Raw, path)
+}
+
+// Migrate function that upgrades the data of an object to the next schema version
+type Migrate func(data json.RawMessage) (json.RawMessage, error)
+
+type migration struct {
+	path  string
+	from  int
+	apply Migrate
+}
+
+type migrations []migration
+
+// MigrateFilter add a filter that upgrades the objects stored with the from schema
+// version to the next version when they are read, migrations of consecutive
+// versions are chained, the stored objects are not modified
+func (app *Server) MigrateFilter(path string, from int, migrate Migrate) {
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.Migrate = append(set.Migrate, migration{
+		path:  path,
+		from:  from,
+		apply: migrate,
+	})
+}
+
+// upgrade an object through the migrations of its path and schema
+func (r migrations) upgrade(obj *meta.Object) (bool, error) {
+	upgraded := false
+	for {
+		match := -1
+		for i, migration := range r {
+			if migration.from == obj.Schema && (migration.path == obj.Path || key.Match(migration.path, obj.Path)) {
+				match = i
+				break
+			}
+		}
+
+		if match == -1 {
+			return upgraded, nil
+		}
+
+		data, err := r[match].apply(obj.Data)
+		if err != nil {
+			return upgraded, err
+		}
+		obj.Data = data
+		obj.Schema = r[match].from + 1
+		upgraded = true
+	}
+}
+
+// check upgrades the objects of the stored data of a path
+func (r migrations) check(path string, raw []byte) ([]byte, error) {
+	if len(r) == 0 {
+		return raw, nil
+	}
+
+	if !strings.Contains(path, "*") {
+		obj, err := meta.Decode(raw)
+		if err != nil || obj.Created == 0 {
+			return raw, nil
+		}
+		upgraded, err := r.upgrade(&obj)
+		if err != nil || !upgraded {
+			return raw, err
+		}
+		return meta.New(&obj), nil
+	}
+
+	objs, err := meta.DecodeList(raw)
+	if err != nil {
+		return raw, nil
+	}
+	upgradedAny := false
+	for i := range objs {
+		upgraded, err := r.upgrade(&objs[i])
+		if err != nil {
+			return raw, err
+		}
+		upgradedAny = upgradedAny || upgraded
+	}
+	if !upgradedAny {
+		return raw, nil
+	}
+
+	return meta.Encode(objs)
+}
+
+// canonical encoding of json data with sorted keys
+func canonical(data json.RawMessage) []byte {
+	var decoded interface{}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return nil
+	}
+	encoded, err := json.Marshal(decoded)
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
 // ReadFilter add a filter that runs before sending a read result
 func (app *Server) ReadFilter(path string, apply Apply) {
-	app.filters.Read = append(app.filters.Read, filter{
+	app.filtersMutex.Lock()
+	defer app.filtersMutex.Unlock()
+	set := app.registering()
+	set.Read = append(set.Read, filter{
 		path:  path,
 		apply: apply,
 	})
 }
 
+type cachedRead struct {
+	input   []byte
+	output  json.RawMessage
+	expires time.Time
+}
+
+// readCacheSize limit of the entries of a read cache
+const readCacheSize = 1024
+
+// readCache results of a read filter by key
+type readCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedRead
+}
+
+// wrap the apply function to reuse its results, an entry is valid
+// during the ttl and while the data of the key is unchanged
+func (c *readCache) wrap(apply Apply) Apply {
+	return func(index string, data json.RawMessage) (json.RawMessage, error) {
+		c.mutex.Lock()
+		entry, ok := c.entries[index]
+		if ok && !time.Now().Before(entry.expires) {
+			delete(c.entries, index)
+			ok = false
+		}
+		c.mutex.Unlock()
+		if ok && bytes.Equal(entry.input, data) {
+			return entry.output, nil
+		}
+
+		output, err := apply(index, data)
+		if err != nil {
+			return nil, err
+		}
+		c.store(index, cachedRead{
+			input:   append([]byte{}, data...),
+			output:  output,
+			expires: time.Now().Add(c.ttl),
+		})
+		return output, nil
+	}
+}
+
+// store an entry, when the cache is full the expired entries are
+// removed and if none expired the one closest to expiring
+func (c *readCache) store(index string, entry cachedRead) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[index]; !ok && len(c.entries) >= readCacheSize {
+		now := time.Now()
+		oldest := ""
+		for k, cached := range c.entries {
+			if !now.Before(cached.expires) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldest == "" || cached.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= readCacheSize {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[index] = entry
+}
+
+// CachedListFilter add a read filter that reuses the result of an expensive apply function
+// for reads and broadcasts of the same key during the ttl, a write to the path changes
+// the data of the key and invalidates the result, errors are not cached, up to 1024
+// keys are cached and the entries closest to expiring are dropped to make room
+func (app *Server) CachedListFilter(path string, ttl time.Duration, apply Apply) {
+	cache := &readCache{
+		ttl:     ttl,
+		entries: map[string]cachedRead{},
+	}
+	app.ReadFilter(path, cache.wrap(apply))
+}
+
 // NoopHook open noop hook
 func NoopHook(index string) error {
 	return nil
@@ -141,6 +966,20 @@ func (r hooks) check(path string, static bool) error {
 	return r[match].apply(path)
 }
 
+func (r hooks) checkStatic(path string, static bool) error {
+	for _, filter := range r {
+		if filter.path == path || key.Match(filter.path, path) {
+			return nil
+		}
+	}
+
+	if static {
+		return errors.New("route not defined, static mode, key:" + path)
+	}
+
+	return nil
+}
+
 func (r router) checkStatic(path string, static bool) error {
 	match := -1
 	for i, filter := range r {
@@ -4,14 +4,27 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/benitogf/jsondiff"
 	"github.com/goccy/go-json"
 
+	"github.com/benitogf/ooo/messages"
+	"github.com/benitogf/ooo/meta"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 func TestFilters(t *testing.T) {
@@ -114,3 +127,842 @@ func TestFilters(t *testing.T) {
 	comparison, _ = jsondiff.Compare(body, interceptedData, &jsondiff.Options{})
 	require.Equal(t, comparison, jsondiff.FullMatch)
 }
+
+func TestDedupeWriteFilter(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.DedupeWriteFilter("test")
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	write := func(data string) {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer([]byte(data)))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Result().StatusCode)
+	}
+	stored := func() meta.Object {
+		raw, err := app.Storage.Get("test")
+		require.NoError(t, err)
+		obj, err := meta.Decode(raw)
+		require.NoError(t, err)
+		return obj
+	}
+
+	write(`{"a":1,"b":2}`)
+	first := stored()
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	write(`{"b":2, "a":1}`)
+	require.Equal(t, first.Updated, stored().Updated)
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = c.ReadMessage()
+	require.Error(t, err)
+
+	c2, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c2.Close()
+	_, _, err = c2.ReadMessage()
+	require.NoError(t, err)
+
+	write(`{"a":1,"b":3}`)
+	require.NotEqual(t, first.Updated, stored().Updated)
+	_, raw, err := c2.ReadMessage()
+	require.NoError(t, err)
+	msg, err := messages.DecodeBuffer(raw)
+	require.NoError(t, err)
+	require.False(t, msg.Snapshot)
+}
+
+func TestFilterHTTPError(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.ReadFilter("forbidden", func(key string, data json.RawMessage) (json.RawMessage, error) {
+		return nil, HTTPError{
+			Status: http.StatusForbidden,
+			Msg:    "forbidden by policy",
+			Header: http.Header{"Cache-Control": []string{"no-store"}},
+		}
+	})
+	app.ReadFilter("gone", func(key string, data json.RawMessage) (json.RawMessage, error) {
+		return nil, &HTTPError{Status: http.StatusGone, Msg: "gone"}
+	})
+	app.WriteFilter("plain", func(key string, data json.RawMessage) (json.RawMessage, error) {
+		return nil, errors.New("plain")
+	})
+	app.DeleteFilter("gone", func(key string) error {
+		return HTTPError{Status: http.StatusGone, Msg: "gone"}
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("GET", "/forbidden", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "forbidden by policy", string(body))
+
+	req = httptest.NewRequest("GET", "/gone", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusGone, w.Result().StatusCode)
+
+	req = httptest.NewRequest("DELETE", "/gone", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusGone, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "/plain", bytes.NewBuffer([]byte(`{"test":1}`)))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestDeriveFilter(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.WriteFilter("users/*", func(index string, data json.RawMessage) (json.RawMessage, error) {
+		if !gjson.GetBytes(data, "first").Exists() {
+			return nil, errors.New("first name is required")
+		}
+		return data, nil
+	})
+	app.DeriveFilter("users/*", func(data json.RawMessage) (json.RawMessage, error) {
+		last := gjson.GetBytes(data, "last")
+		if last.Type != gjson.String {
+			return nil, errors.New("last name must be a string")
+		}
+		return sjson.SetBytes(data, "fullName", gjson.GetBytes(data, "first").String()+" "+last.String())
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	write := func(method string, path string, data string) int {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(data)))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+	stored := func() json.RawMessage {
+		raw, err := app.Storage.Get("users/1")
+		require.NoError(t, err)
+		obj, err := meta.Decode(raw)
+		require.NoError(t, err)
+		return obj.Data
+	}
+
+	require.Equal(t, http.StatusOK, write("POST", "/users/1", `{"first":"Ada","last":"Lovelace"}`))
+	require.Equal(t, "Ada Lovelace", gjson.GetBytes(stored(), "fullName").String())
+
+	// rewriting the derived data is idempotent
+	first := stored()
+	require.Equal(t, http.StatusOK, write("PUT", "/users/1", string(first)))
+	require.JSONEq(t, string(first), string(stored()))
+
+	require.Equal(t, http.StatusBadRequest, write("POST", "/users/2", `{"last":"Lovelace"}`))
+	require.Equal(t, http.StatusBadRequest, write("POST", "/users/2", `{"first":"Ada","last":1}`))
+	_, err := app.Storage.Get("users/2")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// patches are derived from the merged object
+	require.Equal(t, http.StatusOK, write("PATCH", "/users/1", `{"first":"Augusta","last":"King"}`))
+	require.Equal(t, "Augusta King", gjson.GetBytes(stored(), "fullName").String())
+	require.Equal(t, http.StatusOK, write("PUT", "/users/1?merge=true", `{"first":"Ada","last":"Byron"}`))
+	require.Equal(t, "Ada Byron", gjson.GetBytes(stored(), "fullName").String())
+	require.Equal(t, http.StatusBadRequest, write("PATCH", "/users/1", `{"first":"Ada","last":1}`))
+	require.Equal(t, "Ada Byron", gjson.GetBytes(stored(), "fullName").String())
+
+	// merge upserts of new keys and glob patches
+	require.Equal(t, http.StatusOK, write("PUT", "/users/2?merge=true", `{"first":"Grace","last":"Hopper"}`))
+	require.Equal(t, http.StatusOK, write("PATCH", "/users/*", `{"first":"Mary","last":"Hopper"}`))
+	app.Sync()
+	for _, path := range []string{"users/1", "users/2"} {
+		raw, err := app.Storage.Get(path)
+		require.NoError(t, err)
+		obj, err := meta.Decode(raw)
+		require.NoError(t, err)
+		require.Equal(t, "Mary Hopper", gjson.GetBytes(obj.Data, "fullName").String())
+	}
+}
+
+func TestReloadFilters(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.ReadFilter("secret", func(index string, data json.RawMessage) (json.RawMessage, error) {
+		return json.RawMessage(`{"redacted":true}`), nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	_, err := app.Storage.Set("secret", json.RawMessage(`{"pin":1234}`))
+	require.NoError(t, err)
+
+	request := func(method string, path string, data string) (int, string) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(data)))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode, w.Body.String()
+	}
+
+	status, body := request("GET", "/secret", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, `{"redacted":true}`, body)
+	status, _ = request("POST", "/test", `{"bad":true}`)
+	require.Equal(t, http.StatusOK, status)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+	u = url.URL{Scheme: "ws", Host: app.Address, Path: "/secret"}
+	secret, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer secret.Close()
+	_, raw, err := secret.ReadMessage()
+	require.NoError(t, err)
+	secretCache, err := messages.PatchCache(raw, []byte{})
+	require.NoError(t, err)
+	require.Equal(t, `{"redacted":true}`, string(secretCache))
+
+	app.ReloadFilters(func(server *Server) {
+		server.WriteFilter("test", func(index string, data json.RawMessage) (json.RawMessage, error) {
+			if gjson.GetBytes(data, "bad").Bool() {
+				return nil, errors.New("bad data")
+			}
+			return data, nil
+		})
+	})
+
+	status, _ = request("POST", "/test", `{"bad":true}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, body = request("GET", "/secret", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, `"pin":1234`)
+
+	// subscribers get their data without the removed read filter
+	_, raw, err = secret.ReadMessage()
+	require.NoError(t, err)
+	secretCache, err = messages.PatchCache(raw, secretCache)
+	require.NoError(t, err)
+	obj, err := meta.Decode(secretCache)
+	require.NoError(t, err)
+	require.Equal(t, `{"pin":1234}`, string(obj.Data))
+
+	// the subscription survives the reload
+	status, _ = request("POST", "/test", `{"bad":false}`)
+	require.Equal(t, http.StatusOK, status)
+	_, raw, err = c.ReadMessage()
+	require.NoError(t, err)
+	cache, err := messages.PatchCache(raw, []byte{})
+	require.NoError(t, err)
+	obj, err = meta.Decode(cache)
+	require.NoError(t, err)
+	require.Equal(t, `{"bad":false}`, string(obj.Data))
+}
+
+func TestMigrateFilter(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.MigrateFilter("users/*", 1, func(data json.RawMessage) (json.RawMessage, error) {
+		data, err := sjson.SetBytes(data, "fullName", gjson.GetBytes(data, "name").String())
+		if err != nil {
+			return nil, err
+		}
+		return sjson.DeleteBytes(data, "name")
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	request := func(method string, path string, data string, schema string) (int, string) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(data)))
+		if schema != "" {
+			req.Header.Set("X-Schema", schema)
+		}
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode, w.Body.String()
+	}
+
+	status, _ := request("POST", "/users/1", `{"name":"Ada"}`, "1")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = request("POST", "/users/2", `{"fullName":"Bob"}`, "2")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = request("POST", "/users/3", `{"name":"Eve"}`, "one")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, body := request("GET", "/users/1", "", "")
+	require.Equal(t, http.StatusOK, status)
+	obj, err := meta.Decode([]byte(body))
+	require.NoError(t, err)
+	require.Equal(t, 2, obj.Schema)
+	require.Equal(t, `{"fullName":"Ada"}`, string(obj.Data))
+
+	// the stored object keeps the original version
+	raw, err := app.Storage.Get("users/1")
+	require.NoError(t, err)
+	stored, err := meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, 1, stored.Schema)
+	require.Equal(t, `{"name":"Ada"}`, string(stored.Data))
+
+	// already upgraded objects are untouched
+	status, body = request("GET", "/users/2", "", "")
+	require.Equal(t, http.StatusOK, status)
+	obj, err = meta.Decode([]byte(body))
+	require.NoError(t, err)
+	require.Equal(t, 2, obj.Schema)
+	require.Equal(t, `{"fullName":"Bob"}`, string(obj.Data))
+
+	status, body = request("GET", "/users/*", "", "")
+	require.Equal(t, http.StatusOK, status)
+	objs, err := meta.DecodeList([]byte(body))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(objs))
+	for _, obj := range objs {
+		require.Equal(t, 2, obj.Schema)
+		require.True(t, gjson.GetBytes(obj.Data, "fullName").Exists())
+	}
+}
+
+func TestMaxListFilter(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.MaxListFilter("rejected/*", 2, Reject)
+	app.MaxListFilter("evicted/*", 2, EvictOldest)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	push := func(path string, data string) int {
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer([]byte(data)))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+	items := func(path string) []meta.Object {
+		raw, err := app.Storage.Get(path)
+		require.NoError(t, err)
+		objs, err := meta.DecodeList(raw)
+		require.NoError(t, err)
+		return objs
+	}
+
+	require.Equal(t, http.StatusOK, push("/rejected/*", `{"n":1}`))
+	require.Equal(t, http.StatusOK, push("/rejected/*", `{"n":2}`))
+	require.Equal(t, http.StatusConflict, push("/rejected/*", `{"n":3}`))
+	require.Equal(t, 2, len(items("rejected/*")))
+
+	// updates of existing items don't grow the list
+	index := items("rejected/*")[0].Index
+	require.Equal(t, http.StatusOK, push("/rejected/"+index, `{"n":4}`))
+
+	// dry runs respond the same as the writes
+	require.Equal(t, http.StatusConflict, push("/rejected/*?dryRun=true", `{"n":5}`))
+	require.Equal(t, http.StatusOK, push("/rejected/"+index+"?dryRun=true", `{"n":5}`))
+	req := httptest.NewRequest("PUT", "/rejected/new?dryRun=true", bytes.NewBuffer([]byte(`{"n":5}`)))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusConflict, w.Result().StatusCode)
+
+	for i := 1; i <= 4; i++ {
+		require.Equal(t, http.StatusOK, push("/evicted/*", `{"n":`+strconv.Itoa(i)+`}`))
+	}
+	objs := items("evicted/*")
+	require.Equal(t, 2, len(objs))
+	require.JSONEq(t, `{"n":3}`, string(objs[0].Data))
+	require.JSONEq(t, `{"n":4}`, string(objs[1].Data))
+
+	// a write in progress on a list doesn't block the writes of other lists
+	l, _ := app.filterSet().MaxList.match("rejected/*")
+	lock := app.listLock(l)
+	lock.Lock()
+	pushed := make(chan int)
+	go func() {
+		pushed <- push("/evicted/*", `{"n":5}`)
+	}()
+	select {
+	case status := <-pushed:
+		require.Equal(t, http.StatusOK, status)
+	case <-time.After(time.Second):
+		t.Fatal("write blocked by the lock of another list")
+	}
+	lock.Unlock()
+}
+
+func TestOrphanKeys(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.OpenFilter("books/*")
+	app.ReadFilter("config", NoopFilter)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	for _, stored := range []string{"books/1", "books/2", "config", "stranded", "stranded/1"} {
+		_, err := app.Storage.Set(stored, json.RawMessage(`{"test":true}`))
+		require.NoError(t, err)
+	}
+
+	orphans, err := app.OrphanKeys()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"stranded", "stranded/1"}, orphans)
+
+	req := httptest.NewRequest("GET", "/?api=orphans", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var stats Stats
+	err = json.NewDecoder(w.Result().Body).Decode(&stats)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"stranded", "stranded/1"}, stats.Keys)
+}
+
+func TestCachedListFilter(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	var calls atomic.Int64
+	app.CachedListFilter("books/*", time.Minute, func(index string, data json.RawMessage) (json.RawMessage, error) {
+		calls.Add(1)
+		objs, err := meta.DecodeList(data)
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(`{"count":` + strconv.Itoa(len(objs)) + `}`), nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	read := func() string {
+		req := httptest.NewRequest("GET", "/books/*", nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	_, err := app.Storage.Set("books/1", json.RawMessage(`{"title":"taup"}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"count":1}`, read())
+	require.JSONEq(t, `{"count":1}`, read())
+	require.Equal(t, int64(1), calls.Load())
+
+	// the subscription snapshot reuses the cached value
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/books/*"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), calls.Load())
+
+	// a write invalidates the cache, the broadcast computes the value once
+	// and the next read reuses it
+	_, err = app.Storage.Set("books/2", json.RawMessage(`{"title":"rumble"}`))
+	require.NoError(t, err)
+	app.Sync()
+	_, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(message), "count")
+	require.Equal(t, int64(2), calls.Load())
+	require.JSONEq(t, `{"count":2}`, read())
+	require.Equal(t, int64(2), calls.Load())
+}
+
+func TestValidateFilters(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Router = mux.NewRouter()
+	app.Router.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {})
+	app.EndpointGroup("/billing", func(r *mux.Router) {
+		r.HandleFunc("/invoices/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	})
+	app.OpenFilter("books/*")
+	app.WriteFilter("books/special", NoopFilter)
+	app.ReadFilter("*", NoopFilter)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// overlapping globs are allowed with a warning
+	warnings, err := app.validateFilters()
+	require.NoError(t, err)
+	require.Contains(t, warnings, "ooo: write filter books/special is shadowed by books/*")
+	require.Contains(t, warnings, "ooo: read filter * overlaps the route /status")
+	require.NoError(t, app.ValidateFilters())
+
+	app.ReloadFilters(func(server *Server) {
+		server.ReadFilter("billing/invoices/*", NoopFilter)
+	})
+	err = app.ValidateFilters()
+	require.ErrorIs(t, err, ErrFilterConflict)
+	require.Contains(t, err.Error(), "collides with the route /billing/invoices/*")
+
+	app.ReloadFilters(func(server *Server) {
+		server.ReadFilter("subscribe", NoopFilter)
+	})
+	require.ErrorIs(t, app.ValidateFilters(), ErrFilterConflict)
+
+	app.ReloadFilters(func(server *Server) {
+		server.OpenFilter("books/*")
+		server.DeleteFilter("books/*", func(key string) error {
+			return errors.New("can't delete")
+		})
+	})
+	err = app.ValidateFilters()
+	require.ErrorIs(t, err, ErrFilterConflict)
+	require.Contains(t, err.Error(), "delete filter registered twice for books/*")
+}
+
+func TestForeignKeyFilter(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.ForeignKeyFilter("orders/*", "customerId", "customers/{customerId}", true)
+	app.ForeignKeyFilter("orders/*", "couponId", "coupons/{couponId}", false)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	write := func(method string, path string, data string) int {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(data)))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	_, err := app.Storage.Set("customers/ada", json.RawMessage(`{"name":"Ada"}`))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("coupons/7", json.RawMessage(`{"discount":10}`))
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusOK, write("POST", "/orders/1", `{"customerId":"ada"}`))
+	require.Equal(t, http.StatusOK, write("POST", "/orders/2", `{"customerId":"ada","couponId":7}`))
+	require.Equal(t, http.StatusConflict, write("POST", "/orders/3", `{"customerId":"bob"}`))
+	require.Equal(t, http.StatusConflict, write("PUT", "/orders/3", `{"customerId":"ada","couponId":8}`))
+	require.Equal(t, http.StatusBadRequest, write("POST", "/orders/3", `{"total":10}`))
+	require.Equal(t, http.StatusBadRequest, write("POST", "/orders/3", `{"customerId":"bob smith"}`))
+	_, err = app.Storage.Get("orders/3")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// patches only check the fields they include
+	require.Equal(t, http.StatusOK, write("PATCH", "/orders/1", `{"total":10}`))
+	require.Equal(t, http.StatusConflict, write("PATCH", "/orders/1", `{"customerId":"bob"}`))
+}
+
+func TestOpenAPI(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.OpenFilter("books/*")
+	app.ReadFilter("config", NoopFilter)
+	app.EndpointGroup("/billing", func(r *mux.Router) {
+		r.HandleFunc("/invoices/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET", "DELETE")
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("GET", "/?api=openapi", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	body, err := io.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+
+	require.Equal(t, OpenAPIVersion, gjson.GetBytes(body, "openapi").String())
+	require.True(t, gjson.GetBytes(body, "info.title").Exists())
+	require.True(t, gjson.GetBytes(body, "info.version").Exists())
+
+	methods := func(path string) []string {
+		res := []string{}
+		gjson.GetBytes(body, "paths."+gjson.Escape(path)).ForEach(func(method, _ gjson.Result) bool {
+			res = append(res, method.String())
+			return true
+		})
+		return res
+	}
+	require.ElementsMatch(t, []string{"get", "post"}, methods("/books/*"))
+	require.ElementsMatch(t, []string{"get", "post", "put", "patch", "delete"}, methods("/books/{index}"))
+	require.ElementsMatch(t, []string{"get"}, methods("/config"))
+	require.ElementsMatch(t, []string{"get", "delete"}, methods("/billing/invoices/{id}"))
+	require.Equal(t, "#/components/schemas/Objects",
+		gjson.GetBytes(body, `paths./books/\*.get.responses.200.content.application/json.schema.$ref`).String())
+
+	// every path parameter is declared and every reference resolves
+	gjson.GetBytes(body, "paths").ForEach(func(path, operations gjson.Result) bool {
+		require.True(t, strings.HasPrefix(path.String(), "/"))
+		operations.ForEach(func(method, operation gjson.Result) bool {
+			require.True(t, operation.Get("responses").IsObject(), path.String()+" "+method.String())
+			for _, match := range routeParam.FindAllStringSubmatch(path.String(), -1) {
+				param := operation.Get(`parameters.#(name=="` + match[1] + `")`)
+				require.Equal(t, "path", param.Get("in").String(), path.String())
+				require.True(t, param.Get("required").Bool())
+			}
+			return true
+		})
+		return true
+	})
+	for _, ref := range regexp.MustCompile(`"\$ref":"#/components/schemas/(\w+)"`).FindAllSubmatch(body, -1) {
+		require.True(t, gjson.GetBytes(body, "components.schemas."+string(ref[1])).Exists())
+	}
+}
+
+func TestMaskFilter(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.WriteFilter("users/*", NoopFilter)
+	app.MaskFilter("users/*", []MaskRule{
+		{Field: "email", Mask: Hash},
+		{Field: "card", Mask: Last4},
+		{Field: "contact.phone", Mask: Fixed, Value: "hidden"},
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	user := `{"email":"bob@example.com","card":"4111111111111111","contact":{"phone":"555-1234"},"name":"bob"}`
+	_, err := app.Storage.Set("users/1", json.RawMessage(user))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("users/2", json.RawMessage(`{"email":"bob@example.com","name":"other"}`))
+	require.NoError(t, err)
+
+	read := func(path string) []byte {
+		req := httptest.NewRequest("GET", "/"+path, nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		return body
+	}
+
+	object := read("users/1")
+	email := gjson.GetBytes(object, "data.email").String()
+	require.Len(t, email, 64)
+	require.NotContains(t, string(object), "bob@example.com")
+	require.Equal(t, "************1111", gjson.GetBytes(object, "data.card").String())
+	require.Equal(t, "hidden", gjson.GetBytes(object, "data.contact.phone").String())
+	require.Equal(t, "bob", gjson.GetBytes(object, "data.name").String())
+
+	// lists are masked item by item, the hash is consistent
+	list := read("users/*")
+	require.Equal(t, email, gjson.GetBytes(list, "0.data.email").String())
+	require.Equal(t, email, gjson.GetBytes(list, "1.data.email").String())
+	require.Equal(t, "************1111", gjson.GetBytes(list, "0.data.card").String())
+	require.False(t, gjson.GetBytes(list, "1.data.card").Exists())
+
+	// stored data is not masked
+	raw, err := app.Storage.Get("users/1")
+	require.NoError(t, err)
+	require.Equal(t, "bob@example.com", gjson.GetBytes(raw, "data.email").String())
+	require.Equal(t, "4111111111111111", gjson.GetBytes(raw, "data.card").String())
+}
+
+func TestWriteFilterMethod(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.WriteFilterMethod("POST", "items/*", func(index string, data json.RawMessage) (json.RawMessage, error) {
+		if !gjson.GetBytes(data, "id").Exists() {
+			return nil, errors.New("id is required")
+		}
+		return data, nil
+	})
+	app.WriteFilterMethod("PATCH", "items/*", func(index string, data json.RawMessage) (json.RawMessage, error) {
+		if gjson.GetBytes(data, "id").Exists() {
+			return nil, errors.New("id can't be updated")
+		}
+		return data, nil
+	})
+	app.WriteFilter("items/*", func(index string, data json.RawMessage) (json.RawMessage, error) {
+		if gjson.GetBytes(data, "bad").Bool() {
+			return nil, errors.New("bad item")
+		}
+		return data, nil
+	})
+	app.WriteFilterMethod("PUT", "static/*", NoopFilter)
+	app.ReadFilter("items/*", NoopFilter)
+	app.Static = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	write := func(method string, path string, body string) int {
+		req := httptest.NewRequest(method, "/"+path, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusBadRequest, write("POST", "items/1", `{"name":"one"}`))
+	require.Equal(t, http.StatusOK, write("POST", "items/1", `{"id":1,"name":"one"}`))
+	require.Equal(t, http.StatusBadRequest, write("PATCH", "items/1", `{"id":2}`))
+	require.Equal(t, http.StatusOK, write("PATCH", "items/1", `{"name":"uno"}`))
+	// the general filter runs after the method filter and for the methods without one
+	require.Equal(t, http.StatusBadRequest, write("POST", "items/2", `{"id":2,"bad":true}`))
+	require.Equal(t, http.StatusOK, write("PUT", "items/2", `{"name":"two"}`))
+	require.Equal(t, http.StatusBadRequest, write("PUT", "items/2", `{"bad":true}`))
+
+	// in static mode a method filter defines the route for its method only
+	require.Equal(t, http.StatusOK, write("PUT", "static/1", `{"name":"one"}`))
+	require.Equal(t, http.StatusBadRequest, write("POST", "static/2", `{"name":"two"}`))
+	req := httptest.NewRequest("OPTIONS", "/static/1", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, "PUT, OPTIONS", w.Result().Header.Get("Allow"))
+
+	_, err := PushWithResponse(&app, "items/*", map[string]string{"name": "three"})
+	require.Error(t, err)
+	_, err = PushWithResponse(&app, "items/*", map[string]interface{}{"id": 3})
+	require.NoError(t, err)
+	require.Error(t, Patch(&app, "items/1", map[string]int{"id": 4}))
+}
+
+func TestAggregateEndpoint(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	calls := 0
+	openByRegion := func(storage Database) (interface{}, error) {
+		calls++
+		objs, err := storage.GetN("orders/*", 100)
+		if err != nil {
+			return nil, err
+		}
+		res := map[string]int{}
+		for _, obj := range objs {
+			if gjson.GetBytes(obj.Data, "open").Bool() {
+				res[gjson.GetBytes(obj.Data, "region").String()]++
+			}
+		}
+		return res, nil
+	}
+	app.AggregateEndpoint("/stats/open", time.Hour, openByRegion, "orders/*")
+	app.AggregateEndpoint("/stats/uncached", 0, openByRegion)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	get := func(path string) string {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	_, err := app.Storage.Set("orders/1", json.RawMessage(`{"region":"eu","open":true}`))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("orders/2", json.RawMessage(`{"region":"us","open":false}`))
+	require.NoError(t, err)
+	app.Sync()
+
+	require.Equal(t, `{"eu":1}`, get("/stats/open"))
+	require.Equal(t, `{"eu":1}`, get("/stats/open"))
+	require.Equal(t, 1, calls)
+
+	// writes to other keys keep the result
+	_, err = app.Storage.Set("settings", json.RawMessage(`{"on":true}`))
+	require.NoError(t, err)
+	app.Sync()
+	get("/stats/open")
+	require.Equal(t, 1, calls)
+
+	// a write to the invalidate pattern drops it
+	_, err = app.Storage.Set("orders/3", json.RawMessage(`{"region":"us","open":true}`))
+	require.NoError(t, err)
+	app.Sync()
+	require.Equal(t, `{"eu":1,"us":1}`, get("/stats/open"))
+	require.Equal(t, 2, calls)
+
+	// without a ttl every request computes it
+	get("/stats/uncached")
+	get("/stats/uncached")
+	require.Equal(t, 4, calls)
+
+	// listed as a custom route of the openapi document
+	openapi := get("/?api=openapi")
+	require.True(t, gjson.Get(openapi, "paths."+gjson.Escape("/stats/open")+".get").Exists())
+}
+
+func TestComputeReadFilter(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	var now atomic.Int64
+	app.WriteFilter("items/*", NoopFilter)
+	app.ComputeReadFilter("items/*", func(obj meta.Object) (meta.Object, error) {
+		data, err := sjson.SetBytes(obj.Data, "age", now.Load()-obj.Created)
+		obj.Data = data
+		return obj, err
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("items/1", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+	raw, err := app.Storage.Get("items/1")
+	require.NoError(t, err)
+	stored, err := meta.Decode(raw)
+	require.NoError(t, err)
+
+	read := func(path string) []byte {
+		req := httptest.NewRequest("GET", "/"+path, nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		return w.Body.Bytes()
+	}
+	now.Store(stored.Created + 10)
+	require.Equal(t, int64(10), gjson.GetBytes(read("items/1"), "data.age").Int())
+	require.Equal(t, int64(10), gjson.GetBytes(read("items/*"), "0.data.age").Int())
+	now.Store(stored.Created + 20)
+	require.Equal(t, int64(20), gjson.GetBytes(read("items/1"), "data.age").Int())
+	require.Equal(t, "one", gjson.GetBytes(read("items/1"), "data.name").String())
+
+	// the storage doesn't have it
+	raw, err = app.Storage.Get("items/1")
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "age")
+
+	// subscription snapshots and broadcasts are computed
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "items/*"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, int64(20), gjson.GetBytes(message, "data.0.data.age").Int())
+	now.Store(stored.Created + 30)
+	_, err = app.Storage.Set("items/1", json.RawMessage(`{"name":"two"}`))
+	require.NoError(t, err)
+	_, message, err = c.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(message), `"age"`)
+}
+
+func TestReadCacheLimit(t *testing.T) {
+	cache := &readCache{
+		ttl:     time.Minute,
+		entries: map[string]cachedRead{},
+	}
+	apply := cache.wrap(NoopFilter)
+	for i := 0; i < readCacheSize+10; i++ {
+		_, err := apply("books/"+strconv.Itoa(i), json.RawMessage(`{}`))
+		require.NoError(t, err)
+	}
+	require.Equal(t, readCacheSize, len(cache.entries))
+	// the entries closest to expiring were dropped
+	_, found := cache.entries["books/0"]
+	require.False(t, found)
+	_, found = cache.entries["books/"+strconv.Itoa(readCacheSize+9)]
+	require.True(t, found)
+
+	// expired entries are removed when making room
+	for k, entry := range cache.entries {
+		entry.expires = time.Now()
+		cache.entries[k] = entry
+	}
+	_, err := apply("books/new", json.RawMessage(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(cache.entries))
+}
@@ -0,0 +1,148 @@
+package ooo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/goccy/go-json"
+
+	"github.com/benitogf/ooo/meta"
+	"github.com/benitogf/ooo/stream"
+)
+
+// ErrInvalidImport a line of a bulk import isn't a stored object
+var ErrInvalidImport = errors.New("ooo: invalid import object")
+
+// ImportError a line of a bulk import that couldn't be stored
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportResult response of a bulk import
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// importObject stores one line of a bulk import keeping its timestamps, the
+// storage event of the write has the id of the import to skip its broadcast
+func (app *Server) importObject(importID string, line []byte) (string, error) {
+	var obj meta.Object
+	err := json.Unmarshal(line, &obj)
+	if err != nil {
+		return "", err
+	}
+	if !app.validKey(obj.Path) || strings.Contains(obj.Path, "*") || len(obj.Data) == 0 || obj.Created == 0 {
+		return "", ErrInvalidImport
+	}
+	if app.auditLogged(obj.Path) {
+		return "", ErrAuditLogKey
+	}
+	data, err := app.filterSet().checkWrite(http.MethodPost, obj.Path, obj.Data, app.Static)
+	if err != nil {
+		return "", err
+	}
+
+	release := app.holdRequestID(obj.Path, importID)
+	_, err = app.Storage.SetWithMeta(obj.Path, data, obj.Created, obj.Updated)
+	release()
+	return obj.Path, err
+}
+
+// importData reads a NDJSON stream of stored objects (one meta object per line) and
+// writes them with their timestamps, the broadcasts of the imported keys are sent once
+// per subscribed pool after the import, a line that fails is reported in the response
+// and skipped unless the strict=true query parameter stops the import on it
+func (app *Server) importData(w http.ResponseWriter, r *http.Request) {
+	if !app.Audit(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", ErrNotAuthorized)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(w, "%s", errors.New("ooo: import requires an application/x-ndjson body"))
+		return
+	}
+
+	body := r.Body
+	if app.MaxBodyBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, app.MaxBodyBytes)
+	}
+	importID := app.RequestID()
+	app.importing.Store(importID, struct{}{})
+	strict := r.URL.Query().Get("strict") == "true"
+	result := ImportResult{Errors: []ImportError{}}
+	status := http.StatusOK
+	imported := []string{}
+	reader := bufio.NewReader(body)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			var tooLarge *http.MaxBytesError
+			status = http.StatusBadRequest
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			result.Errors = append(result.Errors, ImportError{Line: lineNumber, Error: err.Error()})
+			break
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			path, importErr := app.importObject(importID, line)
+			if path != "" {
+				imported = append(imported, path)
+			}
+			if importErr != nil {
+				result.Failed++
+				result.Errors = append(result.Errors, ImportError{Line: lineNumber, Error: importErr.Error()})
+				if strict {
+					status = http.StatusBadRequest
+					break
+				}
+			} else {
+				result.Imported++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	app.importDone(importID, imported)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// importDone waits for the storage events of the import and broadcasts
+// once each pool of the imported keys (items and lists)
+func (app *Server) importDone(importID string, imported []string) {
+	app.Sync()
+	app.importing.Delete(importID)
+	if len(imported) == 0 {
+		return
+	}
+	app.Stream.BroadcastAll(imported, stream.BroadcastOpt{
+		Get: func(key string) ([]byte, error) {
+			return app.filteredData(app.Storage, key)
+		},
+	})
+}
+
+// isImporting the storage event is a write of a bulk import
+func (app *Server) isImporting(requestID string) bool {
+	if requestID == "" {
+		return false
+	}
+	_, found := app.importing.Load(requestID)
+	return found
+}
@@ -0,0 +1,261 @@
+package ooo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/goccy/go-json"
+)
+
+// DefaultJournalCompact number of journal entries appended before
+// the journal is rewritten as a snapshot of the current state
+const DefaultJournalCompact = 1000
+
+type journalEntry struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type journal struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+	// entries appended since the last snapshot
+	entries int
+	// compacting serializes the snapshots, the entries appended while
+	// a snapshot is written are kept in pending to be added to it
+	compacting   sync.Mutex
+	snapshotting bool
+	pending      [][]byte
+}
+
+// Journal enables an append-only log of the storage writes on the given
+// file, the log is replayed on Start to rebuild the state after a restart,
+// appends are synced to disk only with JournalSync
+func (db *MemoryStorage) Journal(path string) {
+	db.journal = &journal{path: path}
+}
+
+func (db *MemoryStorage) journalCompact() int {
+	if db.JournalCompact <= 0 {
+		return DefaultJournalCompact
+	}
+	return db.JournalCompact
+}
+
+// replay loads the journal entries into the storage and opens the file for appends
+func (db *MemoryStorage) replay() error {
+	j := db.journal
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(j.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	valid := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a partial line is a write interrupted by a crash
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		var entry journalEntry
+		if json.Unmarshal(bytes.TrimSpace(line), &entry) != nil {
+			break
+		}
+		db.apply(entry)
+		valid += int64(len(line))
+		j.entries++
+	}
+	// drop whatever follows the last complete entry
+	err = file.Truncate(valid)
+	if err == nil {
+		_, err = file.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	j.file = file
+	return nil
+}
+
+func (db *MemoryStorage) apply(entry journalEntry) {
+	switch entry.Op {
+	case "set":
+		db.data().Store(entry.Key, []byte(entry.Value))
+		db.index.Add(entry.Key)
+	case "del":
+		db.index.Remove(entry.Key)
+		db.data().Delete(entry.Key)
+	case "clear":
+		db.index.Clear()
+		db.data().Range(func(k interface{}, value interface{}) bool {
+			db.data().Delete(k)
+			return true
+		})
+	}
+}
+
+// write applies the entry to the storage and logs it when the journal is enabled
+func (db *MemoryStorage) write(entry journalEntry) error {
+	j := db.journal
+	if j == nil {
+		db.apply(entry)
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	db.apply(entry)
+	if j.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	_, err = j.file.Write(line)
+	if err != nil {
+		return err
+	}
+	if db.JournalSync {
+		err = j.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	if j.pending != nil {
+		j.pending = append(j.pending, line)
+	}
+	j.entries++
+	if j.entries < db.journalCompact() || j.snapshotting {
+		return nil
+	}
+	// the snapshot is written in the background to not block the writes
+	j.snapshotting = true
+	go db.snapshot()
+	return nil
+}
+
+// CompactJournal rewrites the journal as a snapshot of the current state
+func (db *MemoryStorage) CompactJournal() error {
+	j := db.journal
+	if j == nil {
+		return errors.New("ooo: journal not enabled")
+	}
+	return db.snapshot()
+}
+
+// snapshot writes the current state to a new journal without holding the
+// journal lock, the entries appended meanwhile are added at the end of it
+func (db *MemoryStorage) snapshot() error {
+	j := db.journal
+	j.compacting.Lock()
+	defer j.compacting.Unlock()
+	j.mutex.Lock()
+	if j.file == nil {
+		j.snapshotting = false
+		j.mutex.Unlock()
+		return nil
+	}
+	j.snapshotting = true
+	j.pending = [][]byte{}
+	j.mutex.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), ".journal-*")
+	if err != nil {
+		db.snapshotDone()
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	db.data().Range(func(k interface{}, value interface{}) bool {
+		var line []byte
+		line, err = json.Marshal(journalEntry{Op: "set", Key: k.(string), Value: value.([]byte)})
+		if err != nil {
+			return false
+		}
+		writer.Write(append(line, '\n'))
+		return true
+	})
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	pending := j.pending
+	j.pending = nil
+	j.snapshotting = false
+	if j.file == nil {
+		// closed while the snapshot was written
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil
+	}
+	// replaying the entries appended during the snapshot over it
+	// gives the state at the end of the snapshot
+	for _, line := range pending {
+		if err == nil {
+			_, err = writer.Write(line)
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		// retry after another round of entries
+		j.entries = 0
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	j.entries = len(pending)
+	return nil
+}
+
+// snapshotDone clears the snapshot state after a failed snapshot
+func (db *MemoryStorage) snapshotDone() {
+	j := db.journal
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.pending = nil
+	j.snapshotting = false
+	j.entries = 0
+}
+
+func (db *MemoryStorage) closeJournal() {
+	j := db.journal
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
@@ -0,0 +1,209 @@
+package ooo
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+var (
+	ErrInvalidToken = errors.New("ooo: invalid token")
+	ErrExpiredToken = errors.New("ooo: expired token")
+)
+
+// JWTConfig settings to validate bearer tokens
+//
+// Secret: key of HMAC signed tokens (HS256, HS384, HS512)
+//
+// PublicKey: key of RSA signed tokens (RS256, RS384, RS512)
+//
+// Issuer: expected iss claim, not checked if empty
+//
+// Audience: expected aud claim, not checked if empty
+//
+// Leeway: tolerance of the exp and nbf checks
+type JWTConfig struct {
+	Secret    []byte
+	PublicKey *rsa.PublicKey
+	Issuer    string
+	Audience  string
+	Leeway    time.Duration
+}
+
+// Claims of a validated token
+type Claims map[string]interface{}
+
+type claimsKey struct{}
+
+// JWTAudit returns an audit function that validates the bearer token of the
+// request (Authorization header or bearer websocket subprotocol) and stores
+// its claims in the request context, read them with JWTClaims
+func JWTAudit(cfg JWTConfig) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		claims, err := cfg.Validate(bearerToken(r))
+		if err != nil {
+			return false
+		}
+
+		*r = *r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+		return true
+	}
+}
+
+// JWTClaims of a request audited by JWTAudit
+func JWTClaims(r *http.Request) (Claims, bool) {
+	claims, ok := r.Context().Value(claimsKey{}).(Claims)
+	return claims, ok
+}
+
+// bearerToken from the authorization header or the websocket subprotocols
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	protocols := strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",")
+	if len(protocols) == 2 && strings.TrimSpace(protocols[0]) == "bearer" {
+		return strings.TrimSpace(protocols[1])
+	}
+
+	return ""
+}
+
+// Validate a token signature and claims
+func (cfg JWTConfig) Validate(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	err = cfg.verify(header.Alg, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := Claims{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, cfg.checkClaims(claims)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, v)
+}
+
+func (cfg JWTConfig) verify(alg string, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return ErrInvalidToken
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case "384":
+		newHash, cryptoHash = sha512.New384, crypto.SHA384
+	case "512":
+		newHash, cryptoHash = sha512.New, crypto.SHA512
+	default:
+		return ErrInvalidToken
+	}
+
+	switch alg[:2] {
+	case "HS":
+		if len(cfg.Secret) == 0 {
+			return ErrInvalidToken
+		}
+		mac := hmac.New(newHash, cfg.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return ErrInvalidToken
+		}
+		return nil
+	case "RS":
+		if cfg.PublicKey == nil {
+			return ErrInvalidToken
+		}
+		digest := newHash()
+		digest.Write([]byte(signed))
+		err := rsa.VerifyPKCS1v15(cfg.PublicKey, cryptoHash, digest.Sum(nil), signature)
+		if err != nil {
+			return ErrInvalidToken
+		}
+		return nil
+	}
+
+	return ErrInvalidToken
+}
+
+func (cfg JWTConfig) checkClaims(claims Claims) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if ok && now.After(time.Unix(int64(exp), 0).Add(cfg.Leeway)) {
+		return ErrExpiredToken
+	}
+
+	nbf, ok := claims["nbf"].(float64)
+	if ok && now.Add(cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return ErrInvalidToken
+	}
+
+	if cfg.Issuer != "" && claims["iss"] != cfg.Issuer {
+		return ErrInvalidToken
+	}
+
+	if cfg.Audience != "" && !hasAudience(claims["aud"], cfg.Audience) {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch value := aud.(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, item := range value {
+			if item == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,130 @@
+package ooo_test
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+
+	"github.com/benitogf/ooo"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func signHS256(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, privateKey *rsa.PrivateKey, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAudit(t *testing.T) {
+	secret := []byte("secret")
+	app := ooo.Server{}
+	app.Silence = true
+	app.Audit = ooo.JWTAudit(ooo.JWTConfig{
+		Secret:   secret,
+		Issuer:   "ooo",
+		Audience: "books",
+	})
+	app.Router = mux.NewRouter()
+	app.Router.HandleFunc("/claims/user", func(w http.ResponseWriter, r *http.Request) {
+		if !app.Audit(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims, ok := ooo.JWTClaims(r)
+		require.True(t, ok)
+		w.Write([]byte(claims["sub"].(string)))
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	status := func(path string, token string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode, w.Body.String()
+	}
+
+	claims := map[string]interface{}{
+		"sub": "alice",
+		"iss": "ooo",
+		"aud": []string{"books", "other"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	valid := signHS256(t, secret, claims)
+	code, _ := status("/", valid)
+	require.Equal(t, http.StatusOK, code)
+	code, body := status("/claims/user", valid)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "alice", body)
+
+	code, _ = status("/", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	code, _ = status("/", signHS256(t, secret, claims))
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	code, _ = status("/", signHS256(t, []byte("wrong"), claims))
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	claims["iss"] = "other"
+	code, _ = status("/", signHS256(t, secret, claims))
+	require.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestJWTValidateRSA(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	cfg := ooo.JWTConfig{PublicKey: &privateKey.PublicKey}
+
+	claims, err := cfg.Validate(signRS256(t, privateKey, map[string]interface{}{"sub": "bob"}))
+	require.NoError(t, err)
+	require.Equal(t, "bob", claims["sub"])
+
+	_, err = cfg.Validate(signRS256(t, otherKey, map[string]interface{}{"sub": "bob"}))
+	require.ErrorIs(t, err, ooo.ErrInvalidToken)
+
+	_, err = cfg.Validate(signRS256(t, privateKey, map[string]interface{}{
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	}))
+	require.ErrorIs(t, err, ooo.ErrExpiredToken)
+
+	// HMAC tokens are rejected without a secret
+	_, err = cfg.Validate(signHS256(t, []byte("secret"), map[string]interface{}{"sub": "bob"}))
+	require.ErrorIs(t, err, ooo.ErrInvalidToken)
+
+	_, err = cfg.Validate("not.a.token")
+	require.ErrorIs(t, err, ooo.ErrInvalidToken)
+}
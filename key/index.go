@@ -0,0 +1,121 @@
+package key
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Index of keys by path segments, lists the keys matching a
+// glob pattern without scanning every key
+type Index struct {
+	mutex sync.RWMutex
+	root  *indexNode
+}
+
+type indexNode struct {
+	children map[string]*indexNode
+	leaf     bool
+}
+
+// Add a key to the index
+func (idx *Index) Add(key string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if idx.root == nil {
+		idx.root = &indexNode{}
+	}
+	node := idx.root
+	for _, segment := range strings.Split(key, "/") {
+		if node.children == nil {
+			node.children = map[string]*indexNode{}
+		}
+		child, found := node.children[segment]
+		if !found {
+			child = &indexNode{}
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.leaf = true
+}
+
+// Remove a key from the index
+func (idx *Index) Remove(key string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if idx.root == nil {
+		return
+	}
+	idx.root.remove(strings.Split(key, "/"))
+}
+
+// remove the key from the node, returns true if the node can be pruned
+func (node *indexNode) remove(segments []string) bool {
+	if len(segments) == 0 {
+		node.leaf = false
+		return len(node.children) == 0
+	}
+	child, found := node.children[segments[0]]
+	if !found {
+		return false
+	}
+	if child.remove(segments[1:]) {
+		delete(node.children, segments[0])
+	}
+
+	return !node.leaf && len(node.children) == 0
+}
+
+// Clear all the keys of the index
+func (idx *Index) Clear() {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.root = nil
+}
+
+// Match lists the keys of the index that match the path, same as Match(path, key)
+func (idx *Index) Match(path string) []string {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	keys := []string{}
+	if idx.root == nil {
+		return keys
+	}
+	idx.root.match(strings.Split(path, "/"), "", &keys)
+	return keys
+}
+
+func (node *indexNode) match(segments []string, prefix string, keys *[]string) {
+	if len(segments) == 0 {
+		if node.leaf {
+			*keys = append(*keys, prefix)
+		}
+		return
+	}
+
+	segment := segments[0]
+	if !strings.Contains(segment, "*") {
+		child, found := node.children[segment]
+		if found {
+			child.match(segments[1:], join(prefix, segment), keys)
+		}
+		return
+	}
+
+	for name, child := range node.children {
+		matched, err := filepath.Match(segment, name)
+		if err != nil || !matched {
+			continue
+		}
+		child.match(segments[1:], join(prefix, name), keys)
+	}
+}
+
+func join(prefix string, segment string) string {
+	if prefix == "" {
+		return segment
+	}
+
+	return prefix + "/" + segment
+}
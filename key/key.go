@@ -8,8 +8,12 @@ import (
 	"time"
 )
 
+// Pattern default route regex for keys, the keys accepted by IsValid,
+// custom route patterns are checked with Validator
+const Pattern = `[a-zA-Z\*\d\/\-\._]+`
+
 // GlobRegex checks for valid glob paths
-var GlobRegex = regexp.MustCompile(`^[a-zA-Z\*\d]$|^[a-zA-Z\*\d][a-zA-Z\*\d\/]+[a-zA-Z\*\d]$`)
+var GlobRegex = regexp.MustCompile(`^[a-zA-Z\*\d\-\._]$|^[a-zA-Z\*\d\-\._][a-zA-Z\*\d\/\-\._]+[a-zA-Z\*\d\-\._]$`)
 
 // IsValid checks that the key pattern issuported
 func IsValid(key string) bool {
@@ -20,6 +24,29 @@ func IsValid(key string) bool {
 	return GlobRegex.MatchString(key)
 }
 
+// Validator checks keys with a route pattern (like Pattern) instead of the default,
+// the key must match the whole pattern and can't start or end with a slash
+// or contain empty segments or double globs
+func Validator(pattern string) (func(key string) bool, error) {
+	if pattern == Pattern {
+		return IsValid, nil
+	}
+	regex, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(key string) bool {
+		if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+			return false
+		}
+		if strings.Contains(key, "//") || strings.Contains(key, "**") {
+			return false
+		}
+		return regex.MatchString(key)
+	}, nil
+}
+
 // Match checks if a key is part of a path (glob)
 func Match(path string, key string) bool {
 	if path == key {
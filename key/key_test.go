@@ -1,6 +1,7 @@
 package key
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -14,6 +15,9 @@ func TestRegex(t *testing.T) {
 	require.False(t, GlobRegex.MatchString("/a/b/c"))
 	require.False(t, GlobRegex.MatchString("a/b/c/"))
 	require.False(t, GlobRegex.MatchString("a:b/c"))
+	require.True(t, GlobRegex.MatchString("users/john.doe"))
+	require.True(t, GlobRegex.MatchString("events/2024-01-01"))
+	require.True(t, GlobRegex.MatchString("snake_case/*"))
 }
 
 func TestKeyIsValid(t *testing.T) {
@@ -23,6 +27,27 @@ func TestKeyIsValid(t *testing.T) {
 	require.False(t, IsValid("test///1"))
 }
 
+func TestKeyValidator(t *testing.T) {
+	valid, err := Validator(`[\p{L}\*\d\/\-\._]+`)
+	require.NoError(t, err)
+	require.True(t, valid("usuarios/josé"))
+	require.True(t, valid("ユーザー/*"))
+	require.True(t, valid("test/1"))
+	require.False(t, valid("test//1"))
+	require.False(t, valid("test/**"))
+	require.False(t, valid("/test"))
+	require.False(t, valid("test/"))
+	require.False(t, valid("test:1"))
+	require.False(t, valid(""))
+
+	valid, err = Validator(Pattern)
+	require.NoError(t, err)
+	require.False(t, valid("usuarios/josé"))
+
+	_, err = Validator(`[`)
+	require.Error(t, err)
+}
+
 func TestKeyMatch(t *testing.T) {
 	require.True(t, Match("*", "thing"))
 	require.True(t, Match("games/*", "games/*"))
@@ -35,3 +60,97 @@ func TestKeyMatch(t *testing.T) {
 	require.False(t, Match("thing/1", "thing/123"))
 	require.False(t, Match("thing/123/*", "thing/123/123/123"))
 }
+
+func naiveMatch(keys []string, path string) []string {
+	matched := []string{}
+	for _, k := range keys {
+		if Match(path, k) {
+			matched = append(matched, k)
+		}
+	}
+	return matched
+}
+
+func TestIndexMatch(t *testing.T) {
+	keys := []string{
+		"thing",
+		"thing/1",
+		"thing/123",
+		"thing/123/234",
+		"thing/123/123/123",
+		"thing/glob/test/234",
+		"things/1",
+		"games/*",
+		"a.b/c-d",
+	}
+	index := Index{}
+	for _, k := range keys {
+		index.Add(k)
+	}
+
+	for _, path := range []string{
+		"*",
+		"thing",
+		"thing/*",
+		"thing/1*",
+		"thing/*/*",
+		"thing/*/234",
+		"thing/glob/*/*",
+		"thing/123/*/*",
+		"thing*/1",
+		"games/*",
+		"a.b/*",
+		"missing/*",
+	} {
+		require.ElementsMatch(t, naiveMatch(keys, path), index.Match(path), path)
+	}
+
+	index.Remove("thing/123")
+	index.Remove("thing/123/123/123")
+	index.Remove("missing/1")
+	keys = []string{
+		"thing",
+		"thing/1",
+		"thing/123/234",
+		"thing/glob/test/234",
+		"things/1",
+		"games/*",
+		"a.b/c-d",
+	}
+	for _, path := range []string{"thing/*", "thing/*/*", "thing/123/*/*", "*"} {
+		require.ElementsMatch(t, naiveMatch(keys, path), index.Match(path), path)
+	}
+
+	index.Clear()
+	require.Equal(t, 0, len(index.Match("thing/*")))
+}
+
+func benchmarkKeys() []string {
+	keys := []string{}
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < 100; j++ {
+			keys = append(keys, "group"+strconv.Itoa(i)+"/"+strconv.Itoa(j))
+		}
+	}
+	return keys
+}
+
+func BenchmarkIndexMatch(b *testing.B) {
+	keys := benchmarkKeys()
+	index := Index{}
+	for _, k := range keys {
+		index.Add(k)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.Match("group500/*")
+	}
+}
+
+func BenchmarkScanMatch(b *testing.B) {
+	keys := benchmarkKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		naiveMatch(keys, "group500/*")
+	}
+}
@@ -0,0 +1,69 @@
+package ooo
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// SlashPolicy handling of the keys with a trailing slash
+type SlashPolicy int
+
+const (
+	// Strict keys with a trailing slash are invalid (400)
+	Strict SlashPolicy = iota
+	// Redirect responds a 301 to the key without the trailing slash
+	Redirect
+	// Ignore the trailing slash is removed from the key
+	Ignore
+)
+
+// keyPolicy applies KeyCaseInsensitive and TrailingSlash to the keys of the
+// key routes and the subscribe route before the handlers read them
+func (app *Server) keyPolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		_key, isKey := vars["key"]
+		keys, isMulti := vars["keys"]
+		if !isKey && !isMulti {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if isKey && app.TrailingSlash == Redirect && len(_key) > 1 && strings.HasSuffix(_key, "/") {
+			target := *r.URL
+			target.Path = strings.TrimSuffix(r.URL.Path, "/")
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+			return
+		}
+
+		if isKey {
+			vars["key"] = app.canonicalKey(_key)
+		}
+		if isMulti {
+			parts := strings.Split(keys, ",")
+			for i, part := range parts {
+				parts[i] = app.canonicalKey(part)
+			}
+			vars["keys"] = strings.Join(parts, ",")
+			// the subscribe route reads the keys from the query
+			query := r.URL.Query()
+			query.Set("keys", vars["keys"])
+			r.URL.RawQuery = query.Encode()
+		}
+		next.ServeHTTP(w, mux.SetURLVars(r, vars))
+	})
+}
+
+// canonicalKey the key with the case and trailing slash policies applied
+func (app *Server) canonicalKey(_key string) string {
+	if app.KeyCaseInsensitive {
+		_key = strings.ToLower(_key)
+	}
+	if app.TrailingSlash == Ignore && len(_key) > 1 {
+		_key = strings.TrimSuffix(_key, "/")
+	}
+
+	return _key
+}
@@ -0,0 +1,59 @@
+package ooo
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener accepts at most a number of simultaneous connections,
+// Accept blocks until an accepted connection is closed. It works like
+// golang.org/x/net/netutil.LimitListener (a closed listener unblocks a
+// waiting Accept, a connection releases its slot once), kept here so the
+// module doesn't depend on golang.org/x/net for this listener alone
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(ln net.Listener, max int) *limitListener {
+	return &limitListener{
+		Listener: ln,
+		slots:    make(chan struct{}, max),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	case l.slots <- struct{}{}:
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn releases its slot of the listener once closed
+type limitConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
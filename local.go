@@ -0,0 +1,313 @@
+package ooo
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+
+	"github.com/benitogf/ooo/key"
+	"github.com/benitogf/ooo/meta"
+)
+
+// Meta typed object of a key
+type Meta[T any] struct {
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+	Index   string `json:"index"`
+	Path    string `json:"path"`
+	Schema  int    `json:"schema,omitempty"`
+	Data    T      `json:"data"`
+}
+
+// GetMulti the typed objects of several keys through the read filters
+// of the server, keys not found or filtered out are omitted
+func GetMulti[T any](server *Server, paths []string) (map[string]Meta[T], error) {
+	res := map[string]Meta[T]{}
+	objs, err := server.reads().GetMulti(paths)
+	if err != nil {
+		return res, err
+	}
+
+	for path, obj := range objs {
+		_, err := server.filterSet().Migrate.upgrade(&obj)
+		if err != nil {
+			return res, err
+		}
+		filtered, err := server.filterSet().Read.check(path, meta.New(&obj), server.Static)
+		if err != nil {
+			continue
+		}
+
+		res[path], err = typed[T](obj, filtered)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// typed decodes the read filtered data of a stored object
+func typed[T any](obj meta.Object, filtered []byte) (Meta[T], error) {
+	// filters can replace the object with plain data
+	filteredObj, err := meta.Decode(filtered)
+	if err != nil || len(filteredObj.Data) == 0 {
+		filteredObj = obj
+		filteredObj.Data = filtered
+	}
+
+	var item T
+	err = json.Unmarshal(filteredObj.Data, &item)
+	if err != nil {
+		return Meta[T]{}, err
+	}
+
+	return Meta[T]{
+		Created: filteredObj.Created,
+		Updated: filteredObj.Updated,
+		Index:   filteredObj.Index,
+		Path:    filteredObj.Path,
+		Schema:  filteredObj.Schema,
+		Data:    item,
+	}, nil
+}
+
+// GetOr the typed object of a key through the read filters of the server, a key
+// that isn't stored returns the default data with zero timestamps and no error
+func GetOr[T any](server *Server, path string, def T) (Meta[T], error) {
+	if !server.validKey(path) || strings.Contains(path, "*") {
+		return Meta[T]{}, ErrInvalidPath
+	}
+
+	raw, err := server.reads().Get(path)
+	if err == ErrNotFound {
+		return Meta[T]{
+			Index: key.LastIndex(path),
+			Path:  path,
+			Data:  def,
+		}, nil
+	}
+	if err != nil {
+		return Meta[T]{}, err
+	}
+
+	obj, err := meta.Decode(raw)
+	if err != nil {
+		return Meta[T]{}, err
+	}
+	_, err = server.filterSet().Migrate.upgrade(&obj)
+	if err != nil {
+		return Meta[T]{}, err
+	}
+	filtered, err := server.filterSet().Read.check(path, meta.New(&obj), server.Static)
+	if err != nil {
+		return Meta[T]{}, err
+	}
+
+	return typed[T](obj, filtered)
+}
+
+// QuerySpec a query of the objects of a list path
+//
+// Path: glob path of the list
+//
+// Order: "asc" (default) or "desc" by created time
+//
+// Limit, Offset: page of the results, zero limit returns every result after the offset
+//
+// Where: fields (gjson paths of the data) and the values the objects must have
+type QuerySpec struct {
+	Path   string
+	Order  string
+	Limit  int
+	Offset int
+	Where  map[string]string
+}
+
+// ErrInvalidQuery the query spec can't be run
+var ErrInvalidQuery = errors.New("ooo: invalid query")
+
+// Query the typed objects of a list path through the read filters of the server
+// that match the where fields, ordered by created time and paginated
+func Query[T any](server *Server, q QuerySpec) ([]Meta[T], error) {
+	if !server.validKey(q.Path) || !strings.Contains(q.Path, "*") {
+		return nil, ErrInvalidPath
+	}
+	if (q.Order != "" && q.Order != "asc" && q.Order != "desc") || q.Limit < 0 || q.Offset < 0 {
+		return nil, ErrInvalidQuery
+	}
+
+	filtered, err := server.getFilteredData(q.Path)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := meta.DecodeList(filtered)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Order == "desc" {
+		sort.SliceStable(objs, meta.SortDesc(objs))
+	} else {
+		sort.SliceStable(objs, meta.SortAsc(objs))
+	}
+
+	res := []Meta[T]{}
+	skipped := 0
+	for _, obj := range objs {
+		if !matches(obj.Data, q.Where) {
+			continue
+		}
+		if skipped < q.Offset {
+			skipped++
+			continue
+		}
+		if q.Limit > 0 && len(res) == q.Limit {
+			break
+		}
+		item, err := typed[T](obj, meta.New(&obj))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, item)
+	}
+
+	return res, nil
+}
+
+// matches the data has the values of the where fields
+func matches(data []byte, where map[string]string) bool {
+	for field, value := range where {
+		result := gjson.GetBytes(data, field)
+		if !result.Exists() || result.String() != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Delete a key through the delete filters of the server
+func Delete(server *Server, path string) error {
+	if !server.validKey(path) {
+		return ErrInvalidPath
+	}
+
+	err := server.filterSet().Delete.check(path, server.Static)
+	if err != nil {
+		return err
+	}
+
+	return server.Storage.Del(path)
+}
+
+// Patch merges the partial data into a key through the write filters of the server
+func Patch[T any](server *Server, path string, partial T) error {
+	if !server.validKey(path) {
+		return ErrInvalidPath
+	}
+
+	raw, err := json.Marshal(partial)
+	if err != nil {
+		return err
+	}
+
+	data, err := server.filterSet().checkWrite(http.MethodPatch, path, raw, server.Static)
+	if err != nil {
+		return err
+	}
+
+	err = server.checkReferences(path, data, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = server.patchDerived(path, data)
+	if err != nil {
+		return err
+	}
+
+	server.filterSet().AfterWrite.check(path)
+	return nil
+}
+
+// IndexResponse index and timestamps of a write
+type IndexResponse struct {
+	Index   string `json:"index"`
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+}
+
+// write stores an item through the write pipeline of the rest writes (write, derive
+// and dedupe filters, references and list limit) and responds with the index and
+// timestamps of the stored object, a write skipped by the dedupe filter responds
+// with the stored object
+func write[T any](server *Server, method string, path string, item T) (IndexResponse, error) {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return IndexResponse{}, err
+	}
+
+	data, err := server.filterSet().checkWrite(method, path, raw, server.Static)
+	if err != nil {
+		return IndexResponse{}, err
+	}
+
+	data, err = server.filterSet().Derive.check(path, data, false)
+	if err != nil {
+		return IndexResponse{}, err
+	}
+
+	err = server.checkReferences(path, data, false)
+	if err != nil {
+		return IndexResponse{}, err
+	}
+
+	index, err := server.commitWrite(path, data, func(data json.RawMessage) (string, error) {
+		return server.Storage.SetWithSchema(path, data, 0)
+	})
+	if err != nil && err != ErrNoop {
+		return IndexResponse{}, err
+	}
+
+	if err == nil {
+		server.filterSet().AfterWrite.check(path)
+	}
+	stored, err := server.Storage.Get(path)
+	if err != nil {
+		return IndexResponse{Index: index}, err
+	}
+	obj, err := meta.Decode(stored)
+	if err != nil {
+		return IndexResponse{Index: index}, err
+	}
+
+	return IndexResponse{
+		Index:   index,
+		Created: obj.Created,
+		Updated: obj.Updated,
+	}, nil
+}
+
+// PushWithResponse stores an item in a new key of a list path (glob at the end)
+// through the write filters of the server
+func PushWithResponse[T any](server *Server, path string, item T) (IndexResponse, error) {
+	if !server.validKey(path) || !strings.HasSuffix(path, "/*") || strings.Count(path, "*") > 1 {
+		return IndexResponse{}, ErrInvalidPath
+	}
+
+	return write(server, http.MethodPost, key.Build(path), item)
+}
+
+// SetWithResponse stores an item in a key through the write filters of the server
+func SetWithResponse[T any](server *Server, path string, item T) (IndexResponse, error) {
+	if !server.validKey(path) || strings.Contains(path, "*") {
+		return IndexResponse{}, ErrInvalidPath
+	}
+
+	return write(server, http.MethodPut, path, item)
+}
@@ -0,0 +1,281 @@
+package ooo_test
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/goccy/go-json"
+
+	"github.com/benitogf/ooo"
+	"github.com/benitogf/ooo/messages"
+	"github.com/benitogf/ooo/meta"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+type Book struct {
+	Title  string `json:"title,omitempty"`
+	Author string `json:"author,omitempty"`
+}
+
+func TestLocalDelete(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.DeleteFilter("books/locked", func(key string) error {
+		return errors.New("locked")
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("books/locked", json.RawMessage(`{"title":"locked"}`))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("books/free", json.RawMessage(`{"title":"free"}`))
+	require.NoError(t, err)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/books/*"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, raw, err := c.ReadMessage()
+	require.NoError(t, err)
+	cache, err := messages.PatchCache(raw, nil)
+	require.NoError(t, err)
+
+	err = ooo.Delete(&app, "books/locked")
+	require.Error(t, err)
+	_, err = app.Storage.Get("books/locked")
+	require.NoError(t, err)
+
+	err = ooo.Delete(&app, "books/free")
+	require.NoError(t, err)
+	_, raw, err = c.ReadMessage()
+	require.NoError(t, err)
+	cache, err = messages.PatchCache(raw, cache)
+	require.NoError(t, err)
+	require.Contains(t, string(cache), "locked")
+	require.NotContains(t, string(cache), "free")
+
+	err = ooo.Delete(&app, "books/free")
+	require.ErrorIs(t, err, ooo.ErrNotFound)
+}
+
+func TestLocalPatch(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.WriteFilter("books/*", func(key string, data json.RawMessage) (json.RawMessage, error) {
+		var book Book
+		err := json.Unmarshal(data, &book)
+		if err != nil || book.Author == "anonymous" {
+			return nil, errors.New("invalid author")
+		}
+		return data, nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("books/1", json.RawMessage(`{"title":"taup","author":"someone"}`))
+	require.NoError(t, err)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/books/1"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, raw, err := c.ReadMessage()
+	require.NoError(t, err)
+	cache, _, err := messages.Patch(raw, nil)
+	require.NoError(t, err)
+
+	err = ooo.Patch(&app, "books/1", Book{Author: "anonymous"})
+	require.Error(t, err)
+
+	err = ooo.Patch(&app, "books/1", Book{Author: "other"})
+	require.NoError(t, err)
+	_, raw, err = c.ReadMessage()
+	require.NoError(t, err)
+	_, obj, err := messages.Patch(raw, cache)
+	require.NoError(t, err)
+	require.Equal(t, `{"author":"other","title":"taup"}`, string(obj.Data))
+
+	err = ooo.Patch(&app, "books/2", Book{Author: "other"})
+	require.ErrorIs(t, err, ooo.ErrNotFound)
+}
+
+func TestLocalGetMulti(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.ReadFilter("books/hidden", func(key string, data json.RawMessage) (json.RawMessage, error) {
+		return nil, errors.New("hidden")
+	})
+	app.ReadFilter("books/intercepted", func(key string, data json.RawMessage) (json.RawMessage, error) {
+		return json.RawMessage(`{"title":"intercepted"}`), nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	for _, index := range []string{"1", "2", "hidden", "intercepted"} {
+		_, err := app.Storage.Set("books/"+index, json.RawMessage(`{"title":"book `+index+`"}`))
+		require.NoError(t, err)
+	}
+
+	books, err := ooo.GetMulti[Book](&app, []string{"books/1", "books/2", "books/3", "books/hidden", "books/intercepted"})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(books))
+	require.Equal(t, "book 1", books["books/1"].Data.Title)
+	require.Equal(t, "2", books["books/2"].Index)
+	require.Equal(t, "books/2", books["books/2"].Path)
+	require.NotZero(t, books["books/2"].Created)
+	require.Equal(t, "intercepted", books["books/intercepted"].Data.Title)
+	_, found := books["books/3"]
+	require.False(t, found)
+	_, found = books["books/hidden"]
+	require.False(t, found)
+}
+
+func TestLocalWithResponse(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.WriteFilter("books/*", func(key string, data json.RawMessage) (json.RawMessage, error) {
+		var book Book
+		err := json.Unmarshal(data, &book)
+		if err != nil || book.Author == "anonymous" {
+			return nil, errors.New("invalid author")
+		}
+		return data, nil
+	})
+	app.DedupeWriteFilter("books/*")
+	app.MaxListFilter("books/*", 2, ooo.Reject)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	pushed, err := ooo.PushWithResponse(&app, "books/*", Book{Title: "taup", Author: "someone"})
+	require.NoError(t, err)
+	require.NotEmpty(t, pushed.Index)
+	require.NotZero(t, pushed.Created)
+	require.Zero(t, pushed.Updated)
+	raw, err := app.Storage.Get("books/" + pushed.Index)
+	require.NoError(t, err)
+	obj, err := meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, pushed.Index, obj.Index)
+	require.Equal(t, pushed.Created, obj.Created)
+
+	set, err := ooo.SetWithResponse(&app, "books/"+pushed.Index, Book{Title: "taup", Author: "other"})
+	require.NoError(t, err)
+	require.Equal(t, pushed.Index, set.Index)
+	require.Equal(t, pushed.Created, set.Created)
+	require.GreaterOrEqual(t, set.Updated, set.Created)
+	raw, err = app.Storage.Get("books/" + pushed.Index)
+	require.NoError(t, err)
+	obj, err = meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, set.Updated, obj.Updated)
+
+	_, err = ooo.SetWithResponse(&app, "books/2", Book{Author: "anonymous"})
+	require.Error(t, err)
+	_, err = ooo.PushWithResponse(&app, "books/1", Book{Author: "someone"})
+	require.ErrorIs(t, err, ooo.ErrInvalidPath)
+	_, err = ooo.SetWithResponse(&app, "books/*", Book{Author: "someone"})
+	require.ErrorIs(t, err, ooo.ErrInvalidPath)
+
+	// writes go through the dedupe filter and the list limit
+	deduped, err := ooo.SetWithResponse(&app, "books/"+pushed.Index, Book{Title: "taup", Author: "other"})
+	require.NoError(t, err)
+	require.Equal(t, set.Updated, deduped.Updated)
+	_, err = ooo.PushWithResponse(&app, "books/*", Book{Title: "second", Author: "someone"})
+	require.NoError(t, err)
+	_, err = ooo.PushWithResponse(&app, "books/*", Book{Title: "third", Author: "someone"})
+	var httpErr ooo.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	require.Equal(t, http.StatusConflict, httpErr.Status)
+	objs, err := app.Storage.GetN("books/*", 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(objs))
+}
+
+func TestLocalGetOr(t *testing.T) {
+	type Settings struct {
+		Theme   string `json:"theme"`
+		Enabled bool   `json:"enabled"`
+	}
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	def := Settings{Theme: "light"}
+	_, err := app.Storage.Set("settings/ui", json.RawMessage(`{"theme":"dark","enabled":true}`))
+	require.NoError(t, err)
+	stored, err := ooo.GetOr(&app, "settings/ui", def)
+	require.NoError(t, err)
+	require.Equal(t, Settings{Theme: "dark", Enabled: true}, stored.Data)
+	require.NotZero(t, stored.Created)
+
+	absent, err := ooo.GetOr(&app, "settings/missing", def)
+	require.NoError(t, err)
+	require.Equal(t, def, absent.Data)
+	require.Equal(t, "settings/missing", absent.Path)
+	require.Zero(t, absent.Created)
+	require.Zero(t, absent.Updated)
+
+	_, err = app.Storage.Set("settings/broken", json.RawMessage(`{"theme":1}`))
+	require.NoError(t, err)
+	_, err = ooo.GetOr(&app, "settings/broken", def)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ooo.ErrNotFound)
+
+	_, err = ooo.GetOr(&app, "settings/*", def)
+	require.ErrorIs(t, err, ooo.ErrInvalidPath)
+}
+
+func TestLocalQuery(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	books := []Book{
+		{Title: "one", Author: "ana"},
+		{Title: "two", Author: "bob"},
+		{Title: "three", Author: "ana"},
+		{Title: "four", Author: "ana"},
+		{Title: "five", Author: "bob"},
+	}
+	for i, book := range books {
+		_, err := ooo.SetWithResponse(&app, "books/"+string(rune('a'+i)), book)
+		require.NoError(t, err)
+	}
+	titles := func(res []ooo.Meta[Book]) []string {
+		titles := []string{}
+		for _, book := range res {
+			titles = append(titles, book.Data.Title)
+		}
+		return titles
+	}
+
+	res, err := ooo.Query[Book](&app, ooo.QuerySpec{Path: "books/*", Order: "desc", Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"five", "four"}, titles(res))
+	require.Equal(t, "books/e", res[0].Path)
+	require.NotZero(t, res[0].Created)
+
+	res, err = ooo.Query[Book](&app, ooo.QuerySpec{Path: "books/*", Where: map[string]string{"author": "ana"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"one", "three", "four"}, titles(res))
+
+	// offset pagination
+	pages := [][]string{}
+	for offset := 0; offset < len(books); offset += 2 {
+		res, err = ooo.Query[Book](&app, ooo.QuerySpec{Path: "books/*", Limit: 2, Offset: offset})
+		require.NoError(t, err)
+		pages = append(pages, titles(res))
+	}
+	require.Equal(t, [][]string{{"one", "two"}, {"three", "four"}, {"five"}}, pages)
+
+	_, err = ooo.Query[Book](&app, ooo.QuerySpec{Path: "books/a"})
+	require.ErrorIs(t, err, ooo.ErrInvalidPath)
+	_, err = ooo.Query[Book](&app, ooo.QuerySpec{Path: "books/*", Order: "random"})
+	require.ErrorIs(t, err, ooo.ErrInvalidQuery)
+}
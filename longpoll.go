@@ -0,0 +1,49 @@
+package ooo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ErrInvalidVersion the since parameter of a long-poll isn't a version
+var ErrInvalidVersion = errors.New("ooo: invalid version")
+
+// longPoll responds the data of the key once its version differs from
+// since (hex, as the subscription versions), 304 when the timeout elapses
+func (app *Server) longPoll(w http.ResponseWriter, r *http.Request, _key string) {
+	since := int64(-1)
+	if r.URL.Query().Has("since") {
+		var err error
+		since, err = strconv.ParseInt(r.URL.Query().Get("since"), 16, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", ErrInvalidVersion)
+			return
+		}
+	}
+
+	entry, err := app.fetch(_key)
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	if entry.Version == since {
+		var changed bool
+		entry, changed = app.Stream.Wait(r.Context(), _key, since, app.LongPollTimeout)
+		if !changed {
+			w.Header().Set("X-Version", strconv.FormatInt(since, 16))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	data := entry.Data
+	if app.AuthorizeRead != nil {
+		data = app.Stream.Authorized(app.Principal(r), _key, data)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Version", strconv.FormatInt(entry.Version, 16))
+	w.Write(data)
+}
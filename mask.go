@@ -0,0 +1,86 @@
+package ooo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Mask strategy of a mask rule
+type Mask int
+
+const (
+	// Hash replaces the value with its sha256 hex digest
+	Hash Mask = iota
+	// Last4 replaces every character but the last four with *
+	Last4
+	// Fixed replaces the value with the Value of the rule
+	Fixed
+)
+
+// MaskRule a field of the data of the objects (gjson path) and its mask
+type MaskRule struct {
+	Field string
+	Mask  Mask
+	Value string
+}
+
+func (rule MaskRule) apply(value string) string {
+	switch rule.Mask {
+	case Hash:
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])
+	case Last4:
+		runes := []rune(value)
+		if len(runes) <= 4 {
+			return value
+		}
+		return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+	default:
+		return rule.Value
+	}
+}
+
+// mask the fields of an object at the prefix (the object path in a list)
+func mask(data []byte, prefix string, rules []MaskRule) ([]byte, error) {
+	var err error
+	for _, rule := range rules {
+		field := prefix + "data." + rule.Field
+		value := gjson.GetBytes(data, field)
+		if !value.Exists() || value.Type == gjson.Null {
+			continue
+		}
+		data, err = sjson.SetBytes(data, field, rule.apply(value.String()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// MaskFilter add a read filter that masks fields of the objects (hash, last four
+// characters or a fixed value) in reads of the key and lists (it is the read filter of
+// the path, register it instead of OpenFilter), stored data is not modified
+func (app *Server) MaskFilter(path string, rules []MaskRule) {
+	app.ReadFilter(path, func(index string, data json.RawMessage) (json.RawMessage, error) {
+		parsed := gjson.ParseBytes(data)
+		if !parsed.IsArray() {
+			return mask(data, "", rules)
+		}
+		masked := []byte(data)
+		var err error
+		for i := range parsed.Array() {
+			masked, err = mask(masked, strconv.Itoa(i)+".", rules)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return masked, nil
+	})
+}
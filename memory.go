@@ -5,6 +5,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/goccy/go-json"
@@ -22,19 +23,32 @@ var (
 
 // MemoryStorage composition of Database interface
 type MemoryStorage struct {
-	mem             sync.Map
+	mem             atomic.Pointer[sync.Map]
 	mutex           sync.RWMutex
+	compactMutex    sync.RWMutex
 	memMutex        sync.Map
+	index           key.Index
 	noBroadcastKeys []string
 	watcher         StorageChan
 	storage         *Storage
+	less            func(a, b string) bool
+	validKey        func(key string) bool
+	requestID       func(key string) string
+	journal         *journal
+	// JournalCompact number of journal entries appended before a snapshot
+	// rewrites it, defaults to DefaultJournalCompact
+	JournalCompact int
+	// JournalSync syncs the journal file to disk after every write, without
+	// it the appends are flushed by the OS and a crash of the machine (not
+	// of the process) can lose the last writes
+	JournalSync bool
 }
 
 // Active provides access to the status of the storage client
 func (db *MemoryStorage) Active() bool {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	return db.storage.Active
+	return db.storage != nil && db.storage.Active
 }
 
 // Start the storage client
@@ -48,10 +62,34 @@ func (db *MemoryStorage) Start(storageOpt StorageOpt) error {
 		db.watcher = make(StorageChan)
 	}
 	db.noBroadcastKeys = storageOpt.NoBroadcastKeys
+	db.validKey = storageOpt.ValidKey
+	db.requestID = storageOpt.RequestID
+	if db.journal != nil {
+		err := db.replay()
+		if err != nil {
+			return err
+		}
+	}
 	db.storage.Active = true
 	return nil
 }
 
+// valid checks a key with the validation of the storage options
+func (db *MemoryStorage) valid(path string) bool {
+	if db.validKey == nil {
+		return key.IsValid(path)
+	}
+	return db.validKey(path)
+}
+
+// eventRequestID the request id of the storage event of a write
+func (db *MemoryStorage) eventRequestID(path string) string {
+	if db.requestID == nil {
+		return ""
+	}
+	return db.requestID(path)
+}
+
 // Close the storage client
 func (db *MemoryStorage) Close() {
 	db.mutex.Lock()
@@ -59,6 +97,17 @@ func (db *MemoryStorage) Close() {
 	db.storage.Active = false
 	close(db.watcher)
 	db.watcher = nil
+	db.closeJournal()
+}
+
+// data returns the map holding the storage entries
+func (db *MemoryStorage) data() *sync.Map {
+	mem := db.mem.Load()
+	if mem != nil {
+		return mem
+	}
+	db.mem.CompareAndSwap(nil, &sync.Map{})
+	return db.mem.Load()
 }
 
 func (db *MemoryStorage) _getLock(path string) *sync.Mutex {
@@ -77,16 +126,15 @@ func (db *MemoryStorage) _loadLock(path string) (*sync.Mutex, error) {
 
 // Clear all keys in the storage
 func (db *MemoryStorage) Clear() {
-	db.mem.Range(func(key interface{}, value interface{}) bool {
-		db.mem.Delete(key)
-		return true
-	})
+	db.compactMutex.RLock()
+	defer db.compactMutex.RUnlock()
+	db.write(journalEntry{Op: "clear"})
 }
 
 // Keys list all the keys in the storage
 func (db *MemoryStorage) Keys() ([]byte, error) {
 	stats := Stats{}
-	db.mem.Range(func(key interface{}, value interface{}) bool {
+	db.data().Range(func(key interface{}, value interface{}) bool {
 		stats.Keys = append(stats.Keys, key.(string))
 		return true
 	})
@@ -94,13 +142,50 @@ func (db *MemoryStorage) Keys() ([]byte, error) {
 	if stats.Keys == nil {
 		stats.Keys = []string{}
 	}
+	less := db.keyOrder()
 	sort.Slice(stats.Keys, func(i, j int) bool {
-		return strings.ToLower(stats.Keys[i]) < strings.ToLower(stats.Keys[j])
+		return less(stats.Keys[i], stats.Keys[j])
 	})
 
 	return meta.Encode(stats)
 }
 
+// SetKeyOrder defines the order of the keys list, nil restores DefaultKeyOrder
+func (db *MemoryStorage) SetKeyOrder(less func(a, b string) bool) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.less = less
+}
+
+// keyOrder the order of the keys list
+func (db *MemoryStorage) keyOrder() func(a, b string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.less == nil {
+		return DefaultKeyOrder
+	}
+
+	return db.less
+}
+
+// KeyCount number of stored keys
+func (db *MemoryStorage) KeyCount() int {
+	count := 0
+	db.data().Range(func(key interface{}, value interface{}) bool {
+		count++
+		return true
+	})
+
+	return count
+}
+
+// RangeKeys calls fn for each stored key (unsorted) until it returns false
+func (db *MemoryStorage) RangeKeys(fn func(key string) bool) {
+	db.data().Range(func(key interface{}, value interface{}) bool {
+		return fn(key.(string))
+	})
+}
+
 // KeysRange list keys in a path and time range
 func (db *MemoryStorage) KeysRange(path string, from, to int64) ([]string, error) {
 	keys := []string{}
@@ -112,27 +197,43 @@ func (db *MemoryStorage) KeysRange(path string, from, to int64) ([]string, error
 		return keys, errors.New("ooo: invalid range")
 	}
 
-	db.mem.Range(func(k interface{}, value interface{}) bool {
-		current := k.(string)
-		if !key.Match(path, current) {
-			return true
-		}
+	for _, current := range db.index.Match(path) {
 		paths := strings.Split(current, "/")
 		created := key.Decode(paths[len(paths)-1])
 		if created < from || created > to {
-			return true
+			continue
 		}
 		keys = append(keys, current)
-		return true
-	})
+	}
 
 	return keys, nil
 }
 
+// matchObjects decodes the objects of the keys matching a glob pattern
+func (db *MemoryStorage) matchObjects(path string) []meta.Object {
+	res := []meta.Object{}
+	mem := db.data()
+	for _, k := range db.index.Match(path) {
+		value, found := mem.Load(k)
+		if !found {
+			continue
+		}
+
+		newObject, err := meta.Decode(value.([]byte))
+		if err != nil {
+			continue
+		}
+
+		res = append(res, newObject)
+	}
+
+	return res
+}
+
 // get a key/pattern related value(s)
 func (db *MemoryStorage) get(path string, order string) ([]byte, error) {
 	if !strings.Contains(path, "*") {
-		data, found := db.mem.Load(path)
+		data, found := db.data().Load(path)
 		if !found {
 			return []byte(""), ErrNotFound
 		}
@@ -140,20 +241,7 @@ func (db *MemoryStorage) get(path string, order string) ([]byte, error) {
 		return data.([]byte), nil
 	}
 
-	res := []meta.Object{}
-	db.mem.Range(func(k interface{}, value interface{}) bool {
-		if !key.Match(path, k.(string)) {
-			return true
-		}
-
-		newObject, err := meta.Decode(value.([]byte))
-		if err != nil {
-			return true
-		}
-
-		res = append(res, newObject)
-		return true
-	})
+	res := db.matchObjects(path)
 
 	if order == "desc" {
 		sort.Slice(res, meta.SortDesc(res))
@@ -174,6 +262,48 @@ func (db *MemoryStorage) GetDescending(path string) ([]byte, error) {
 	return db.get(path, "desc")
 }
 
+// GetMulti get the objects of several keys, keys not found are omitted
+func (db *MemoryStorage) GetMulti(paths []string) (map[string]meta.Object, error) {
+	res := map[string]meta.Object{}
+	for _, path := range paths {
+		if strings.Contains(path, "*") {
+			return res, errors.New("ooo: can't get multiple glob pattern paths")
+		}
+	}
+
+	mem := db.data()
+	for _, path := range paths {
+		data, found := mem.Load(path)
+		if !found {
+			continue
+		}
+
+		obj, err := meta.Decode(data.([]byte))
+		if err != nil {
+			continue
+		}
+
+		res[path] = obj
+	}
+
+	return res, nil
+}
+
+// Iterate calls fn with every stored object (unsorted) until it returns an error
+func (db *MemoryStorage) Iterate(fn func(obj meta.Object) error) error {
+	var err error
+	db.data().Range(func(key interface{}, value interface{}) bool {
+		obj, decodeErr := meta.Decode(value.([]byte))
+		if decodeErr != nil {
+			return true
+		}
+		err = fn(obj)
+		return err == nil
+	})
+
+	return err
+}
+
 func (db *MemoryStorage) GetAndLock(path string) ([]byte, error) {
 	if strings.Contains(path, "*") {
 		return []byte{}, errors.New("ooo: can't lock a glob pattern path")
@@ -215,19 +345,7 @@ func (db *MemoryStorage) getN(path string, limit int, order string) ([]meta.Obje
 		return res, errors.New("ooo: invalid limit")
 	}
 
-	db.mem.Range(func(k interface{}, value interface{}) bool {
-		if !key.Match(path, k.(string)) {
-			return true
-		}
-
-		newObject, err := meta.Decode(value.([]byte))
-		if err != nil {
-			return true
-		}
-
-		res = append(res, newObject)
-		return true
-	})
+	res = db.matchObjects(path)
 
 	if order == "desc" {
 		sort.Slice(res, meta.SortDesc(res))
@@ -263,25 +381,26 @@ func (db *MemoryStorage) GetNRange(path string, limit int, from, to int64) ([]me
 		return res, errors.New("ooo: invalid limit")
 	}
 
-	db.mem.Range(func(k interface{}, value interface{}) bool {
-		current := k.(string)
-		if !key.Match(path, current) {
-			return true
-		}
+	mem := db.data()
+	for _, current := range db.index.Match(path) {
 		paths := strings.Split(current, "/")
 		created := key.Decode(paths[len(paths)-1])
 		if created < from || created > to {
-			return true
+			continue
+		}
+
+		value, found := mem.Load(current)
+		if !found {
+			continue
 		}
 
 		newObject, err := meta.Decode(value.([]byte))
 		if err != nil {
-			return true
+			continue
 		}
 
 		res = append(res, newObject)
-		return true
-	})
+	}
 
 	sort.Slice(res, meta.SortDesc(res))
 
@@ -294,7 +413,7 @@ func (db *MemoryStorage) GetNRange(path string, limit int, from, to int64) ([]me
 
 // Peek a value timestamps
 func (db *MemoryStorage) Peek(key string, now int64) (int64, int64) {
-	previous, found := db.mem.Load(key)
+	previous, found := db.data().Load(key)
 	if !found {
 		return now, 0
 	}
@@ -309,7 +428,12 @@ func (db *MemoryStorage) Peek(key string, now int64) (int64, int64) {
 
 // Set a value
 func (db *MemoryStorage) Set(path string, data json.RawMessage) (string, error) {
-	if !key.IsValid(path) {
+	return db.SetWithSchema(path, data, 0)
+}
+
+// SetWithSchema set a value tagged with the schema version of the data
+func (db *MemoryStorage) SetWithSchema(path string, data json.RawMessage, schema int) (string, error) {
+	if !db.valid(path) {
 		return path, ErrInvalidPath
 	}
 	if len(data) == 0 {
@@ -319,17 +443,23 @@ func (db *MemoryStorage) Set(path string, data json.RawMessage) (string, error)
 
 	if !strings.Contains(path, "*") {
 		index := key.LastIndex(path)
+		db.compactMutex.RLock()
 		created, updated := db.Peek(path, now)
-		db.mem.Store(path, meta.New(&meta.Object{
+		err := db.write(journalEntry{Op: "set", Key: path, Value: meta.New(&meta.Object{
 			Created: created,
 			Updated: updated,
 			Index:   index,
 			Path:    path,
+			Schema:  schema,
 			Data:    data,
-		}))
+		})})
+		db.compactMutex.RUnlock()
+		if err != nil {
+			return path, err
+		}
 
 		if !key.Contains(db.noBroadcastKeys, path) && db.Active() {
-			db.watcher <- StorageEvent{Key: path, Operation: "set"}
+			db.watcher <- StorageEvent{Key: path, Operation: "set", Created: updated == 0, RequestID: db.eventRequestID(path)}
 		}
 		return index, nil
 	}
@@ -340,7 +470,7 @@ func (db *MemoryStorage) Set(path string, data json.RawMessage) (string, error)
 }
 
 func (db *MemoryStorage) _patch(path string, data json.RawMessage, now int64) (string, error) {
-	raw, found := db.mem.Load(path)
+	raw, found := db.data().Load(path)
 	if !found {
 		return path, ErrNotFound
 	}
@@ -361,20 +491,21 @@ func (db *MemoryStorage) _patch(path string, data json.RawMessage, now int64) (s
 
 	index := key.LastIndex(path)
 	created, updated := db.Peek(path, now)
-	db.mem.Store(path, meta.New(&meta.Object{
+	err = db.write(journalEntry{Op: "set", Key: path, Value: meta.New(&meta.Object{
 		Created: created,
 		Updated: updated,
 		Index:   index,
 		Path:    path,
+		Schema:  obj.Schema,
 		Data:    merged,
-	}))
+	})})
 
-	return path, nil
+	return path, err
 }
 
 // Set a value to matching keys
 func (db *MemoryStorage) Patch(path string, data json.RawMessage) (string, error) {
-	if !key.IsValid(path) {
+	if !db.valid(path) {
 		return path, ErrInvalidPath
 	}
 	if len(data) == 0 {
@@ -383,29 +514,23 @@ func (db *MemoryStorage) Patch(path string, data json.RawMessage) (string, error
 
 	now := time.Now().UTC().UnixNano()
 	if !strings.Contains(path, "*") {
+		db.compactMutex.RLock()
 		index, err := db._patch(path, data, now)
+		db.compactMutex.RUnlock()
 		if err != nil {
 			return path, err
 		}
 
 		if !key.Contains(db.noBroadcastKeys, path) && db.Active() {
-			db.watcher <- StorageEvent{Key: path, Operation: "set"}
+			db.watcher <- StorageEvent{Key: path, Operation: "set", RequestID: db.eventRequestID(path)}
 		}
 		return index, nil
 	}
 
-	keys := []string{}
-	db.mem.Range(func(_key interface{}, value interface{}) bool {
-		current := _key.(string)
-		if !key.Match(path, current) {
-			return true
-		}
-		keys = append(keys, current)
-		return true
-	})
-
 	// batch patch
-	for _, key := range keys {
+	db.compactMutex.RLock()
+	defer db.compactMutex.RUnlock()
+	for _, key := range db.index.Match(path) {
 		_, err := db._patch(key, data, now)
 		if err != nil {
 			return path, err
@@ -417,24 +542,30 @@ func (db *MemoryStorage) Patch(path string, data json.RawMessage) (string, error
 
 // SetWithMeta set entries with metadata created/updated values
 func (db *MemoryStorage) SetWithMeta(path string, data json.RawMessage, created int64, updated int64) (string, error) {
-	if !key.IsValid(path) {
+	if !db.valid(path) {
 		return path, ErrInvalidPath
 	}
 	index := key.LastIndex(path)
-	db.mem.Store(path, meta.New(&meta.Object{
+	db.compactMutex.RLock()
+	_, found := db.data().Load(path)
+	err := db.write(journalEntry{Op: "set", Key: path, Value: meta.New(&meta.Object{
 		Created: created,
 		Updated: updated,
 		Index:   index,
 		Path:    path,
 		Data:    data,
-	}))
+	})})
+	db.compactMutex.RUnlock()
+	if err != nil {
+		return path, err
+	}
 
 	if len(path) > 8 && path[0:7] == "history" {
 		return index, nil
 	}
 
 	if !key.Contains(db.noBroadcastKeys, path) && db.Active() {
-		db.watcher <- StorageEvent{Key: path, Operation: "set"}
+		db.watcher <- StorageEvent{Key: path, Operation: "set", Created: !found, RequestID: db.eventRequestID(path)}
 	}
 	return index, nil
 }
@@ -442,29 +573,51 @@ func (db *MemoryStorage) SetWithMeta(path string, data json.RawMessage, created
 // Del a key/pattern value(s)
 func (db *MemoryStorage) Del(path string) error {
 	if !strings.Contains(path, "*") {
-		_, found := db.mem.Load(path)
+		db.compactMutex.RLock()
+		_, found := db.data().Load(path)
 		if !found {
+			db.compactMutex.RUnlock()
 			return ErrNotFound
 		}
-		db.mem.Delete(path)
+		err := db.write(journalEntry{Op: "del", Key: path})
+		db.compactMutex.RUnlock()
+		if err != nil {
+			return err
+		}
 		if !key.Contains(db.noBroadcastKeys, path) && db.Active() {
-			db.watcher <- StorageEvent{Key: path, Operation: "del"}
+			db.watcher <- StorageEvent{Key: path, Operation: "del", RequestID: db.eventRequestID(path)}
 		}
 		return nil
 	}
 
-	db.mem.Range(func(k interface{}, value interface{}) bool {
-		if key.Match(path, k.(string)) {
-			db.mem.Delete(k.(string))
+	db.compactMutex.RLock()
+	for _, k := range db.index.Match(path) {
+		err := db.write(journalEntry{Op: "del", Key: k})
+		if err != nil {
+			db.compactMutex.RUnlock()
+			return err
 		}
-		return true
-	})
+	}
+	db.compactMutex.RUnlock()
 	if !key.Contains(db.noBroadcastKeys, path) && db.Active() {
-		db.watcher <- StorageEvent{Key: path, Operation: "del"}
+		db.watcher <- StorageEvent{Key: path, Operation: "del", RequestID: db.eventRequestID(path)}
 	}
 	return nil
 }
 
+// Compact rebuilds the storage map from the live entries to release
+// the memory retained after mass deletes, writes wait until it's done
+func (db *MemoryStorage) Compact() {
+	db.compactMutex.Lock()
+	defer db.compactMutex.Unlock()
+	compacted := &sync.Map{}
+	db.data().Range(func(k interface{}, value interface{}) bool {
+		compacted.Store(k, value)
+		return true
+	})
+	db.mem.Store(compacted)
+}
+
 // Watch the storage set/del events
 func (db *MemoryStorage) Watch() StorageChan {
 	return db.watcher
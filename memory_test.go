@@ -1,8 +1,17 @@
 package ooo
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/benitogf/ooo/meta"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStorageMemory(t *testing.T) {
@@ -79,6 +88,38 @@ func TestGetN(t *testing.T) {
 	StorageGetNTest(app, t, 10)
 }
 
+func TestGetMulti(t *testing.T) {
+	app := &Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	StorageGetMultiTest(app, t)
+}
+
+func TestSetWithSchema(t *testing.T) {
+	app := &Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	StorageSetWithSchemaTest(app, t)
+}
+
+func TestKeyOrder(t *testing.T) {
+	app := &Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	StorageKeyOrderTest(app, t)
+}
+
+func TestIterate(t *testing.T) {
+	app := &Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	StorageIterateTest(app, t)
+}
+
 func TestKeysRange(t *testing.T) {
 	// t.Parallel()
 	app := &Server{}
@@ -106,3 +147,165 @@ func TestBatchSet(t *testing.T) {
 	defer app.Close(os.Interrupt)
 	StorageBatchSetTest(app, t, 10)
 }
+
+func TestMemoryCompact(t *testing.T) {
+	db := &MemoryStorage{}
+	err := db.Start(StorageOpt{NoBroadcastKeys: []string{"test/*"}})
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10000; i++ {
+		_, err := db.Set("test/"+strconv.Itoa(i), TEST_DATA)
+		require.NoError(t, err)
+	}
+	for i := 0; i < 9990; i++ {
+		err := db.Del("test/" + strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+
+	before := db.mem.Load()
+	db.Compact()
+	require.NotSame(t, before, db.mem.Load())
+
+	objs, err := db.GetN("test/*", 100)
+	require.NoError(t, err)
+	require.Equal(t, 10, len(objs))
+	raw, err := db.Get("test/9995")
+	require.NoError(t, err)
+	obj, err := meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, "9995", obj.Index)
+	_, err = db.Get("test/1")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = db.Set("test/1", TEST_DATA)
+	require.NoError(t, err)
+	_, err = db.Get("test/1")
+	require.NoError(t, err)
+}
+
+func TestMemoryCompactPatch(t *testing.T) {
+	db := &MemoryStorage{}
+	err := db.Start(StorageOpt{})
+	require.NoError(t, err)
+	defer db.Close()
+
+	go db.Set("thing", TEST_DATA)
+	<-db.Watch()
+
+	// a patch waiting for its event to be read doesn't block the compaction
+	patched := make(chan error)
+	go func() {
+		_, err := db.Patch("thing", json.RawMessage(`{"name":"patched"}`))
+		patched <- err
+	}()
+	require.Eventually(t, func() bool {
+		raw, err := db.Get("thing")
+		return err == nil && bytes.Contains(raw, []byte("patched"))
+	}, time.Second, time.Millisecond)
+	compacted := make(chan struct{})
+	go func() {
+		db.Compact()
+		close(compacted)
+	}()
+	select {
+	case <-compacted:
+	case <-time.After(time.Second):
+		t.Fatal("compaction blocked by the patch event")
+	}
+	<-db.Watch()
+	require.NoError(t, <-patched)
+}
+
+func TestMemoryJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	db := &MemoryStorage{JournalSync: true}
+	db.Journal(path)
+	err := db.Start(StorageOpt{NoBroadcastKeys: []string{"test/*", "thing"}})
+	require.NoError(t, err)
+
+	_, err = db.Set("test/1", TEST_DATA)
+	require.NoError(t, err)
+	_, err = db.Set("test/2", TEST_DATA)
+	require.NoError(t, err)
+	_, err = db.Set("thing", TEST_DATA)
+	require.NoError(t, err)
+	_, err = db.Patch("thing", json.RawMessage(`{"name":"patched"}`))
+	require.NoError(t, err)
+	err = db.Del("test/1")
+	require.NoError(t, err)
+	// simulate a crash in the middle of a write
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"set","key":"test/3"`)
+	require.NoError(t, err)
+	file.Close()
+	db.Close()
+
+	restarted := &MemoryStorage{}
+	restarted.Journal(path)
+	err = restarted.Start(StorageOpt{NoBroadcastKeys: []string{"test/*", "thing"}})
+	require.NoError(t, err)
+	defer restarted.Close()
+
+	_, err = restarted.Get("test/1")
+	require.ErrorIs(t, err, ErrNotFound)
+	objs, err := restarted.GetN("test/*", 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, "2", objs[0].Index)
+	raw, err := restarted.Get("thing")
+	require.NoError(t, err)
+	obj, err := meta.Decode(raw)
+	require.NoError(t, err)
+	require.Contains(t, string(obj.Data), "patched")
+
+	_, err = restarted.Set("test/4", TEST_DATA)
+	require.NoError(t, err)
+	objs, err = restarted.GetN("test/*", 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(objs))
+}
+
+func TestMemoryJournalCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	db := &MemoryStorage{JournalCompact: 100}
+	db.Journal(path)
+	err := db.Start(StorageOpt{NoBroadcastKeys: []string{"test/*", "thing"}})
+	require.NoError(t, err)
+
+	// writes keep going while the snapshots are written
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				_, err := db.Set("test/"+strconv.Itoa(w*10+i%10), TEST_DATA)
+				require.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	lines := func() int {
+		raw, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return bytes.Count(raw, []byte("\n"))
+	}
+	require.Eventually(t, func() bool {
+		return lines() <= 140
+	}, time.Second, time.Millisecond)
+	err = db.CompactJournal()
+	require.NoError(t, err)
+	require.Equal(t, 40, lines())
+	db.Close()
+
+	restarted := &MemoryStorage{}
+	restarted.Journal(path)
+	err = restarted.Start(StorageOpt{NoBroadcastKeys: []string{"test/*", "thing"}})
+	require.NoError(t, err)
+	defer restarted.Close()
+	objs, err := restarted.GetN("test/*", 100)
+	require.NoError(t, err)
+	require.Equal(t, 40, len(objs))
+}
@@ -9,11 +9,35 @@ import (
 	"github.com/goccy/go-json"
 )
 
+// ErrOversized the data of the message exceeded the stream size limit
+// and should be fetched through the rest api
+var ErrOversized = errors.New("ooo: message data oversized")
+
 // Message sent through websocket connections
 type Message struct {
-	Data     json.RawMessage `json:"data"`
-	Version  string          `json:"version"`
-	Snapshot bool            `json:"snapshot"`
+	Data      json.RawMessage `json:"data"`
+	Version   string          `json:"version"`
+	Snapshot  bool            `json:"snapshot"`
+	Oversized bool            `json:"oversized,omitempty"`
+	RequestID string          `json:"requestId,omitempty"`
+	Ready     bool            `json:"ready,omitempty"`
+	Heartbeat bool            `json:"heartbeat,omitempty"`
+	Removed   []string        `json:"removed,omitempty"`
+	Key       string          `json:"key,omitempty"`
+}
+
+// IsReady checks if the message is a subscription ready frame
+func IsReady(data []byte) bool {
+	var wsEvent Message
+	err := json.Unmarshal(data, &wsEvent)
+	return err == nil && wsEvent.Ready
+}
+
+// IsHeartbeat checks if the message is a heartbeat frame
+func IsHeartbeat(data []byte) bool {
+	var wsEvent Message
+	err := json.Unmarshal(data, &wsEvent)
+	return err == nil && wsEvent.Heartbeat
 }
 
 // DecodeTest data (testing function)
@@ -45,15 +69,36 @@ func DecodeReader(r io.Reader) (json.RawMessage, error) {
 	return httpEvent, nil
 }
 
+// Decode a frame once so its fields can be checked without decoding it again
+func Decode(data []byte) (Message, error) {
+	var wsEvent Message
+	err := json.Unmarshal(data, &wsEvent)
+	return wsEvent, err
+}
+
+// PatchCache applies a message to the cache, any snapshot replaces the
+// cache regardless of its version so a server restart rebases the client
 func PatchCache(data []byte, cache json.RawMessage) (json.RawMessage, error) {
-	message, err := DecodeBuffer(data)
+	message, err := Decode(data)
 	if err != nil {
 		return cache, err
 	}
 
+	return message.PatchCache(cache)
+}
+
+// PatchCache applies the decoded message to the cache, the cache
+// passed isn't modified so it can be kept when the result is discarded
+func (message Message) PatchCache(cache json.RawMessage) (json.RawMessage, error) {
+	if message.Oversized {
+		return cache, ErrOversized
+	}
+	if len(message.Data) == 0 {
+		return cache, errors.New("ooo: decode error, empty data")
+	}
+
 	if message.Snapshot {
-		cache = message.Data
-		return cache, nil
+		return message.Data, nil
 	}
 	if string(message.Data) == "[]" {
 		return cache, nil
@@ -72,7 +117,17 @@ func PatchCache(data []byte, cache json.RawMessage) (json.RawMessage, error) {
 }
 
 func Patch(data []byte, cache json.RawMessage) (json.RawMessage, meta.Object, error) {
-	cache, err := PatchCache(data, cache)
+	message, err := Decode(data)
+	if err != nil {
+		return cache, meta.Object{}, err
+	}
+
+	return message.Patch(cache)
+}
+
+// Patch applies the decoded message to the cache of an object
+func (message Message) Patch(cache json.RawMessage) (json.RawMessage, meta.Object, error) {
+	cache, err := message.PatchCache(cache)
 	if err != nil {
 		return cache, meta.Object{}, err
 	}
@@ -86,7 +141,17 @@ func Patch(data []byte, cache json.RawMessage) (json.RawMessage, meta.Object, er
 }
 
 func PatchList(data []byte, cache json.RawMessage) (json.RawMessage, []meta.Object, error) {
-	cache, err := PatchCache(data, cache)
+	message, err := Decode(data)
+	if err != nil {
+		return cache, []meta.Object{}, err
+	}
+
+	return message.PatchList(cache)
+}
+
+// PatchList applies the decoded message to the cache of a list
+func (message Message) PatchList(cache json.RawMessage) (json.RawMessage, []meta.Object, error) {
+	cache, err := message.PatchCache(cache)
 	if err != nil {
 		return cache, []meta.Object{}, err
 	}
@@ -13,6 +13,7 @@ type Object struct {
 	Updated int64           `json:"updated"`
 	Index   string          `json:"index"`
 	Path    string          `json:"path"`
+	Schema  int             `json:"schema,omitempty"`
 	Data    json.RawMessage `json:"data"`
 }
 
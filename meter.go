@@ -0,0 +1,53 @@
+package ooo
+
+import (
+	"io"
+	"net/http"
+)
+
+// meteredBody counts the bytes read from a request body
+type meteredBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (body *meteredBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.read += int64(n)
+	return n, err
+}
+
+// meteredWriter counts the bytes written to a response
+type meteredWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *meteredWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// meter reports the body bytes of REST requests and responses to the
+// Meter callback, websocket upgrades are metered by the stream
+func (app *Server) meter(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		body := &meteredBody{ReadCloser: r.Body}
+		r.Body = body
+		writer := &meteredWriter{ResponseWriter: w}
+		handler.ServeHTTP(writer, r)
+		app.Meter(app.Principal(r), body.read, writer.written)
+	})
+}
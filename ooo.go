@@ -7,21 +7,25 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/benitogf/coat"
+	"github.com/benitogf/ooo/key"
 	"github.com/benitogf/ooo/meta"
 	"github.com/benitogf/ooo/stream"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/rs/cors"
 )
 
 const deadlineMsg = "ooo: server deadline reached"
 
+// syncOperation storage event operation used by Sync to drain the watch workers
+const syncOperation = "sync"
+
 // audit requests function
 // will define approval or denial by the return value
 // r: the request to be audited
@@ -48,64 +52,218 @@ type audit func(r *http.Request) bool
 //
 // OnUnsubscribe: function to monitor unsubscribe events
 //
+// OnSubscribeCtx: function to monitor subscribe events with the principal and remote address of the subscriber
+//
+// OnUnsubscribeCtx: function to monitor unsubscribe events with the principal and remote address of the subscriber
+//
+// Principal: function to identify the principal of a request
+//
+// AuthorizeRead: function to define which objects a principal can read, applied per subscription and on reads
+//
+// VersionFrom: function to derive the version of single object pools from the object (UpdatedBased keeps versions across restarts), defaults to the time of the pool update
+//
+// Meter: function to account the bytes read and written per principal, called after each REST request and when a subscription closes
+//
+// RequestID: function to generate the id of write requests that don't provide a valid X-Request-Id header
+//
+// ReturnRepresentation: respond POST and PUT requests with the stored object (through the read filters) instead of the index, can be requested per write with a "Prefer: return=representation" header
+//
+// EmptyAsOK: respond GET requests of keys without data with a 200 status and an empty object instead of a 404, same as subscriptions
+//
 // OnClose: function that triggers before closing the application
 //
-// Deadline: time duration of a request before timing out
+// AuditLog: record every successful POST, PUT, PATCH and DELETE request (principal, method, key, time and hashes of the data before and after) as an entry of the AuditLogPath list, the list doesn't broadcast and can't be modified through the api
+//
+// AuditLogPath: list path of the audit log entries, defaults to "audit/*"
+//
+// AuditLogSink: function that receives the audit log entries instead of storing them
+//
+// KeyCaseInsensitive: keys of the key routes and subscriptions are lowercased before they are handled so /Test and /test are the same key
+//
+// TrailingSlash: policy of the keys with a trailing slash, Strict (default) rejects them as invalid, Redirect responds a 301 to the key without it and Ignore removes it
+//
+// KeysStreamThreshold: number of stored keys over which the key list of the root route is written incrementally (unsorted) instead of building it in memory, zero always builds the sorted list
+//
+// ErrorStatus: status of the responses of storage errors (matched with errors.Is), overrides the defaults (ErrNotFound 404, ErrNoop 304, ErrInvalidPath and ErrInvalidSchema 400, other errors 500)
+//
+// MaxBodyBytes: limit in bytes of the body of a bulk import (POST /?api=import), the body is read as a stream and the import stops with 413 once the limit is reached, zero means no limit
+//
+// MaxConnections: limit of simultaneous connections accepted by the listener, further connections wait in the backlog until one closes, zero means no limit
+//
+// ListenConfig: options of the tcp listener (socket control like SO_REUSEPORT, keep-alive)
+//
+// MaxConcurrentUpgrades: limit of subscriptions sending their initial snapshot at the same time, zero means no limit
+//
+// LongPollTimeout: time a long-poll read (?wait=1&since=version) waits for a change before responding 304, defaults to 30 seconds
+//
+// UpgradeWait: time a subscription waits for an upgrade slot before responding 503 with a Retry-After header, defaults to 1 second
+//
+// Deadline: time duration of a request before timing out, can be overridden per path with SetDeadline
+//
+// DisableCORS: skip the global cross domain handling, for same origin deployments (path policies defined with CORS still apply)
 //
 // AllowedOrigins: list of allowed origins for cross domain access, defaults to ["*"]
 //
-// AllowedMethods: list of allowed methods for cross domain access, defaults to ["GET", "POST", "DELETE", "PUT"]
+// AllowedMethods: list of allowed methods for cross domain access, defaults to ["GET", "HEAD", "POST", "DELETE", "PUT", "PATCH"]
 //
-// AllowedHeaders: list of allowed headers for cross domain access, defaults to ["Authorization", "Content-Type"]
+// AllowedHeaders: list of allowed headers for cross domain access, defaults to ["Authorization", "Content-Type", "X-Request-Id", "X-Schema", "Prefer"]
 //
-// ExposedHeaders: list of exposed headers for cross domain access, defaults to nil
+// ExposedHeaders: list of exposed headers for cross domain access, defaults to ["X-Request-Id", "X-Next-Cursor", "X-Version"]
 //
 // Storage: database interdace implementation
 //
+// ReadStorage: storage of the reads (GET, subscriptions, key list, local reads), defaults to Storage, writes and broadcasts use Storage so reads of a replica can lag behind the broadcasts, started and closed with the server when it isn't active
+//
+// StorageFactory: function to create a new storage on each start, takes precedence over Storage
+//
 // Silence: output silence flag
 //
 // Static: static routing flag
 //
-// Tick: time interval between ticks on the clock subscription
+// KeyPattern: route regex for keys, defaults to key.Pattern, keys are validated with it (key.Validator) in the handlers and the storage writes
+//
+// Tick: time interval between ticks on the clock subscription, defaults to 1 second, a negative value disables the periodic ticks (the time is only sent on connect), 0 can't mean on demand only since it's the unset value that gets the default, clock subscribers can request a coarser interval with the tick query parameter (ws://host/?tick=5s)
+//
+// Signal: os signal channel, created by WaitClose when not defined
 //
-// Signal: os signal channel
+// OnReload: function called on SIGHUP while waiting in WaitClose instead of closing the server (can call ReloadFilters), without it SIGHUP closes the server
 //
 // Client: http client to make requests
 type Server struct {
-	wg                sync.WaitGroup
-	server            *http.Server
-	Router            *mux.Router
-	Stream            stream.Stream
-	filters           filters
-	Pivot             string
-	NoBroadcastKeys   []string
-	DbOpt             interface{}
-	Audit             audit
-	Workers           int
-	ForcePatch        bool
-	NoPatch           bool
-	OnSubscribe       stream.Subscribe
-	OnUnsubscribe     stream.Unsubscribe
-	OnClose           func()
-	Deadline          time.Duration
-	AllowedOrigins    []string
-	AllowedMethods    []string
-	AllowedHeaders    []string
-	ExposedHeaders    []string
-	Storage           Database
-	Address           string
-	closing           int64
-	active            int64
-	Silence           bool
-	Static            bool
-	Tick              time.Duration
-	Console           *coat.Console
-	Signal            chan os.Signal
-	Client            *http.Client
-	ReadTimeout       time.Duration
-	WriteTimeout      time.Duration
-	ReadHeaderTimeout time.Duration
-	IdleTimeout       time.Duration
+	wg                    sync.WaitGroup
+	server                *http.Server
+	Router                *mux.Router
+	Stream                stream.Stream
+	filters               filters
+	filtersMutex          sync.RWMutex
+	reloadMutex           sync.Mutex
+	staging               *filters
+	listLocks             sync.Map
+	warm                  []string
+	warmMutex             sync.RWMutex
+	deadlines             []deadline
+	events                eventCallbacks
+	requestIDs            sync.Map
+	writeLocks            [writeLockCount]sync.Mutex
+	importing             sync.Map
+	syncMutex             sync.Mutex
+	syncBarrier           *sync.WaitGroup
+	syncRelease           chan struct{}
+	Pivot                 string
+	NoBroadcastKeys       []string
+	DbOpt                 interface{}
+	Audit                 audit
+	Workers               int
+	ForcePatch            bool
+	NoPatch               bool
+	OnSubscribe           stream.Subscribe
+	OnUnsubscribe         stream.Unsubscribe
+	OnSubscribeCtx        stream.SubscribeCtx
+	OnUnsubscribeCtx      stream.UnsubscribeCtx
+	Principal             stream.Principal
+	AuthorizeRead         stream.AuthorizeRead
+	VersionFrom           stream.VersionFrom
+	Meter                 stream.Meter
+	RequestID             func() string
+	OnClose               func()
+	MaxConcurrentUpgrades int
+	UpgradeWait           time.Duration
+	LongPollTimeout       time.Duration
+	upgrades              chan struct{}
+	Deadline              time.Duration
+	DisableCORS           bool
+	corsPolicies          []corsPolicy
+	EmptyAsOK             bool
+	AuditLog              bool
+	AuditLogPath          string
+	AuditLogSink          func(AuditLogEntry)
+	KeysStreamThreshold   int
+	KeyCaseInsensitive    bool
+	TrailingSlash         SlashPolicy
+	ErrorStatus           map[error]int
+	MaxBodyBytes          int64
+	MaxConnections        int
+	ListenConfig          net.ListenConfig
+	ReturnRepresentation  bool
+	AllowedOrigins        []string
+	AllowedMethods        []string
+	AllowedHeaders        []string
+	ExposedHeaders        []string
+	Storage               Database
+	StorageFactory        func() Database
+	ReadStorage           Database
+	Address               string
+	AdminAddress          string
+	admin                 atomic.Pointer[http.Server]
+	closing               int64
+	active                int64
+	Silence               bool
+	Static                bool
+	KeyPattern            string
+	keyValidator          func(key string) bool
+	Tick                  time.Duration
+	Console               *coat.Console
+	Signal                chan os.Signal
+	OnReload              func()
+	Client                *http.Client
+	ReadTimeout           time.Duration
+	WriteTimeout          time.Duration
+	ReadHeaderTimeout     time.Duration
+	IdleTimeout           time.Duration
+}
+
+// UpdatedBased derives the version from the stored timestamps of the
+// object so it only changes when the object is modified
+func UpdatedBased(obj meta.Object) int64 {
+	if obj.Updated != 0 {
+		return obj.Updated
+	}
+
+	return obj.Created
+}
+
+// deadline per path override of the request deadline
+type deadline struct {
+	path     string
+	duration time.Duration
+}
+
+// SetDeadline overrides the request deadline for keys matching the path
+func (app *Server) SetDeadline(path string, duration time.Duration) {
+	app.deadlines = append(app.deadlines, deadline{
+		path:     path,
+		duration: duration,
+	})
+}
+
+// PatchMode overrides NoPatch and ForcePatch for the subscriptions of keys matching the path
+func (app *Server) PatchMode(path string, mode stream.PatchMode) {
+	app.Stream.SetPatchMode(path, mode)
+}
+
+// EndpointGroup mounts the routes defined by fn on a subrouter under the prefix,
+// the routes are defined relative to the prefix and take precedence over the key routes
+func (app *Server) EndpointGroup(prefix string, fn func(r *mux.Router)) {
+	if app.Router == nil {
+		app.Router = mux.NewRouter()
+	}
+
+	fn(app.Router.PathPrefix(prefix).Subrouter())
+}
+
+// timeout wraps a handler with the deadline that matches the request key
+func (app *Server) timeout(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		duration := app.Deadline
+		_key := mux.Vars(r)["key"]
+		for _, d := range app.deadlines {
+			if d.path == _key || key.Match(d.path, _key) {
+				duration = d.duration
+				break
+			}
+		}
+		http.TimeoutHandler(handler, duration, deadlineMsg).ServeHTTP(w, r)
+	})
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
@@ -121,37 +279,57 @@ func (app *Server) waitListen() {
 	err = app.Storage.Start(StorageOpt{
 		NoBroadcastKeys: app.NoBroadcastKeys,
 		DbOpt:           app.DbOpt,
+		ValidKey:        app.validKey,
+		RequestID:       app.takeRequestID,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
+	if app.ReadStorage != nil && !app.ReadStorage.Active() {
+		err = app.ReadStorage.Start(StorageOpt{DbOpt: app.DbOpt, ValidKey: app.validKey})
+		if err != nil {
+			log.Fatal(err)
+		}
+		go WatchStorageNoop(app.ReadStorage)
+	}
+	// handlers chain: cors (per path policy or global unless disabled) -> meter (if defined) -> compress -> router
+	var handler http.Handler = handlers.CompressHandler(app.Router)
+	if app.Meter != nil {
+		handler = app.meter(handler)
+	}
+	handler = app.corsHandler(handler)
 	app.server = &http.Server{
 		WriteTimeout:      app.WriteTimeout,
 		ReadTimeout:       app.ReadTimeout,
 		ReadHeaderTimeout: app.ReadHeaderTimeout,
 		IdleTimeout:       app.IdleTimeout,
 		Addr:              app.Address,
-		Handler: cors.New(cors.Options{
-			AllowedMethods: app.AllowedMethods,
-			AllowedOrigins: app.AllowedOrigins,
-			AllowedHeaders: app.AllowedHeaders,
-			ExposedHeaders: app.ExposedHeaders,
-			// AllowCredentials: true,
-			// Debug:          true,
-		}).Handler(handlers.CompressHandler(app.Router))}
-	ln, err := net.Listen("tcp4", app.Address)
+		Handler:           handler}
+	ln, err := app.ListenConfig.Listen(context.Background(), "tcp4", app.Address)
 	if err != nil {
 		log.Fatal("failed to start tcp, ", err)
 	}
 	app.Address = ln.Addr().String()
+	ln = tcpKeepAliveListener{ln.(*net.TCPListener)}
+	if app.MaxConnections > 0 {
+		ln = newLimitListener(ln, app.MaxConnections)
+	}
 	atomic.StoreInt64(&app.active, 1)
 	app.wg.Done()
-	err = app.server.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+	err = app.server.Serve(ln)
 	if atomic.LoadInt64(&app.closing) != 1 {
 		log.Fatal(err)
 	}
 }
 
+// validKey checks a key with the KeyPattern of the server
+func (app *Server) validKey(k string) bool {
+	if app.keyValidator == nil {
+		return key.IsValid(k)
+	}
+	return app.keyValidator(k)
+}
+
 // Active check if the server is active
 func (app *Server) Active() bool {
 	return atomic.LoadInt64(&app.active) == 1 && atomic.LoadInt64(&app.closing) == 0
@@ -171,43 +349,125 @@ func (app *Server) waitStart() {
 
 // Fetch data, update cache and apply filter
 func (app *Server) fetch(key string) (stream.Cache, error) {
-	err := app.filters.Read.checkStatic(key, app.Static)
+	err := app.filterSet().Read.checkStatic(key, app.Static)
 	if err != nil {
 		return stream.Cache{}, err
 	}
-	return app.Stream.Refresh(key, app.getFilteredData), nil
+	var filterErr error
+	cache := app.Stream.Refresh(key, func(key string) ([]byte, error) {
+		data, err := app.getFilteredData(key)
+		filterErr = err
+		return data, err
+	})
+	// filters can define the response with an HTTPError
+	if _, ok := asHTTPError(filterErr); ok {
+		return cache, filterErr
+	}
+	return cache, nil
+}
+
+// reads the storage of the read paths
+func (app *Server) reads() Database {
+	if app.ReadStorage != nil {
+		return app.ReadStorage
+	}
+
+	return app.Storage
 }
 
-// getFilteredData
+// getFilteredData the data of a key from the read storage through the read filters
 func (app *Server) getFilteredData(key string) ([]byte, error) {
-	raw, _ := app.Storage.Get(key)
+	return app.filteredData(app.reads(), key)
+}
+
+// filteredData the data of a key from a storage through the read filters
+func (app *Server) filteredData(db Database, key string) ([]byte, error) {
+	raw, _ := db.Get(key)
 	if len(raw) == 0 {
 		raw = meta.EmptyObject
 	}
-	filteredData, err := app.filters.Read.check(key, raw, app.Static)
+	raw, err := app.filterSet().Migrate.check(key, raw)
+	if err != nil {
+		return []byte(""), err
+	}
+	filteredData, err := app.filterSet().Read.check(key, raw, app.Static)
 	if err != nil {
 		return []byte(""), err
 	}
 	return filteredData, nil
 }
 
+// Sync blocks until the broadcasts of the storage events
+// sent before the call are written to the subscriptions
+func (app *Server) Sync() {
+	app.syncMutex.Lock()
+	defer app.syncMutex.Unlock()
+	if !app.Active() || !app.Storage.Active() {
+		return
+	}
+
+	// every worker takes one sync event after finishing its current
+	// broadcast and waits until all the workers got theirs
+	app.syncBarrier = &sync.WaitGroup{}
+	app.syncBarrier.Add(app.Workers)
+	app.syncRelease = make(chan struct{})
+	sc := app.Storage.Watch()
+	for i := 0; i < app.Workers; i++ {
+		sc <- StorageEvent{Operation: syncOperation}
+	}
+	app.syncBarrier.Wait()
+	close(app.syncRelease)
+	app.Stream.FlushAll()
+}
+
 func (app *Server) watch(sc StorageChan) {
 	broadcastOpt := stream.BroadcastOpt{
-		Get:      app.getFilteredData,
+		Get: func(key string) ([]byte, error) {
+			return app.filteredData(app.Storage, key)
+		},
 		Callback: nil,
 	}
 	for {
-		ev := <-sc
+		ev, ok := <-sc
+		// the storage closed the channel
+		if !ok {
+			break
+		}
+		if ev.Operation == syncOperation {
+			release := app.syncRelease
+			app.syncBarrier.Done()
+			<-release
+			continue
+		}
 		if ev.Key != "" {
-			app.Console.Log("broadcast[" + ev.Key + "]")
-			app.Stream.Broadcast(ev.Key, broadcastOpt)
+			app.process(ev, broadcastOpt)
 		}
-		if !app.Storage.Active() {
+		// an inactive storage stops the worker only when the server is closing,
+		// a storage that recovers keeps broadcasting
+		if !app.Storage.Active() && atomic.LoadInt64(&app.closing) == 1 {
 			break
 		}
 	}
 }
 
+// process broadcasts a storage event and calls the event callbacks,
+// a panic is logged and the worker continues with the next event
+func (app *Server) process(ev StorageEvent, broadcastOpt stream.BroadcastOpt) {
+	defer func() {
+		if r := recover(); r != nil {
+			app.Console.Err("ooo: recovered panic processing the event of "+ev.Key, r)
+		}
+	}()
+	app.Console.Log("broadcast[" + ev.Key + "]")
+	opt := broadcastOpt
+	opt.RequestID = ev.RequestID
+	// a bulk import broadcasts once it's done
+	if !app.isImporting(ev.RequestID) {
+		app.Stream.Broadcast(ev.Key, opt)
+	}
+	app.events.check(ev)
+}
+
 // defaults will populate the server fields with their zero values
 func (app *Server) defaults() {
 	if app.Router == nil {
@@ -229,6 +489,7 @@ func (app *Server) defaults() {
 	if app.AllowedMethods == nil || len(app.AllowedMethods) == 0 {
 		app.AllowedMethods = []string{
 			http.MethodGet,
+			http.MethodHead,
 			http.MethodPost,
 			http.MethodDelete,
 			http.MethodPut,
@@ -237,7 +498,30 @@ func (app *Server) defaults() {
 	}
 
 	if app.AllowedHeaders == nil || len(app.AllowedHeaders) == 0 {
-		app.AllowedHeaders = []string{"Authorization", "Content-Type"}
+		app.AllowedHeaders = []string{"Authorization", "Content-Type", "X-Request-Id", "X-Schema", "Prefer"}
+	}
+
+	if app.ExposedHeaders == nil || len(app.ExposedHeaders) == 0 {
+		app.ExposedHeaders = []string{"X-Request-Id", "X-Next-Cursor", "X-Version"}
+	}
+
+	if app.UpgradeWait == 0 {
+		app.UpgradeWait = 1 * time.Second
+	}
+
+	if app.LongPollTimeout == 0 {
+		app.LongPollTimeout = 30 * time.Second
+	}
+
+	app.upgrades = nil
+	if app.MaxConcurrentUpgrades > 0 {
+		app.upgrades = make(chan struct{}, app.MaxConcurrentUpgrades)
+	}
+
+	if app.RequestID == nil {
+		app.RequestID = func() string {
+			return strconv.FormatInt(time.Now().UTC().UnixNano(), 16)
+		}
 	}
 
 	if app.Console == nil {
@@ -248,10 +532,24 @@ func (app *Server) defaults() {
 		app.Stream.Console = app.Console
 	}
 
+	if app.StorageFactory != nil {
+		app.Storage = app.StorageFactory()
+	}
+
 	if app.Storage == nil {
 		app.Storage = &MemoryStorage{}
 	}
 
+	if app.KeyPattern == "" {
+		app.KeyPattern = key.Pattern
+	}
+
+	validKey, err := key.Validator(app.KeyPattern)
+	if err != nil {
+		log.Fatal("invalid key pattern, ", err)
+	}
+	app.keyValidator = validKey
+
 	if app.Tick == 0 {
 		app.Tick = 1 * time.Second
 	}
@@ -292,6 +590,34 @@ func (app *Server) defaults() {
 		app.Stream.OnUnsubscribe = app.OnUnsubscribe
 	}
 
+	if app.Stream.OnSubscribeCtx == nil {
+		app.Stream.OnSubscribeCtx = app.OnSubscribeCtx
+	}
+
+	if app.Stream.OnUnsubscribeCtx == nil {
+		app.Stream.OnUnsubscribeCtx = app.OnUnsubscribeCtx
+	}
+
+	if app.Principal == nil {
+		app.Principal = func(r *http.Request) string { return "" }
+	}
+
+	if app.Stream.Principal == nil {
+		app.Stream.Principal = app.Principal
+	}
+
+	if app.Stream.AuthorizeRead == nil {
+		app.Stream.AuthorizeRead = app.AuthorizeRead
+	}
+
+	if app.Stream.VersionFrom == nil {
+		app.Stream.VersionFrom = app.VersionFrom
+	}
+
+	if app.Stream.Meter == nil {
+		app.Stream.Meter = app.Meter
+	}
+
 	if app.Workers == 0 {
 		app.Workers = 6
 	}
@@ -300,6 +626,14 @@ func (app *Server) defaults() {
 		app.NoBroadcastKeys = []string{}
 	}
 
+	if app.AuditLogPath == "" {
+		app.AuditLogPath = "audit/*"
+	}
+
+	if app.AuditLog && app.AuditLogSink == nil && !key.Contains(app.NoBroadcastKeys, app.AuditLogPath) {
+		app.NoBroadcastKeys = append(app.NoBroadcastKeys, app.AuditLogPath)
+	}
+
 	if app.Client == nil {
 		app.Client = &http.Client{
 			Timeout: 10 * time.Second,
@@ -338,23 +672,30 @@ func (app *Server) Start(address string) {
 	app.defaults()
 	// https://ieftimov.com/post/make-resilient-golang-net-http-servers-using-timeouts-deadlines-context-cancellation/
 	app.Router.HandleFunc("/", app.getStats).Methods("GET")
+	app.Router.HandleFunc("/", app.public(app.importData)).Queries("api", "import").Methods("POST")
+	app.Router.HandleFunc("/subscribe", app.wsMulti).Queries("keys", "{keys}").Methods("GET")
 	// https://www.calhoun.io/why-cant-i-pass-this-function-as-an-http-handler/
-	app.Router.Handle("/{key:[a-zA-Z\\*\\d\\/]+}", http.TimeoutHandler(
-		http.HandlerFunc(app.unpublish), app.Deadline, deadlineMsg)).Methods("DELETE")
-	app.Router.Handle("/{key:[a-zA-Z\\*\\d\\/]+}", http.TimeoutHandler(
-		http.HandlerFunc(app.publish), app.Deadline, deadlineMsg)).Methods("POST")
-	app.Router.Handle("/{key:[a-zA-Z\\*\\d\\/]+}", http.TimeoutHandler(
-		http.HandlerFunc(app.republish), app.Deadline, deadlineMsg)).Methods("PUT")
-	app.Router.Handle("/{key:[a-zA-Z\\*\\d\\/]+}", http.TimeoutHandler(
-		http.HandlerFunc(app.patch), app.Deadline, deadlineMsg)).Methods("PATCH")
-	app.Router.HandleFunc("/{key:[a-zA-Z\\*\\d\\/]+}", app.read).Methods("GET")
-	app.Router.HandleFunc("/{key:[a-zA-Z\\*\\d\\/]+}", app.read).Queries("v", "{[\\d]}").Methods("GET")
+	keyRoute := "/{key:" + app.KeyPattern + "}"
+	app.Router.Handle(keyRoute, app.timeout(app.unpublish)).Methods("DELETE")
+	app.Router.Handle(keyRoute, app.timeout(app.publish)).Methods("POST")
+	app.Router.Handle(keyRoute, app.timeout(app.republish)).Methods("PUT")
+	app.Router.Handle(keyRoute, app.timeout(app.patch)).Methods("PATCH")
+	app.Router.HandleFunc(keyRoute, app.read).Methods("GET")
+	app.Router.HandleFunc(keyRoute, app.read).Queries("v", "{[\\d]}").Methods("GET")
+	app.Router.HandleFunc(keyRoute, app.read).Methods("HEAD")
+	app.Router.HandleFunc(keyRoute, app.options).Methods("OPTIONS")
+	if app.KeyCaseInsensitive || app.TrailingSlash != Strict {
+		app.Router.Use(app.keyPolicy)
+	}
 	app.wg.Add(1)
 	go app.waitListen()
 	app.wg.Wait()
 	app.waitStart()
 	app.Console = coat.NewConsole(app.Address, app.Silence)
-	go app.tick()
+	app.warmCaches(app.warmPaths())
+	if app.Tick > 0 {
+		go app.tick()
+	}
 }
 
 // Close : shutdown the http server and database connection
@@ -362,24 +703,39 @@ func (app *Server) Close(sig os.Signal) {
 	if atomic.LoadInt64(&app.closing) != 1 {
 		atomic.StoreInt64(&app.closing, 1)
 		atomic.StoreInt64(&app.active, 0)
+		if app.ReadStorage != nil {
+			app.ReadStorage.Close()
+		}
 		app.Storage.Close()
 		app.OnClose()
 		app.Console.Err("shutdown", sig)
 		if app.server != nil {
 			app.server.Shutdown(context.Background())
 		}
+		app.closeAdmin()
 	}
 }
 
-// WaitClose : Blocks waiting for SIGINT, SIGTERM, SIGKILL, SIGHUP
+// WaitClose : Blocks waiting for SIGINT, SIGTERM, SIGKILL, SIGHUP, with OnReload
+// defined SIGHUP calls it and keeps waiting
 func (app *Server) WaitClose() {
-	app.Signal = make(chan os.Signal, 1)
+	if app.Signal == nil {
+		app.Signal = make(chan os.Signal, 1)
+	}
 	done := make(chan bool, 1)
 	signal.Notify(app.Signal, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(app.Signal)
 	go func() {
-		sig := <-app.Signal
-		app.Close(sig)
-		done <- true
+		for sig := range app.Signal {
+			if sig == syscall.SIGHUP && app.OnReload != nil {
+				app.Console.Log("reload")
+				app.OnReload()
+				continue
+			}
+			app.Close(sig)
+			done <- true
+			return
+		}
 	}()
 	<-done
 }
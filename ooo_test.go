@@ -1,16 +1,30 @@
 package ooo
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/goccy/go-json"
+	"github.com/tidwall/gjson"
 
+	"github.com/benitogf/ooo/messages"
+	"github.com/benitogf/ooo/meta"
+	"github.com/benitogf/ooo/stream"
 	"github.com/gorilla/websocket"
+	"github.com/rs/cors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -156,6 +170,141 @@ func TestInvalidKey(t *testing.T) {
 	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
 }
 
+func TestSubscribeNoPatch(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test/*"}
+	patchClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer patchClient.Close()
+	u.RawQuery = "patch=false"
+	snapshotClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer snapshotClient.Close()
+
+	readMessage := func(c *websocket.Conn) messages.Message {
+		_, raw, err := c.ReadMessage()
+		require.NoError(t, err)
+		msg, err := messages.DecodeBuffer(raw)
+		require.NoError(t, err)
+		return msg
+	}
+
+	require.True(t, readMessage(patchClient).Snapshot)
+	require.True(t, readMessage(snapshotClient).Snapshot)
+
+	_, err = app.Storage.Set("test/1", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+
+	patchMsg := readMessage(patchClient)
+	snapshotMsg := readMessage(snapshotClient)
+	require.False(t, patchMsg.Snapshot)
+	require.True(t, snapshotMsg.Snapshot)
+	require.Equal(t, patchMsg.Version, snapshotMsg.Version)
+	objs, err := meta.DecodeList(snapshotMsg.Data)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, `{"name":"one"}`, string(objs[0].Data))
+}
+
+func TestAuthorizeRead(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.Principal = func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	}
+	app.AuthorizeRead = func(principal, key string, obj meta.Object) bool {
+		return gjson.GetBytes(obj.Data, "owner").String() == principal
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/docs/*"}
+	subscribe := func(principal string) *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"X-User": {principal}})
+		require.NoError(t, err)
+		return c
+	}
+	read := func(c *websocket.Conn, cache json.RawMessage) (json.RawMessage, []meta.Object) {
+		_, raw, err := c.ReadMessage()
+		require.NoError(t, err)
+		cache, objs, err := messages.PatchList(raw, cache)
+		require.NoError(t, err)
+		return cache, objs
+	}
+
+	alice := subscribe("alice")
+	defer alice.Close()
+	bob := subscribe("bob")
+	defer bob.Close()
+	aliceCache, aliceDocs := read(alice, nil)
+	bobCache, bobDocs := read(bob, nil)
+	require.Equal(t, 0, len(aliceDocs))
+	require.Equal(t, 0, len(bobDocs))
+
+	_, err := app.Storage.Set("docs/1", json.RawMessage(`{"owner":"alice"}`))
+	require.NoError(t, err)
+	aliceCache, aliceDocs = read(alice, aliceCache)
+	bobCache, bobDocs = read(bob, bobCache)
+	require.Equal(t, 1, len(aliceDocs))
+	require.Equal(t, "docs/1", aliceDocs[0].Path)
+	require.Equal(t, 0, len(bobDocs))
+
+	_, err = app.Storage.Set("docs/2", json.RawMessage(`{"owner":"bob"}`))
+	require.NoError(t, err)
+	_, aliceDocs = read(alice, aliceCache)
+	_, bobDocs = read(bob, bobCache)
+	require.Equal(t, 1, len(aliceDocs))
+	require.Equal(t, "docs/1", aliceDocs[0].Path)
+	require.Equal(t, 1, len(bobDocs))
+	require.Equal(t, "docs/2", bobDocs[0].Path)
+
+	req := httptest.NewRequest("GET", "/docs/*", nil)
+	req.Header.Set("X-User", "bob")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	objs, err := meta.DecodeList(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, "docs/2", objs[0].Path)
+
+	req = httptest.NewRequest("GET", "/docs/1", nil)
+	req.Header.Set("X-User", "bob")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestDeadlinePerPath(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Deadline = 50 * time.Millisecond
+	slowFilter := func(key string, data json.RawMessage) (json.RawMessage, error) {
+		time.Sleep(100 * time.Millisecond)
+		return data, nil
+	}
+	app.WriteFilter("slow/*", slowFilter)
+	app.WriteFilter("fast", slowFilter)
+	app.SetDeadline("slow/*", time.Second)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("POST", "/slow/1", bytes.NewBuffer([]byte(`{"data":"test"}`)))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "/fast", bytes.NewBuffer([]byte(`{"data":"test"}`)))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+}
+
 // TODO: find a way to test this
 // func TestDeadline(t *testing.T) {
 // 	if runtime.GOOS == "windows" {
@@ -176,3 +325,884 @@ func TestInvalidKey(t *testing.T) {
 // 	resp := w.Result()
 // 	require.Equal(t, 503, resp.StatusCode)
 // }
+
+func TestStreamMaxMessageBytes(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Stream.MaxMessageBytes = 256
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	readMessage := func() messages.Message {
+		_, raw, err := c.ReadMessage()
+		require.NoError(t, err)
+		msg, err := messages.DecodeBuffer(raw)
+		require.NoError(t, err)
+		return msg
+	}
+
+	msg := readMessage()
+	require.True(t, msg.Snapshot)
+	require.False(t, msg.Oversized)
+
+	_, err = app.Storage.Set("test", json.RawMessage(`{"name":"small"}`))
+	require.NoError(t, err)
+	msg = readMessage()
+	require.False(t, msg.Oversized)
+	cache, err := messages.PatchCache([]byte(`{"snapshot":true,"version":"1","data":{}}`), nil)
+	require.NoError(t, err)
+	_, err = app.Storage.Set("test", json.RawMessage(`{"name":"`+strings.Repeat("a", 512)+`"}`))
+	require.NoError(t, err)
+	msg = readMessage()
+	require.True(t, msg.Oversized)
+	require.True(t, msg.Snapshot)
+	require.NotEmpty(t, msg.Version)
+	require.Equal(t, "null", string(msg.Data))
+	raw, err := json.Marshal(msg)
+	require.NoError(t, err)
+	_, err = messages.PatchCache(raw, cache)
+	require.ErrorIs(t, err, messages.ErrOversized)
+
+	// incoming frames over the limit close the connection
+	err = c.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", 512)))
+	require.NoError(t, err)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.Error(t, err)
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseMessageTooBig, closeErr.Code)
+}
+
+func TestRequestID(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	readMessage := func() messages.Message {
+		_, raw, err := c.ReadMessage()
+		require.NoError(t, err)
+		msg, err := messages.DecodeBuffer(raw)
+		require.NoError(t, err)
+		return msg
+	}
+	write := func(requestID string, data string) string {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer([]byte(data)))
+		if requestID != "" {
+			req.Header.Set("X-Request-Id", requestID)
+		}
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		return w.Result().Header.Get("X-Request-Id")
+	}
+
+	msg := readMessage()
+	require.Equal(t, "", msg.RequestID)
+
+	require.Equal(t, "client-1", write("client-1", `{"name":"one"}`))
+	msg = readMessage()
+	require.Equal(t, "client-1", msg.RequestID)
+
+	generated := write("", `{"name":"two"}`)
+	require.NotEmpty(t, generated)
+	msg = readMessage()
+	require.Equal(t, generated, msg.RequestID)
+
+	// invalid ids are replaced
+	generated = write(`"}`, `{"name":"three"}`)
+	require.NotEqual(t, `"}`, generated)
+	msg = readMessage()
+	require.Equal(t, generated, msg.RequestID)
+
+	// writes that don't come from a request have no id
+	_, err = app.Storage.Set("test", json.RawMessage(`{"name":"four"}`))
+	require.NoError(t, err)
+	msg = readMessage()
+	require.Equal(t, "", msg.RequestID)
+}
+
+func TestRequestIDConcurrent(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.NoBroadcastKeys = []string{"quiet"}
+	events := make(chan string, 100)
+	app.OnEvent("race", func(event StorageEvent) {
+		events <- event.RequestID
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	write := func(method, path, requestID string) {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(`{"name":"`+requestID+`"}`)))
+		req.Header.Set("X-Request-Id", requestID)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+	}
+
+	// every event of concurrent writes to a key has the id of its own write
+	const writes = 20
+	done := make(chan struct{})
+	for i := 0; i < writes; i++ {
+		go func(i int) {
+			write("POST", "/race", "write-"+strconv.Itoa(i))
+			done <- struct{}{}
+		}(i)
+	}
+	for i := 0; i < writes; i++ {
+		<-done
+	}
+	app.Sync()
+	seen := map[string]bool{}
+	for i := 0; i < writes; i++ {
+		requestID := <-events
+		require.NotEmpty(t, requestID)
+		require.False(t, seen[requestID], requestID)
+		seen[requestID] = true
+	}
+
+	// writes without an event don't keep their id
+	write("POST", "/quiet", "quiet-1")
+	write("POST", "/list/1", "item-1")
+	write("PATCH", "/list/*", "patch-1")
+	app.Sync()
+	for _, _key := range []string{"quiet", "list/*"} {
+		_, found := app.requestIDs.Load(_key)
+		require.False(t, found, _key)
+	}
+}
+
+func TestVersionFromUpdated(t *testing.T) {
+	storage := &MemoryStorage{}
+	version := func(app *Server) string {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		require.NoError(t, err)
+		defer c.Close()
+		_, raw, err := c.ReadMessage()
+		require.NoError(t, err)
+		msg, err := messages.DecodeBuffer(raw)
+		require.NoError(t, err)
+		return msg.Version
+	}
+
+	app := Server{}
+	app.Silence = true
+	app.Storage = storage
+	app.VersionFrom = UpdatedBased
+	app.Start("localhost:0")
+	_, err := app.Storage.Set("test", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+	first := version(&app)
+	app.Close(os.Interrupt)
+
+	// restart with the same storage
+	restarted := Server{}
+	restarted.Silence = true
+	restarted.Storage = storage
+	restarted.VersionFrom = UpdatedBased
+	restarted.Start("localhost:0")
+	defer restarted.Close(os.Interrupt)
+	require.Equal(t, first, version(&restarted))
+
+	_, err = restarted.Storage.Set("test", json.RawMessage(`{"name":"two"}`))
+	require.NoError(t, err)
+	require.NotEqual(t, first, version(&restarted))
+}
+
+func TestStreamSendReady(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Stream.SendReady = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, raw, err := c.ReadMessage()
+	require.NoError(t, err)
+	require.True(t, messages.IsReady(raw))
+	require.Equal(t, "", gjson.GetBytes(raw, "data").Raw)
+
+	_, raw, err = c.ReadMessage()
+	require.NoError(t, err)
+	require.False(t, messages.IsReady(raw))
+	msg, err := messages.DecodeBuffer(raw)
+	require.NoError(t, err)
+	require.True(t, msg.Snapshot)
+}
+
+func TestStreamTombstones(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Stream.Tombstones = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("test/a", json.RawMessage(`{"name":"a"}`))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("test/b", json.RawMessage(`{"name":"b"}`))
+	require.NoError(t, err)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test/*"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, raw, err := c.ReadMessage()
+	require.NoError(t, err)
+	cache, err := messages.PatchCache(raw, []byte{})
+	require.NoError(t, err)
+
+	err = app.Storage.Del("test/a")
+	require.NoError(t, err)
+
+	_, raw, err = c.ReadMessage()
+	require.NoError(t, err)
+	msg, err := messages.DecodeBuffer(raw)
+	require.NoError(t, err)
+	require.Equal(t, []string{"test/a"}, msg.Removed)
+
+	cache, err = messages.PatchCache(raw, cache)
+	require.NoError(t, err)
+	objs, err := meta.DecodeList(cache)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, "test/b", objs[0].Path)
+}
+
+func TestStorageFactory(t *testing.T) {
+	built := 0
+	app := Server{}
+	app.Silence = true
+	app.NoBroadcastKeys = []string{"quiet"}
+	app.StorageFactory = func() Database {
+		built++
+		return &MemoryStorage{}
+	}
+	app.Start("localhost:0")
+	require.Equal(t, 1, built)
+	_, err := app.Storage.Set("test", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+	first := app.Storage
+	app.Close(os.Interrupt)
+
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	require.Equal(t, 2, built)
+	require.NotSame(t, first, app.Storage)
+	require.True(t, app.Storage.Active())
+	_, err = app.Storage.Get("test")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/quiet"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	// no broadcast keys are passed to the new storage
+	_, err = app.Storage.Set("quiet", json.RawMessage(`{"name":"quiet"}`))
+	require.NoError(t, err)
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = c.ReadMessage()
+	require.Error(t, err)
+}
+
+func TestSubscribeCtx(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Principal = func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	}
+	subscribed := make(chan stream.Subscriber, 1)
+	unsubscribed := make(chan stream.Subscriber, 1)
+	app.OnSubscribeCtx = func(key string, subscriber stream.Subscriber) error {
+		require.Equal(t, "test", key)
+		subscribed <- subscriber
+		return nil
+	}
+	app.OnUnsubscribeCtx = func(key string, subscriber stream.Subscriber) {
+		require.Equal(t, "test", key)
+		unsubscribed <- subscriber
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"X-User": []string{"alice"}})
+	require.NoError(t, err)
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	subscriber := <-subscribed
+	require.Equal(t, "alice", subscriber.Principal)
+	require.Equal(t, c.LocalAddr().String(), subscriber.RemoteAddr)
+
+	c.Close()
+	select {
+	case unsubscriber := <-unsubscribed:
+		require.Equal(t, subscriber, unsubscriber)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the unsubscribe event")
+	}
+}
+
+func TestDisableCORS(t *testing.T) {
+	preflight := func(app *Server) *http.Response {
+		req, err := http.NewRequest("OPTIONS", "http://"+app.Address+"/test", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", "http://example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	get := func(app *Server) *http.Response {
+		req, err := http.NewRequest("GET", "http://"+app.Address+"/", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", "http://example.com")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	resp := preflight(&app)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	resp = get(&app)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	noCORS := Server{}
+	noCORS.Silence = true
+	noCORS.DisableCORS = true
+	noCORS.Start("localhost:0")
+	defer noCORS.Close(os.Interrupt)
+	// the preflight reaches the router options handler
+	resp = preflight(&noCORS)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("Allow"))
+	require.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+	resp = get(&noCORS)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSPolicy(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.CORS("admin/*", cors.Options{
+		AllowedOrigins: []string{"http://admin.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	request := func(method string, path string, origin string) *http.Response {
+		req, err := http.NewRequest(method, "http://"+app.Address+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// the admin path is restricted to one origin
+	resp := request("OPTIONS", "/admin/users", "http://admin.example.com")
+	require.Equal(t, "http://admin.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	resp = request("OPTIONS", "/admin/users", "http://example.com")
+	require.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+	resp = request("GET", "/admin/users", "http://example.com")
+	require.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	// public paths use the global policy
+	resp = request("OPTIONS", "/books/1", "http://example.com")
+	require.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	resp = request("GET", "/books/1", "http://example.com")
+	require.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestSync(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test/*"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, raw, err := c.ReadMessage()
+	require.NoError(t, err)
+	cache, err := messages.PatchCache(raw, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = app.Storage.Set("test/"+strconv.Itoa(i), json.RawMessage(`{"name":"`+strconv.Itoa(i)+`"}`))
+		require.NoError(t, err)
+	}
+	app.Sync()
+	app.Stream.Flush("test/*")
+
+	// all the broadcasts are written, reading them doesn't wait
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for i := 0; i < 10; i++ {
+		_, raw, err = c.ReadMessage()
+		require.NoError(t, err)
+		cache, err = messages.PatchCache(raw, cache)
+		require.NoError(t, err)
+	}
+	objs, err := meta.DecodeList(cache)
+	require.NoError(t, err)
+	require.Equal(t, 10, len(objs))
+
+	// sync without pending events returns
+	app.Sync()
+}
+
+func TestOnEvent(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	orders := make(chan StorageEvent, 10)
+	all := make(chan StorageEvent, 10)
+	app.OnEvent("orders/*", func(event StorageEvent) {
+		orders <- event
+	})
+	app.OnEvent("*", func(event StorageEvent) {
+		all <- event
+	})
+	app.OnEvent("orders/*", func(event StorageEvent) {
+		all <- event
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("users/1", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("orders/1", json.RawMessage(`{"total":1}`))
+	require.NoError(t, err)
+	err = app.Storage.Del("orders/1")
+	require.NoError(t, err)
+	app.Sync()
+
+	require.Equal(t, 2, len(orders))
+	// the workers can call the callbacks in any order
+	require.ElementsMatch(t, []StorageEvent{
+		{Key: "orders/1", Operation: "set", Created: true},
+		{Key: "orders/1", Operation: "del"},
+	}, []StorageEvent{<-orders, <-orders})
+	// overlapping patterns all fire, "*" doesn't match the multi level keys
+	require.Equal(t, 2, len(all))
+}
+
+func TestStorageEventCreated(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	events := make(chan StorageEvent, 10)
+	app.OnEvent("*", func(event StorageEvent) {
+		events <- event
+	})
+	app.OnEvent("things/*", func(event StorageEvent) {
+		events <- event
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("test", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+	app.Sync()
+	require.Equal(t, StorageEvent{Key: "test", Operation: "set", Created: true}, <-events)
+
+	_, err = app.Storage.Set("test", json.RawMessage(`{"name":"two"}`))
+	require.NoError(t, err)
+	app.Sync()
+	require.Equal(t, StorageEvent{Key: "test", Operation: "set", Created: false}, <-events)
+
+	// push to a list
+	req := httptest.NewRequest("POST", "/things/*", bytes.NewBuffer([]byte(`{"name":"one"}`)))
+	req.Header.Set("X-Request-Id", "push-1")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	index := gjson.Get(w.Body.String(), "index").String()
+	app.Sync()
+	require.Equal(t, StorageEvent{Key: "things/" + index, Operation: "set", Created: true, RequestID: "push-1"}, <-events)
+
+	req = httptest.NewRequest("POST", "/things/"+index, bytes.NewBuffer([]byte(`{"name":"two"}`)))
+	req.Header.Set("X-Request-Id", "update-1")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	app.Sync()
+	require.Equal(t, StorageEvent{Key: "things/" + index, Operation: "set", Created: false, RequestID: "update-1"}, <-events)
+}
+
+func TestMeter(t *testing.T) {
+	type usage struct {
+		principal string
+		in        int64
+		out       int64
+	}
+	meters := make(chan usage, 10)
+	app := Server{}
+	app.Silence = true
+	app.Principal = func(r *http.Request) string {
+		return r.Header.Get("X-Tenant")
+	}
+	app.Meter = func(principal string, bytesIn, bytesOut int64) {
+		meters <- usage{principal, bytesIn, bytesOut}
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	request := func(method string, body string) []byte {
+		req, err := http.NewRequest(method, "http://"+app.Address+"/test", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		response, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return response
+	}
+
+	body := `{"name":"one"}`
+	response := request("POST", body)
+	require.Equal(t, usage{"acme", int64(len(body)), int64(len(response))}, <-meters)
+	response = request("GET", "")
+	require.Equal(t, usage{"acme", 0, int64(len(response))}, <-meters)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"X-Tenant": {"acme"}})
+	require.NoError(t, err)
+	_, snapshot, err := c.ReadMessage()
+	require.NoError(t, err)
+	_, err = app.Storage.Set("test", json.RawMessage(`{"name":"two"}`))
+	require.NoError(t, err)
+	_, broadcast, err := c.ReadMessage()
+	require.NoError(t, err)
+	c.Close()
+
+	select {
+	case subscription := <-meters:
+		require.Equal(t, usage{"acme", 0, int64(len(snapshot) + len(broadcast))}, subscription)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the subscription meter")
+	}
+}
+
+func TestClockInterval(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Tick = 50 * time.Millisecond
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	ticks := func(query string, duration time.Duration) []int64 {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: "/", RawQuery: query}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		require.NoError(t, err)
+		defer c.Close()
+		received := []int64{}
+		deadline := time.Now().Add(duration)
+		c.SetReadDeadline(deadline)
+		for time.Now().Before(deadline) {
+			_, raw, err := c.ReadMessage()
+			if err != nil {
+				break
+			}
+			tick, err := strconv.ParseInt(string(raw), 10, 64)
+			require.NoError(t, err)
+			received = append(received, tick)
+		}
+		return received
+	}
+
+	var coarse []int64
+	done := make(chan struct{})
+	go func() {
+		coarse = ticks("tick=250ms", 800*time.Millisecond)
+		close(done)
+	}()
+	every := ticks("", 800*time.Millisecond)
+	<-done
+
+	require.GreaterOrEqual(t, len(every), 10)
+	require.GreaterOrEqual(t, len(coarse), 3)
+	require.LessOrEqual(t, len(coarse), 5)
+	for i := 1; i < len(coarse); i++ {
+		require.GreaterOrEqual(t, time.Duration(coarse[i]-coarse[i-1]), 240*time.Millisecond)
+	}
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/", RawQuery: "tick=soon"}
+	_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestClockOnDemand(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Tick = -1
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+	c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, _, err = c.ReadMessage()
+	require.Error(t, err)
+}
+
+func TestReloadSignal(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	var reloads atomic.Int64
+	app.OnReload = func() {
+		reloads.Add(1)
+		app.ReloadFilters(func(server *Server) {
+			server.OpenFilter("test")
+		})
+	}
+	app.Signal = make(chan os.Signal, 1)
+	app.Start("localhost:0")
+	closed := make(chan struct{})
+	go func() {
+		app.WaitClose()
+		close(closed)
+	}()
+
+	app.Signal <- syscall.SIGHUP
+	require.Eventually(t, func() bool { return reloads.Load() == 1 }, time.Second, time.Millisecond)
+	require.True(t, app.Active())
+
+	app.Signal <- syscall.SIGTERM
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		require.Fail(t, "server not closed")
+	}
+	require.False(t, app.Active())
+}
+
+func TestMaxConnections(t *testing.T) {
+	var controlled atomic.Int64
+	app := Server{}
+	app.Silence = true
+	app.MaxConnections = 2
+	app.ListenConfig.Control = func(network, address string, c syscall.RawConn) error {
+		controlled.Add(1)
+		return nil
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	require.Equal(t, int64(1), controlled.Load())
+
+	get := func(conn net.Conn, wait time.Duration) (*http.Response, error) {
+		_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + app.Address + "\r\n\r\n"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(wait))
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+
+	// keep-alive connections under the limit are served
+	open := []net.Conn{}
+	for i := 0; i < app.MaxConnections; i++ {
+		conn, err := net.Dial("tcp", app.Address)
+		require.NoError(t, err)
+		defer conn.Close()
+		res, err := get(conn, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		open = append(open, conn)
+	}
+
+	// over the limit the connection waits
+	extra, err := net.Dial("tcp", app.Address)
+	require.NoError(t, err)
+	defer extra.Close()
+	_, err = extra.Write([]byte("GET / HTTP/1.1\r\nHost: " + app.Address + "\r\n\r\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(extra)
+	extra.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = http.ReadResponse(reader, nil)
+	require.Error(t, err)
+
+	// and it's accepted once another closes
+	open[0].Close()
+	extra.SetReadDeadline(time.Now().Add(time.Second))
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestWatchRecover(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Workers = 1
+	app.OnEvent("boom", func(event StorageEvent) {
+		panic("callback failed")
+	})
+	events := make(chan StorageEvent, 10)
+	app.OnEvent("after", func(event StorageEvent) {
+		events <- event
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	logged := make(chan string, 10)
+	app.Console.Err = func(v ...interface{}) {
+		logged <- fmt.Sprint(v...)
+	}
+	updates := make(chan string, 10)
+	detach := app.Stream.Attach("after", func(snapshot []byte, version int64) {}, func(data []byte, snapshot bool, version int64) {
+		updates <- string(data)
+	})
+	defer detach()
+
+	_, err := app.Storage.Set("boom", json.RawMessage(`{"name":"boom"}`))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("after", json.RawMessage(`{"name":"after"}`))
+	require.NoError(t, err)
+	app.Sync()
+
+	require.Contains(t, <-logged, "callback failed")
+	require.Equal(t, "after", (<-events).Key)
+	require.Equal(t, "after", gjson.Get(<-updates, "data.name").String())
+}
+
+func TestStartAdmin(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	err := app.StartAdmin("localhost:0")
+	require.NoError(t, err)
+	require.Error(t, app.StartAdmin("localhost:0"))
+	require.NotEqual(t, app.Address, app.AdminAddress)
+
+	admin := "http://" + app.AdminAddress
+	public := "http://" + app.Address
+	request := func(method, url, body string) (int, string) {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(data)
+	}
+
+	// the main listener serves data
+	status, _ := request("POST", public+"/test", `{"test":"something"}`)
+	require.Equal(t, http.StatusOK, status)
+	status, body := request("GET", public+"/test", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "something", gjson.Get(body, "data.test").String())
+
+	// but not the admin endpoints
+	for _, path := range []string{"/", "/?api=openapi", "/?api=pool&key=test", "/?api=subscriptions", "/health"} {
+		status, _ = request("GET", public+path, "")
+		require.Equal(t, http.StatusNotFound, status, path)
+	}
+	status, _ = request("POST", public+"/?api=import", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// the admin listener serves the stats and api endpoints of the same storage
+	status, body = request("GET", admin+"/", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, `{"keys":["test"]}`, body)
+	status, body = request("GET", admin+"/?api=openapi", "")
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, gjson.Get(body, "openapi").Exists())
+	status, body = request("GET", admin+"/health", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "ok", gjson.Get(body, "status").String())
+
+	// and refuses the data routes
+	status, _ = request("POST", admin+"/test", `{"test":"something"}`)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = request("GET", admin+"/test", "")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = request("DELETE", admin+"/test", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestIsEmptyObject(t *testing.T) {
+	require.True(t, isEmptyObject(meta.EmptyObject))
+	require.True(t, isEmptyObject([]byte(`{"updated":0,"created":0,"data":{},"index":""}`)))
+	require.False(t, isEmptyObject([]byte(`{"created":1,"updated":0,"index":"a","data":{}}`)))
+	require.False(t, isEmptyObject([]byte(`{"created":0,"updated":0,"index":"","data":{}}`+strings.Repeat(" ", 4*len(meta.EmptyObject)))))
+}
+
+func TestImportBroadcast(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	var item, list, other atomic.Int32
+	attach := func(key string, count *atomic.Int32) func() {
+		return app.Stream.Attach(key, func(snapshot []byte, version int64) {}, func(data []byte, snapshot bool, version int64) {
+			count.Add(1)
+		})
+	}
+	defer attach("devices/a", &item)()
+	defer attach("devices/*", &list)()
+	defer attach("other", &other)()
+
+	// writes outside of the import are broadcasted while it runs
+	app.importing.Store("import-1", struct{}{})
+	_, err := app.Storage.Set("other", json.RawMessage(`{"on":true}`))
+	require.NoError(t, err)
+	app.Sync()
+	require.Equal(t, int32(1), other.Load())
+	app.importing.Delete("import-1")
+
+	body := strings.Join([]string{
+		`{"created":100,"updated":200,"path":"devices/a","data":{"name":"a"}}`,
+		`{"created":300,"updated":0,"path":"devices/b","data":{"name":"b"}}`,
+	}, "\n")
+	req := httptest.NewRequest(http.MethodPost, "/?api=import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	app.Sync()
+	require.Equal(t, int32(1), item.Load())
+	require.Equal(t, int32(1), list.Load())
+	require.Equal(t, int32(1), other.Load())
+}
@@ -0,0 +1,188 @@
+package ooo
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/gorilla/mux"
+)
+
+// OpenAPIVersion of the document served at ?api=openapi
+const OpenAPIVersion = "3.0.3"
+
+var routeParam = regexp.MustCompile(`\{([^}:]*)(:[^}]*)?\}`)
+
+type openAPIParameter struct {
+	Name     string                 `json:"name"`
+	In       string                 `json:"in"`
+	Required bool                   `json:"required"`
+	Schema   map[string]interface{} `json:"schema"`
+}
+
+type openAPIOperation struct {
+	Summary     string                            `json:"summary,omitempty"`
+	Parameters  []openAPIParameter                `json:"parameters,omitempty"`
+	RequestBody map[string]interface{}            `json:"requestBody,omitempty"`
+	Responses   map[string]map[string]interface{} `json:"responses"`
+}
+
+// OpenAPI minimal description of the api
+type OpenAPI struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       map[string]string                       `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components map[string]interface{}                  `json:"components"`
+}
+
+var openAPIObject = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"created": map[string]string{"type": "integer"},
+		"updated": map[string]string{"type": "integer"},
+		"index":   map[string]string{"type": "string"},
+		"path":    map[string]string{"type": "string"},
+		"data":    map[string]string{"type": "object"},
+	},
+}
+
+func openAPIResponse(description string, schema map[string]interface{}) map[string]interface{} {
+	response := map[string]interface{}{"description": description}
+	if schema != nil {
+		response["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+	}
+
+	return response
+}
+
+func openAPIRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// openAPIPath converts a filter path to an openapi path, the globs
+// are parameters named index (index2, index3... for several)
+func openAPIPath(path string) (string, []openAPIParameter) {
+	parts := strings.Split(path, "/")
+	params := []openAPIParameter{}
+	for i, part := range parts {
+		if part != "*" {
+			continue
+		}
+		name := "index"
+		if len(params) > 0 {
+			name += strconv.Itoa(len(params) + 1)
+		}
+		parts[i] = "{" + name + "}"
+		params = append(params, openAPIParameter{Name: name, In: "path", Required: true, Schema: map[string]interface{}{"type": "string"}})
+	}
+
+	return "/" + strings.Join(parts, "/"), params
+}
+
+// OpenAPI builds the description of the key routes defined by the filters
+// (a glob path describes the list and its items) and the custom routes
+func (app *Server) OpenAPI() OpenAPI {
+	doc := OpenAPI{
+		OpenAPI: OpenAPIVersion,
+		Info:    map[string]string{"title": "ooo", "version": "1.0.0"},
+		Paths:   map[string]map[string]*openAPIOperation{},
+		Components: map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Object":  openAPIObject,
+				"Objects": map[string]interface{}{"type": "array", "items": openAPIRef("Object")},
+				"Index":   map[string]interface{}{"type": "object", "properties": map[string]interface{}{"index": map[string]string{"type": "string"}}},
+			},
+		},
+	}
+	add := func(path string, method string, operation *openAPIOperation) {
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*openAPIOperation{}
+		}
+		if doc.Paths[path][method] == nil {
+			doc.Paths[path][method] = operation
+		}
+	}
+	body := map[string]interface{}{
+		"required": true,
+		"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]string{"type": "object"}}},
+	}
+	write := func(summary string) *openAPIOperation {
+		return &openAPIOperation{
+			Summary:     summary,
+			RequestBody: body,
+			Responses:   map[string]map[string]interface{}{"200": openAPIResponse("stored", openAPIRef("Index"))},
+		}
+	}
+
+	set := app.filterSet()
+	for _, filter := range set.Read {
+		item, params := openAPIPath(filter.path)
+		add(item, "get", &openAPIOperation{Summary: "read", Parameters: params,
+			Responses: map[string]map[string]interface{}{"200": openAPIResponse("object", openAPIRef("Object"))}})
+		if len(params) > 0 {
+			add("/"+filter.path, "get", &openAPIOperation{Summary: "read list",
+				Responses: map[string]map[string]interface{}{"200": openAPIResponse("list", openAPIRef("Objects"))}})
+		}
+	}
+	for _, filter := range set.Write {
+		item, params := openAPIPath(filter.path)
+		for _, method := range []string{"post", "put", "patch"} {
+			operation := write(method)
+			operation.Parameters = params
+			add(item, method, operation)
+		}
+		if len(params) > 0 {
+			add("/"+filter.path, "post", write("create"))
+		}
+	}
+	for _, filter := range set.WriteMethod {
+		item, params := openAPIPath(filter.path)
+		operation := write(strings.ToLower(filter.method))
+		operation.Parameters = params
+		add(item, strings.ToLower(filter.method), operation)
+		if len(params) > 0 && filter.method == http.MethodPost {
+			add("/"+filter.path, "post", write("create"))
+		}
+	}
+	for _, hook := range set.Delete {
+		item, params := openAPIPath(hook.path)
+		add(item, "delete", &openAPIOperation{Summary: "delete", Parameters: params,
+			Responses: map[string]map[string]interface{}{"204": openAPIResponse("deleted", nil)}})
+	}
+
+	if app.Router == nil {
+		return doc
+	}
+	app.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || strings.Contains(template, "{key:") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		params := []openAPIParameter{}
+		for _, match := range routeParam.FindAllStringSubmatch(template, -1) {
+			params = append(params, openAPIParameter{Name: match[1], In: "path", Required: true, Schema: map[string]interface{}{"type": "string"}})
+		}
+		path := routeParam.ReplaceAllString(template, "{$1}")
+		for _, method := range methods {
+			if method == http.MethodOptions || method == http.MethodHead {
+				continue
+			}
+			add(path, strings.ToLower(method), &openAPIOperation{Parameters: params,
+				Responses: map[string]map[string]interface{}{"200": openAPIResponse("ok", nil)}})
+		}
+		return nil
+	})
+
+	return doc
+}
+
+func (app *Server) getOpenAPI(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.OpenAPI())
+}
@@ -0,0 +1,135 @@
+package ooo
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/benitogf/ooo/meta"
+)
+
+// ErrInvalidCursor the cursor or limit of a page request can't be parsed
+var ErrInvalidCursor = errors.New("ooo: invalid cursor")
+
+// cursor position of an object in a list ordered by created time (ties by path)
+type cursor struct {
+	created int64
+	path    string
+}
+
+func (c cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.created, 10) + ":" + c.path))
+}
+
+// before the object comes after the cursor, a cursor without
+// path (a plain created time) skips every object of that time
+func (c cursor) before(obj meta.Object) bool {
+	if c.path == "" {
+		return obj.Created > c.created
+	}
+	return obj.Created > c.created || (obj.Created == c.created && obj.Path > c.path)
+}
+
+// parseCursor decodes a cursor, a plain created time is accepted as well
+func parseCursor(raw string) (cursor, error) {
+	created, err := strconv.ParseInt(raw, 10, 64)
+	if err == nil {
+		return cursor{created: created}, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+	createdPart, path, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return cursor{}, ErrInvalidCursor
+	}
+	created, err = strconv.ParseInt(createdPart, 10, 64)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return cursor{created: created, path: path}, nil
+}
+
+// isPage the request reads a page of a list
+func isPage(r *http.Request, _key string) bool {
+	return strings.Contains(_key, "*") && (r.URL.Query().Has("after") || r.URL.Query().Has("limit"))
+}
+
+// readPage writes the objects of a list created after the cursor (?after=), up
+// to the limit (?limit=), the cursor of the next page is in the X-Next-Cursor header
+func (app *Server) readPage(w http.ResponseWriter, r *http.Request, _key string) {
+	after := cursor{}
+	hasAfter := r.URL.Query().Has("after")
+	var err error
+	if hasAfter {
+		after, err = parseCursor(r.URL.Query().Get("after"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+	}
+	limit := 0
+	if r.URL.Query().Has("limit") {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", ErrInvalidCursor)
+			return
+		}
+	}
+
+	err = app.filterSet().Read.checkStatic(_key, app.Static)
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	data, err := app.getFilteredData(_key)
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	if app.AuthorizeRead != nil {
+		data = app.Stream.Authorized(app.Principal(r), _key, data)
+	}
+	objects, err := meta.DecodeList(data)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	sort.SliceStable(objects, func(i, j int) bool {
+		if objects[i].Created != objects[j].Created {
+			return objects[i].Created < objects[j].Created
+		}
+		return objects[i].Path < objects[j].Path
+	})
+	page := []meta.Object{}
+	for _, obj := range objects {
+		if hasAfter && !after.before(obj) {
+			continue
+		}
+		if limit > 0 && len(page) == limit {
+			last := page[len(page)-1]
+			w.Header().Set("X-Next-Cursor", cursor{created: last.Created, path: last.Path}.String())
+			break
+		}
+		page = append(page, obj)
+	}
+
+	res, err := meta.Encode(page)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
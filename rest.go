@@ -1,34 +1,401 @@
 package ooo
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/goccy/go-json"
 
 	"github.com/benitogf/ooo/key"
+	"github.com/benitogf/ooo/merge"
 	"github.com/benitogf/ooo/messages"
 	"github.com/benitogf/ooo/meta"
+	"github.com/benitogf/ooo/stream"
 	"github.com/gorilla/mux"
 )
 
 var (
-	ErrNotAuthorized = errors.New("ooo: pathKeyError key is not valid")
+	ErrNotAuthorized      = errors.New("ooo: pathKeyError key is not valid")
+	ErrPreconditionFailed = errors.New("ooo: precondition failed")
+	ErrInvalidSchema      = errors.New("ooo: invalid schema version")
 )
 
+var requestIDRegex = regexp.MustCompile(`^[a-zA-Z\d\-\._:]{1,128}$`)
+
+// requestID reads the X-Request-Id header of a write request or generates one,
+// the id is echoed in the response and held for the storage event of the write,
+// the writes of a key wait for each other until the returned release is called
+// so the event of a write can't take the id of another
+func (app *Server) requestID(w http.ResponseWriter, r *http.Request, _key string) func() {
+	requestID := r.Header.Get("X-Request-Id")
+	if !requestIDRegex.MatchString(requestID) {
+		requestID = app.RequestID()
+	}
+	w.Header().Set("X-Request-Id", requestID)
+	return app.holdRequestID(_key, requestID)
+}
+
+// holdRequestID holds the id for the storage event of a write to the key
+func (app *Server) holdRequestID(_key string, requestID string) func() {
+	lock := &app.writeLocks[writeLockIndex(_key)]
+	lock.Lock()
+	app.requestIDs.Store(_key, requestID)
+	return func() {
+		// the id of a write without an event (no broadcast keys, glob patches)
+		app.requestIDs.Delete(_key)
+		lock.Unlock()
+	}
+}
+
+// writeLockCount write locks shared by the keys
+const writeLockCount = 64
+
+// writeLockIndex the write lock of a key
+func writeLockIndex(_key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(_key))
+	return int(hash.Sum32() % writeLockCount)
+}
+
+// takeRequestID the id of the request writing the key (StorageOpt.RequestID)
+func (app *Server) takeRequestID(_key string) string {
+	requestID, found := app.requestIDs.LoadAndDelete(_key)
+	if !found {
+		return ""
+	}
+	return requestID.(string)
+}
+
+// isDryRun checks if a write request should only be validated
+func isDryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dryRun") == "true"
+}
+
+// dryRunPatch writes the result of merging the filtered data with
+// the stored object without persisting it
+func (app *Server) dryRunPatch(w http.ResponseWriter, _key string, data []byte) {
+	if strings.Contains(_key, "*") {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	raw, err := app.Storage.Get(_key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	obj, err := meta.Decode(raw)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	merged, _, err := merge.MergeBytes(obj.Data, data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(merged)
+}
+
+// ErrInvalidText the body of a write to a raw path isn't UTF-8 text
+var ErrInvalidText = errors.New("ooo: raw data must be UTF-8 text")
+
+// decodeBody the JSON data of a write, the body of a raw
+// path is stored verbatim encoded as a JSON string
+func (app *Server) decodeBody(_key string, r *http.Request) (json.RawMessage, error) {
+	if !app.filterSet().Raw.match(_key) {
+		return messages.DecodeReader(r.Body)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(body) {
+		return nil, ErrInvalidText
+	}
+
+	return json.Marshal(string(body))
+}
+
+// rawData the text of an object of a raw path
+func rawData(data []byte) ([]byte, bool) {
+	obj, err := meta.Decode(data)
+	if err != nil || obj.Created == 0 {
+		return nil, false
+	}
+	var text string
+	err = json.Unmarshal(obj.Data, &text)
+	if err != nil {
+		return nil, false
+	}
+
+	return []byte(text), true
+}
+
+// upsert merges the data into the stored object, or
+// stores it as a new object if the key is not found
+func (app *Server) upsert(_key string, data []byte, version int) (string, error) {
+	_, err := app.patchDerived(_key, data)
+	if err == ErrNotFound {
+		data, err = app.filterSet().Derive.check(_key, data, false)
+		if err != nil {
+			return _key, err
+		}
+		return app.Storage.SetWithSchema(_key, data, version)
+	}
+	if err != nil && err != ErrNoop {
+		return _key, err
+	}
+
+	return key.LastIndex(_key), nil
+}
+
+// commitWrite stores the data of a write that passed the write filters through
+// the dedupe filter and the list limit of the key, a write skipped by the dedupe
+// filter returns ErrNoop with the index of the key
+func (app *Server) commitWrite(_key string, data json.RawMessage, set func(data json.RawMessage) (string, error)) (string, error) {
+	data, err := app.filterSet().Dedupe.check(_key, data, false)
+	if err == ErrNoop {
+		return key.LastIndex(_key), ErrNoop
+	}
+	if err != nil {
+		if _, ok := asHTTPError(err); ok {
+			return "", err
+		}
+		return "", HTTPError{Status: http.StatusBadRequest, Msg: err.Error()}
+	}
+
+	releaseList, err := app.reserveList(_key)
+	if err != nil {
+		return "", err
+	}
+	defer releaseList()
+
+	return set(data)
+}
+
+// representation the response of a write should include the stored object, with
+// ReturnRepresentation or a "Prefer: return=representation" request header
+func (app *Server) representation(r *http.Request) bool {
+	if app.ReturnRepresentation {
+		return true
+	}
+	for _, preference := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.TrimSpace(preference) == "return=representation" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeResponse responds a write with the index or the
+// stored object through the read filters (representation)
+func (app *Server) writeResponse(w http.ResponseWriter, r *http.Request, _key string, index string) {
+	w.Header().Set("Content-Type", "application/json")
+	if app.representation(r) {
+		data, err := app.filteredData(app.Storage, _key)
+		if err == nil {
+			w.Header().Set("Preference-Applied", "return=representation")
+			w.Write(data)
+			return
+		}
+	}
+
+	fmt.Fprintf(w, `{"index":"`+index+`"}`)
+}
+
+// schema version of the data of a write request from the X-Schema header
+func schema(r *http.Request) (int, error) {
+	header := r.Header.Get("X-Schema")
+	if header == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(header)
+	if err != nil || version < 0 {
+		return 0, ErrInvalidSchema
+	}
+
+	return version, nil
+}
+
+// etag of a stored object
+func etag(obj meta.Object) string {
+	return `"` + strconv.FormatInt(UpdatedBased(obj), 16) + `"`
+}
+
+// precondition checks the If-Match and If-Unmodified-Since
+// headers of a write request against the stored object
+func (app *Server) precondition(r *http.Request, _key string) bool {
+	ifMatch := r.Header.Get("If-Match")
+	ifUnmodifiedSince := r.Header.Get("If-Unmodified-Since")
+	if ifMatch == "" && ifUnmodifiedSince == "" {
+		return true
+	}
+
+	raw, err := app.Storage.Get(_key)
+	if err != nil {
+		return ifMatch == ""
+	}
+	obj, err := meta.Decode(raw)
+	if err != nil {
+		return false
+	}
+
+	if ifMatch != "" {
+		current := etag(obj)
+		matched := false
+		for _, tag := range strings.Split(ifMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || tag == current {
+				matched = true
+				break
+			}
+		}
+		return matched
+	}
+
+	since, err := http.ParseTime(ifUnmodifiedSince)
+	if err != nil {
+		return true
+	}
+	modified := time.Unix(0, UpdatedBased(obj)).Truncate(time.Second)
+	return !modified.After(since)
+}
+
+// emptyObject canonical encoding of meta.EmptyObject
+var emptyObject = canonical(meta.EmptyObject)
+
+// isEmptyObject the data is the empty object, filtered data can encode it with other
+// spacing or field order so short payloads are compared by their canonical encoding
+func isEmptyObject(data []byte) bool {
+	if bytes.Equal(data, meta.EmptyObject) {
+		return true
+	}
+	if len(data) > 4*len(meta.EmptyObject) {
+		return false
+	}
+	return bytes.Equal(canonical(data), emptyObject)
+}
+
 func (app *Server) getStats(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Upgrade") == "websocket" {
 		app.clock(w, r)
 		return
 	}
+	if app.adminListening() {
+		writeAdminOnly(w)
+		return
+	}
+	app.stats(w, r)
+}
+
+// stats responds the api= endpoints and the key list
+func (app *Server) stats(w http.ResponseWriter, r *http.Request) {
 	if !app.Audit(r) {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprintf(w, "%s", ErrNotAuthorized)
 		return
 	}
 
-	stats, err := app.Storage.Keys()
+	if r.URL.Query().Get("api") == "pool" {
+		app.getPool(w, r.URL.Query().Get("key"))
+		return
+	}
+
+	if r.URL.Query().Get("api") == "subscriptions" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.Subscriptions())
+		return
+	}
+
+	if r.URL.Query().Get("api") == "orphans" {
+		app.getOrphans(w)
+		return
+	}
+
+	if r.URL.Query().Get("api") == "openapi" {
+		app.getOpenAPI(w)
+		return
+	}
+
+	streamer, ok := app.reads().(KeysStreamer)
+	if ok && app.KeysStreamThreshold > 0 && streamer.KeyCount() > app.KeysStreamThreshold {
+		app.streamKeys(w, streamer)
+		return
+	}
+
+	stats, err := app.reads().Keys()
+	if err != nil {
+		app.writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(stats)
+}
+
+// needsEscape the string has characters that must be escaped in a JSON string
+func needsEscape(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == '"' || s[i] == '\\' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamKeys writes the stats of the storage as the keys are listed
+func (app *Server) streamKeys(w http.ResponseWriter, streamer KeysStreamer) {
+	w.Header().Set("Content-Type", "application/json")
+	buf := bufio.NewWriter(w)
+	buf.WriteString(`{"keys":[`)
+	first := true
+	streamer.RangeKeys(func(_key string) bool {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		if needsEscape(_key) {
+			encoded, _ := json.Marshal(_key)
+			buf.Write(encoded)
+			return true
+		}
+		buf.WriteByte('"')
+		buf.WriteString(_key)
+		buf.WriteByte('"')
+		return true
+	})
+	buf.WriteString(`]}`)
+	err := buf.Flush()
+	if err != nil {
+		app.Console.Err("ooo: stream keys", err)
+	}
+}
+
+// getOrphans writes the stored keys that match no filter
+func (app *Server) getOrphans(w http.ResponseWriter) {
+	orphans, err := app.OrphanKeys()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%s", err)
@@ -36,7 +403,44 @@ func (app *Server) getStats(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(stats)
+	json.NewEncoder(w).Encode(Stats{Keys: orphans})
+}
+
+// Subscriptions lists the keys with subscribers, their number, the version of the pool and the remote addresses
+func (app *Server) Subscriptions() []stream.SubscriptionInfo {
+	return app.Stream.Subscriptions()
+}
+
+// poolInfo the cache of a pool in the pool api
+type poolInfo struct {
+	Key     string          `json:"key"`
+	Version string          `json:"version"`
+	List    bool            `json:"list"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// getPool writes the cache of a stream pool
+func (app *Server) getPool(w http.ResponseWriter, _key string) {
+	cache, err := app.Stream.GetCache(_key)
+	if _key == "" || err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s", errors.New("ooo: pool not found"))
+		return
+	}
+
+	data, err := json.Marshal(poolInfo{
+		Key:     _key,
+		Version: strconv.FormatInt(cache.Version, 16),
+		List:    strings.Contains(_key, "*"),
+		Data:    cache.Data,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 }
 
 func (app *Server) publish(w http.ResponseWriter, r *http.Request) {
@@ -51,39 +455,83 @@ func (app *Server) publish(w http.ResponseWriter, r *http.Request) {
 	where := strings.Index(_key, "*")
 	invalidGlobCount := countGlob > 1
 	globNotAtTheEndOfPath := countGlob == 1 && where != len(_key)-1
-	if !key.IsValid(_key) || invalidGlobCount || globNotAtTheEndOfPath {
+	if !app.validKey(_key) || invalidGlobCount || globNotAtTheEndOfPath {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", errors.New("ooo: pathKeyError key is not valid"))
 		return
 	}
 
-	event, err := messages.DecodeReader(r.Body)
+	if app.rejectAuditLog(w, _key) {
+		return
+	}
+
+	version, err := schema(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
 
-	_newKey := key.Build(_key)
-	data, err := app.filters.Write.check(_newKey, event, app.Static)
+	event, err := app.decodeBody(_key, r)
 	if err != nil {
-		app.Console.Err("setError:filter["+_newKey+"]", err)
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
 
-	index, err := app.Storage.Set(_newKey, data)
+	_newKey := key.Build(_key)
+	data, err := app.filterSet().checkWrite(http.MethodPost, _newKey, event, app.Static)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%s", err)
+		app.Console.Err("setError:filter["+_newKey+"]", err)
+		writeFilterError(w, err)
+		return
+	}
+
+	data, err = app.filterSet().Derive.check(_newKey, data, false)
+	if err != nil {
+		app.Console.Err("setError:derive["+_newKey+"]", err)
+		writeFilterError(w, err)
+		return
+	}
+
+	err = app.checkReferences(_newKey, data, false)
+	if err != nil {
+		app.Console.Err("setError:reference["+_newKey+"]", err)
+		writeFilterError(w, err)
+		return
+	}
+
+	if isDryRun(r) {
+		err = app.checkList(_newKey)
+		if err != nil {
+			writeFilterError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	var before string
+	index, err := app.commitWrite(_newKey, data, func(data json.RawMessage) (string, error) {
+		release := app.requestID(w, r, _newKey)
+		defer release()
+		before = app.auditHash(_newKey)
+		return app.Storage.SetWithSchema(_newKey, data, version)
+	})
+	if err == ErrNoop {
+		app.writeResponse(w, r, _newKey, index)
 		return
 	}
+	if err != nil {
+		app.writeStorageError(w, err)
+		return
+	}
+	app.auditMutation(r, _newKey, before)
 
 	app.Console.Log("publish", _newKey)
-	app.filters.AfterWrite.check(_newKey)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"index":"`+index+`"}`)
+	app.filterSet().AfterWrite.check(_newKey)
+	app.writeResponse(w, r, _newKey, index)
 }
 
 func (app *Server) republish(w http.ResponseWriter, r *http.Request) {
@@ -98,38 +546,94 @@ func (app *Server) republish(w http.ResponseWriter, r *http.Request) {
 	where := strings.Index(_key, "*")
 	invalidGlobCount := countGlob > 1
 	globNotAtTheEndOfPath := countGlob == 1 && where != len(_key)-1
-	if !key.IsValid(_key) || invalidGlobCount || globNotAtTheEndOfPath {
+	if !app.validKey(_key) || invalidGlobCount || globNotAtTheEndOfPath {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", errors.New("ooo: pathKeyError key is not valid"))
 		return
 	}
 
-	event, err := messages.DecodeReader(r.Body)
+	if app.rejectAuditLog(w, _key) {
+		return
+	}
+
+	if !app.precondition(r, _key) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "%s", ErrPreconditionFailed)
+		return
+	}
+
+	version, err := schema(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
 
-	data, err := app.filters.Write.check(_key, event, app.Static)
+	event, err := app.decodeBody(_key, r)
 	if err != nil {
-		app.Console.Err("setError:filter["+_key+"]", err)
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
 
-	index, err := app.Storage.Set(_key, data)
+	data, err := app.filterSet().checkWrite(http.MethodPut, _key, event, app.Static)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%s", err)
+		app.Console.Err("setError:filter["+_key+"]", err)
+		writeFilterError(w, err)
+		return
+	}
+
+	// merge writes are derived from the merged object when stored
+	if r.URL.Query().Get("merge") != "true" {
+		data, err = app.filterSet().Derive.check(_key, data, false)
+		if err != nil {
+			app.Console.Err("setError:derive["+_key+"]", err)
+			writeFilterError(w, err)
+			return
+		}
+	}
+
+	err = app.checkReferences(_key, data, r.URL.Query().Get("merge") == "true")
+	if err != nil {
+		app.Console.Err("setError:reference["+_key+"]", err)
+		writeFilterError(w, err)
+		return
+	}
+
+	if isDryRun(r) {
+		err = app.checkList(_key)
+		if err != nil {
+			writeFilterError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
 		return
 	}
 
+	var before string
+	index, err := app.commitWrite(_key, data, func(data json.RawMessage) (string, error) {
+		release := app.requestID(w, r, _key)
+		defer release()
+		before = app.auditHash(_key)
+		if r.URL.Query().Get("merge") == "true" {
+			return app.upsert(_key, data, version)
+		}
+		return app.Storage.SetWithSchema(_key, data, version)
+	})
+	if err == ErrNoop {
+		app.writeResponse(w, r, _key, index)
+		return
+	}
+	if err != nil {
+		app.writeStorageError(w, err)
+		return
+	}
+	app.auditMutation(r, _key, before)
+
 	app.Console.Log("republish", _key)
-	app.filters.AfterWrite.check(_key)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"index":"`+index+`"}`)
+	app.filterSet().AfterWrite.check(_key)
+	app.writeResponse(w, r, _key, index)
 }
 
 func (app *Server) patch(w http.ResponseWriter, r *http.Request) {
@@ -144,12 +648,22 @@ func (app *Server) patch(w http.ResponseWriter, r *http.Request) {
 	where := strings.Index(_key, "*")
 	invalidGlobCount := countGlob > 1
 	globNotAtTheEndOfPath := countGlob == 1 && where != len(_key)-1
-	if !key.IsValid(_key) || invalidGlobCount || globNotAtTheEndOfPath {
+	if !app.validKey(_key) || invalidGlobCount || globNotAtTheEndOfPath {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", errors.New("ooo: pathKeyError key is not valid"))
 		return
 	}
 
+	if app.rejectAuditLog(w, _key) {
+		return
+	}
+
+	if !app.precondition(r, _key) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "%s", ErrPreconditionFailed)
+		return
+	}
+
 	event, err := messages.DecodeReader(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -157,30 +671,44 @@ func (app *Server) patch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := app.filters.Write.check(_key, event, app.Static)
+	data, err := app.filterSet().checkWrite(http.MethodPatch, _key, event, app.Static)
 	if err != nil {
 		app.Console.Err("setError["+_key+"]", err)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", err)
+		writeFilterError(w, err)
 		return
 	}
 
-	index, err := app.Storage.Patch(_key, data)
+	err = app.checkReferences(_key, data, true)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%s", err)
+		app.Console.Err("setError:reference["+_key+"]", err)
+		writeFilterError(w, err)
+		return
+	}
+
+	if isDryRun(r) {
+		app.dryRunPatch(w, _key, data)
+		return
+	}
+
+	release := app.requestID(w, r, _key)
+	before := app.auditHash(_key)
+	index, err := app.patchDerived(_key, data)
+	release()
+	if err != nil {
+		app.writeStorageError(w, err)
 		return
 	}
+	app.auditMutation(r, _key, before)
 
 	app.Console.Log("patch", _key)
-	app.filters.AfterWrite.check(_key)
+	app.filterSet().AfterWrite.check(_key)
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintf(w, `{"index":"`+index+`"}`)
 }
 
 func (app *Server) read(w http.ResponseWriter, r *http.Request) {
 	_key := mux.Vars(r)["key"]
-	if !key.IsValid(_key) {
+	if !app.validKey(_key) {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", errors.New("ooo: pathKeyError key is not valid"))
 		return
@@ -197,26 +725,62 @@ func (app *Server) read(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("wait") == "1" {
+		app.longPoll(w, r, _key)
+		return
+	}
+
+	if isPage(r, _key) {
+		app.readPage(w, r, _key)
+		return
+	}
+
 	app.Console.Log("read", _key)
 	entry, err := app.fetch(_key)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", err)
+		writeFilterError(w, err)
 		return
 	}
-	if bytes.Equal(entry.Data, meta.EmptyObject) {
+	data := entry.Data
+	if app.AuthorizeRead != nil {
+		data = app.Stream.Authorized(app.Principal(r), _key, data)
+	}
+	empty := isEmptyObject(data)
+	if empty && !app.EmptyAsOK {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "%s", errors.New("ooo: empty key"))
 		return
 	}
+	if empty {
+		data = meta.EmptyObject
+	}
 
+	if !strings.Contains(_key, "*") {
+		obj, err := meta.Decode(data)
+		if err == nil && obj.Created != 0 {
+			w.Header().Set("ETag", etag(obj))
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(entry.Data)
+	if !strings.Contains(_key, "*") && app.filterSet().Raw.match(_key) {
+		text, ok := rawData(data)
+		if ok {
+			data = text
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Write(data)
 }
 
-func (app *Server) unpublish(w http.ResponseWriter, r *http.Request) {
+// options responds the methods allowed for a key in the Allow header
+func (app *Server) options(w http.ResponseWriter, r *http.Request) {
 	_key := mux.Vars(r)["key"]
-	if !key.IsValid(_key) {
+	if !app.validKey(_key) {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", errors.New("ooo: pathKeyError key is not valid"))
 		return
@@ -228,27 +792,60 @@ func (app *Server) unpublish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := app.filters.Delete.check(_key, app.Static)
+	methods := []string{}
+	if app.filterSet().Read.checkStatic(_key, app.Static) == nil {
+		methods = append(methods, http.MethodGet, http.MethodHead)
+	}
+	set := app.filterSet()
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch} {
+		if set.Write.checkStatic(_key, app.Static) == nil || set.WriteMethod.method(method).checkStatic(_key, true) == nil {
+			methods = append(methods, method)
+		}
+	}
+	if app.filterSet().Delete.checkStatic(_key, app.Static) == nil {
+		methods = append(methods, http.MethodDelete)
+	}
+	methods = append(methods, http.MethodOptions)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *Server) unpublish(w http.ResponseWriter, r *http.Request) {
+	if !app.Audit(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", ErrNotAuthorized)
+		return
+	}
+
+	_key := mux.Vars(r)["key"]
+	if !app.validKey(_key) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", errors.New("ooo: pathKeyError key is not valid"))
+		return
+	}
+
+	if app.rejectAuditLog(w, _key) {
+		return
+	}
+
+	err := app.filterSet().Delete.check(_key, app.Static)
 	if err != nil {
 		app.Console.Err("detError["+_key+"]", err)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", err)
+		writeFilterError(w, err)
 		return
 	}
 
 	app.Console.Log("unpublish", _key)
+	release := app.requestID(w, r, _key)
+	before := app.auditHash(_key)
 	err = app.Storage.Del(_key)
-
+	release()
 	if err != nil {
 		app.Console.Err(err.Error())
-		if err == ErrNotFound {
-			w.WriteHeader(http.StatusNotFound)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		fmt.Fprintf(w, "%s", err)
+		app.writeStorageError(w, err)
 		return
 	}
+	app.auditMutation(r, _key, before)
 
 	// this performs better than the watch channel
 	// if app.Storage.Watch() == nil {
@@ -2,15 +2,26 @@ package ooo_test
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
 
 	"github.com/benitogf/ooo"
 	"github.com/benitogf/ooo/meta"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 func TestRestPostNonObject(t *testing.T) {
@@ -332,3 +343,975 @@ func TestPatch(t *testing.T) {
 
 	require.Equal(t, string(testOutput), string(obj.Data))
 }
+
+func TestRestDryRun(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.WriteFilter("test/*", func(key string, data json.RawMessage) (json.RawMessage, error) {
+		if !bytes.Contains(data, []byte(`"name"`)) {
+			return nil, errors.New("name is required")
+		}
+		return json.RawMessage(`{"name":"normalized"}`), nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest(http.MethodPost, "/test/*?dryRun=true", bytes.NewBuffer([]byte(`{"name":"Test"}`)))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `{"name":"normalized"}`, string(body))
+
+	raw, err := app.Storage.Get("test/*")
+	require.NoError(t, err)
+	require.Equal(t, "[]", string(raw))
+
+	req = httptest.NewRequest(http.MethodPut, "/test/1?dryRun=true", bytes.NewBuffer([]byte(`{"other":"Test"}`)))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "name is required", string(body))
+
+	_, err = app.Storage.Set("test/1", json.RawMessage(`{"name":"stored","count":1}`))
+	require.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodPatch, "/test/1?dryRun=true", bytes.NewBuffer([]byte(`{"name":"Test"}`)))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `{"count":1,"name":"normalized"}`, string(body))
+
+	raw, err = app.Storage.Get("test/1")
+	require.NoError(t, err)
+	obj, err := meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"stored","count":1}`, string(obj.Data))
+}
+
+func TestRestKeyPattern(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	for _, _key := range []string{"users/john.doe", "events/2024-01-01", "snake_case"} {
+		req := httptest.NewRequest(http.MethodPost, "/"+_key, bytes.NewBuffer(ooo.TEST_DATA))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		req = httptest.NewRequest(http.MethodGet, "/"+_key, nil)
+		w = httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+
+	custom := ooo.Server{}
+	custom.Silence = true
+	custom.KeyPattern = `[a-zA-Z\*\d\/]+`
+	custom.Start("localhost:0")
+	defer custom.Close(os.Interrupt)
+
+	req := httptest.NewRequest(http.MethodPost, "/users/john.doe", bytes.NewBuffer(ooo.TEST_DATA))
+	w := httptest.NewRecorder()
+	custom.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodPost, "/users/john", bytes.NewBuffer(ooo.TEST_DATA))
+	w = httptest.NewRecorder()
+	custom.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// a wider pattern widens the keys accepted by the handlers and the storage
+	unicode := ooo.Server{}
+	unicode.Silence = true
+	unicode.KeyPattern = `[\p{L}\*\d\/\-\._]+`
+	unicode.Start("localhost:0")
+	defer unicode.Close(os.Interrupt)
+
+	req = httptest.NewRequest(http.MethodPost, "/usuarios/jos%C3%A9", bytes.NewBuffer(ooo.TEST_DATA))
+	w = httptest.NewRecorder()
+	unicode.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodGet, "/usuarios/jos%C3%A9", nil)
+	w = httptest.NewRecorder()
+	unicode.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	_, err := unicode.Storage.Get("usuarios/josé")
+	require.NoError(t, err)
+}
+
+func TestRestUpsert(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest(http.MethodPut, "/test/1?merge=true", bytes.NewBuffer([]byte(`{"one":"test"}`)))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `{"index":"1"}`, string(body))
+
+	raw, err := app.Storage.Get("test/1")
+	require.NoError(t, err)
+	obj, err := meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, `{"one":"test"}`, string(obj.Data))
+
+	req = httptest.NewRequest(http.MethodPut, "/test/1?merge=true", bytes.NewBuffer([]byte(`{"two":"testing"}`)))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `{"index":"1"}`, string(body))
+
+	raw, err = app.Storage.Get("test/1")
+	require.NoError(t, err)
+	obj, err = meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, `{"one":"test","two":"testing"}`, string(obj.Data))
+
+	req = httptest.NewRequest(http.MethodPut, "/test/1", bytes.NewBuffer([]byte(`{"three":"test"}`)))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	raw, err = app.Storage.Get("test/1")
+	require.NoError(t, err)
+	obj, err = meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, `{"three":"test"}`, string(obj.Data))
+}
+
+func TestRestPool(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("test", json.RawMessage(`{"name":"test"}`))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	version, err := app.Stream.GetCacheVersion("test")
+	require.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodGet, "/?api=pool&key=test", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var pool struct {
+		Key     string      `json:"key"`
+		Version string      `json:"version"`
+		List    bool        `json:"list"`
+		Data    meta.Object `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&pool)
+	require.NoError(t, err)
+	require.Equal(t, "test", pool.Key)
+	require.Equal(t, strconv.FormatInt(version, 16), pool.Version)
+	require.False(t, pool.List)
+	require.Equal(t, `{"name":"test"}`, string(pool.Data.Data))
+
+	_, err = app.Storage.Set("test", json.RawMessage(`{"name":"broadcast"}`))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/?api=pool&key=test", nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return bytes.Contains(w.Body.Bytes(), []byte(`{"name":"broadcast"}`))
+	}, time.Second, 10*time.Millisecond)
+
+	req = httptest.NewRequest(http.MethodGet, "/?api=pool&key=unknown", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	// keys are escaped in the response
+	custom := ooo.Server{}
+	custom.Silence = true
+	custom.KeyPattern = `[\w\*\/\"]+`
+	custom.Start("localhost:0")
+	defer custom.Close(os.Interrupt)
+	_, err = custom.Storage.Set(`say/"hi"`, json.RawMessage(`{"name":"quoted"}`))
+	require.NoError(t, err)
+	req = httptest.NewRequest(http.MethodGet, "/say/%22hi%22", nil)
+	w = httptest.NewRecorder()
+	custom.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	req = httptest.NewRequest(http.MethodGet, "/?api=pool&key=say/%22hi%22", nil)
+	w = httptest.NewRecorder()
+	custom.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	err = json.NewDecoder(resp.Body).Decode(&pool)
+	require.NoError(t, err)
+	require.Equal(t, `say/"hi"`, pool.Key)
+	require.Equal(t, `{"name":"quoted"}`, string(pool.Data.Data))
+
+	app.Audit = func(r *http.Request) bool { return false }
+	req = httptest.NewRequest(http.MethodGet, "/?api=pool&key=test", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
+
+func TestRestEndpointGroup(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.EndpointGroup("/billing", func(r *mux.Router) {
+		r.HandleFunc("/invoices", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+		}).Methods("GET")
+		r.HandleFunc("/invoices/{id}", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":"` + mux.Vars(r)["id"] + `"}`))
+		}).Methods("GET")
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("GET", "/billing/invoices", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, `{"path":"/billing/invoices"}`, w.Body.String())
+
+	req = httptest.NewRequest("GET", "/billing/invoices/1", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, `{"id":"1"}`, w.Body.String())
+
+	// the group routes don't exist at the root
+	req = httptest.NewRequest("GET", "/invoices", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	// paths under the prefix without a group route use the key routes
+	req = httptest.NewRequest("POST", "/billing/other", bytes.NewBuffer([]byte(`{"test":1}`)))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	req = httptest.NewRequest("GET", "/billing/other", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Contains(t, w.Body.String(), `"data":{"test":1}`)
+}
+
+func TestRestPrecondition(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	write := func(method string, data string, header http.Header) int {
+		req := httptest.NewRequest(method, "/test", bytes.NewBuffer([]byte(data)))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+	read := func() (string, meta.Object) {
+		req := httptest.NewRequest("GET", "/test", nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		obj, err := meta.Decode(w.Body.Bytes())
+		require.NoError(t, err)
+		return w.Result().Header.Get("ETag"), obj
+	}
+
+	// missing object
+	require.Equal(t, http.StatusPreconditionFailed, write("PUT", `{"name":"one"}`, http.Header{"If-Match": {`"1"`}}))
+	require.Equal(t, http.StatusOK, write("PUT", `{"name":"one"}`, nil))
+	etag, _ := read()
+	require.NotEmpty(t, etag)
+
+	require.Equal(t, http.StatusOK, write("PUT", `{"name":"two"}`, http.Header{"If-Match": {etag}}))
+	staleEtag := etag
+	etag, obj := read()
+	require.NotEqual(t, staleEtag, etag)
+	require.Equal(t, `{"name":"two"}`, string(obj.Data))
+
+	require.Equal(t, http.StatusPreconditionFailed, write("PUT", `{"name":"three"}`, http.Header{"If-Match": {staleEtag}}))
+	require.Equal(t, http.StatusPreconditionFailed, write("PATCH", `{"name":"three"}`, http.Header{"If-Match": {staleEtag}}))
+	require.Equal(t, http.StatusOK, write("PATCH", `{"name":"three"}`, http.Header{"If-Match": {`"0", ` + etag}}))
+	require.Equal(t, http.StatusOK, write("PATCH", `{"name":"four"}`, http.Header{"If-Match": {"*"}}))
+
+	_, obj = read()
+	modified := time.Unix(0, obj.Updated)
+	require.Equal(t, http.StatusPreconditionFailed, write("PUT", `{"name":"five"}`,
+		http.Header{"If-Unmodified-Since": {modified.Add(-time.Hour).UTC().Format(http.TimeFormat)}}))
+	require.Equal(t, http.StatusOK, write("PUT", `{"name":"five"}`,
+		http.Header{"If-Unmodified-Since": {modified.Add(time.Hour).UTC().Format(http.TimeFormat)}}))
+	_, obj = read()
+	require.Equal(t, `{"name":"five"}`, string(obj.Data))
+}
+
+func TestRestHeadOptions(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	index, err := app.Storage.Set("test", json.RawMessage(`{"name":"one"}`))
+	require.Equal(t, "test", index)
+	require.NoError(t, err)
+
+	get, err := http.Get("http://" + app.Address + "/test")
+	require.NoError(t, err)
+	body, err := io.ReadAll(get.Body)
+	get.Body.Close()
+	require.NoError(t, err)
+
+	head, err := http.Head("http://" + app.Address + "/test")
+	require.NoError(t, err)
+	empty, err := io.ReadAll(head.Body)
+	head.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, head.StatusCode)
+	require.Equal(t, 0, len(empty))
+	require.NotEmpty(t, head.Header.Get("ETag"))
+	require.Equal(t, get.Header.Get("ETag"), head.Header.Get("ETag"))
+	require.Equal(t, int64(len(body)), head.ContentLength)
+
+	req := httptest.NewRequest("HEAD", "/missing", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	req = httptest.NewRequest("OPTIONS", "/test", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	require.Equal(t, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS", w.Result().Header.Get("Allow"))
+
+	static := ooo.Server{}
+	static.Silence = true
+	static.Static = true
+	static.ReadFilter("list/*", ooo.NoopFilter)
+	static.Start("localhost:0")
+	defer static.Close(os.Interrupt)
+
+	req = httptest.NewRequest("HEAD", "/test", nil)
+	w = httptest.NewRecorder()
+	static.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	req = httptest.NewRequest("OPTIONS", "/list/1", nil)
+	w = httptest.NewRecorder()
+	static.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	require.Equal(t, "GET, HEAD, OPTIONS", w.Result().Header.Get("Allow"))
+}
+
+func TestRestEmptyAsOK(t *testing.T) {
+	get := func(app *ooo.Server, path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode, w.Body.String()
+	}
+
+	app := ooo.Server{}
+	app.Silence = true
+	app.Static = true
+	app.OpenFilter("thing")
+	app.OpenFilter("things/*")
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	status, _ := get(&app, "/thing")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = get(&app, "/things/1")
+	require.Equal(t, http.StatusNotFound, status)
+
+	emptyOK := ooo.Server{}
+	emptyOK.Silence = true
+	emptyOK.Static = true
+	emptyOK.EmptyAsOK = true
+	emptyOK.OpenFilter("thing")
+	emptyOK.OpenFilter("things/*")
+	emptyOK.Start("localhost:0")
+	defer emptyOK.Close(os.Interrupt)
+	status, body := get(&emptyOK, "/thing")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, string(meta.EmptyObject), body)
+	status, body = get(&emptyOK, "/things/*")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "[]", body)
+	// undefined keys are still rejected in static mode
+	status, _ = get(&emptyOK, "/other")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestRestReturnRepresentation(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.WriteFilter("users/*", func(index string, data json.RawMessage) (json.RawMessage, error) {
+		return sjson.SetBytes(data, "name", strings.ToLower(gjson.GetBytes(data, "name").String()))
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	write := func(app *ooo.Server, method string, path string, data string, prefer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(data)))
+		if prefer != "" {
+			req.Header.Set("Prefer", prefer)
+		}
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		return w
+	}
+
+	w := write(&app, "POST", "/users/*", `{"name":"ADA"}`, "")
+	require.Equal(t, "", w.Result().Header.Get("Preference-Applied"))
+	index := gjson.Get(w.Body.String(), "index").String()
+	require.NotEmpty(t, index)
+	require.JSONEq(t, `{"index":"`+index+`"}`, w.Body.String())
+
+	w = write(&app, "POST", "/users/*", `{"name":"BOB"}`, "return=representation")
+	require.Equal(t, "return=representation", w.Result().Header.Get("Preference-Applied"))
+	obj, err := meta.Decode(w.Body.Bytes())
+	require.NoError(t, err)
+	require.NotZero(t, obj.Created)
+	require.NotEmpty(t, obj.Index)
+	require.Equal(t, `{"name":"bob"}`, string(obj.Data))
+
+	app.ReturnRepresentation = true
+	w = write(&app, "PUT", "/users/"+index, `{"name":"ADA LOVELACE"}`, "")
+	obj, err = meta.Decode(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, index, obj.Index)
+	require.NotZero(t, obj.Updated)
+	require.Equal(t, `{"name":"ada lovelace"}`, string(obj.Data))
+}
+
+// discardWriter response writer that only counts the body bytes
+type discardWriter struct {
+	header  http.Header
+	written int
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) WriteHeader(statusCode int)  {}
+func (w *discardWriter) Write(p []byte) (int, error) { w.written += len(p); return len(p), nil }
+
+func TestRestStreamKeys(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.KeysStreamThreshold = 100
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	expected := []string{}
+	for i := 0; i < 5000; i++ {
+		_key := "things/" + strconv.Itoa(i)
+		expected = append(expected, _key)
+		_, err := app.Storage.Set(_key, json.RawMessage(`{"test":true}`))
+		require.NoError(t, err)
+	}
+	app.Sync()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var stats ooo.Stats
+	err := json.NewDecoder(w.Result().Body).Decode(&stats)
+	require.NoError(t, err)
+	require.ElementsMatch(t, expected, stats.Keys)
+
+	allocated := func(fn func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		fn()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	streamed := allocated(func() {
+		app.Router.ServeHTTP(&discardWriter{header: http.Header{}}, req)
+	})
+	app.KeysStreamThreshold = 0
+	built := allocated(func() {
+		app.Router.ServeHTTP(&discardWriter{header: http.Header{}}, req)
+	})
+	require.Less(t, streamed*10, built)
+}
+
+func TestRestRawFilter(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.RawFilter("notes/*")
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	const note = "plain text, not {json}\nsecond line"
+	req := httptest.NewRequest("POST", "/notes/1", strings.NewReader(note))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/notes/1", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", w.Result().Header.Get("Content-Type"))
+	body, err := io.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, note, string(body))
+
+	// lists keep the objects with the text as data
+	req = httptest.NewRequest("GET", "/notes/*", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	objs, err := meta.DecodeList(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, note, gjson.GetBytes(objs[0].Data, "@this").String())
+
+	req = httptest.NewRequest("POST", "/notes/2", bytes.NewReader([]byte{0xff, 0xfe}))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	// other paths still require JSON
+	req = httptest.NewRequest("POST", "/other/1", strings.NewReader(note))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestRestAuditLog(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.AuditLog = true
+	app.Principal = func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	}
+	app.Audit = func(r *http.Request) bool {
+		return r.Header.Get("X-User") != ""
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	request := func(method string, path string, data string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(data))
+		req.Header.Set("X-User", "ada")
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+	entries := func() []ooo.AuditLogEntry {
+		raw, err := app.Storage.Get("audit/*")
+		require.NoError(t, err)
+		objs, err := meta.DecodeList(raw)
+		require.NoError(t, err)
+		res := []ooo.AuditLogEntry{}
+		for _, obj := range objs {
+			var entry ooo.AuditLogEntry
+			require.NoError(t, json.Unmarshal(obj.Data, &entry))
+			res = append(res, entry)
+		}
+		return res
+	}
+
+	require.Equal(t, http.StatusOK, request("POST", "/books/1", `{"title":"taup"}`))
+	require.Equal(t, http.StatusNoContent, request("DELETE", "/books/1", ""))
+
+	log := entries()
+	require.Equal(t, 2, len(log))
+	require.Equal(t, "ada", log[0].Principal)
+	require.Equal(t, "POST", log[0].Method)
+	require.Equal(t, "books/1", log[0].Key)
+	require.NotZero(t, log[0].Timestamp)
+	require.Equal(t, "", log[0].Before)
+	require.Len(t, log[0].After, 64)
+	require.Equal(t, "DELETE", log[1].Method)
+	require.Equal(t, "books/1", log[1].Key)
+	require.Equal(t, log[0].After, log[1].Before)
+	require.Equal(t, "", log[1].After)
+
+	// the audit log can't be modified through the api
+	raw, err := app.Storage.Get("audit/*")
+	require.NoError(t, err)
+	index := gjson.GetBytes(raw, "0.index").String()
+	require.Equal(t, http.StatusForbidden, request("POST", "/audit/*", `{"method":"forged"}`))
+	require.Equal(t, http.StatusForbidden, request("PUT", "/audit/"+index, `{"method":"forged"}`))
+	require.Equal(t, http.StatusForbidden, request("PATCH", "/audit/"+index, `{"method":"forged"}`))
+	require.Equal(t, http.StatusForbidden, request("DELETE", "/audit/"+index, ""))
+	require.Equal(t, http.StatusForbidden, request("DELETE", "/audit/*", ""))
+	require.Equal(t, log, entries())
+
+	// unauthorized requests don't learn that the path is the audit log
+	for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		req := httptest.NewRequest(method, "/audit/"+index, strings.NewReader(`{"method":"forged"}`))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode, method)
+	}
+}
+
+func TestRestKeysetPagination(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	for i := 0; i < 10; i++ {
+		_, err := app.Storage.Set("items/"+strconv.Itoa(i), json.RawMessage(`{"n":`+strconv.Itoa(i)+`}`))
+		require.NoError(t, err)
+	}
+	// same created time, ordered by path
+	_, err := app.Storage.SetWithMeta("items/a", json.RawMessage(`{"n":"a"}`), 1, 1)
+	require.NoError(t, err)
+	_, err = app.Storage.SetWithMeta("items/b", json.RawMessage(`{"n":"b"}`), 1, 1)
+	require.NoError(t, err)
+
+	page := func(query string) ([]meta.Object, string) {
+		req := httptest.NewRequest("GET", "/items/*?"+query, nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		objects, err := meta.DecodeListFromReader(w.Result().Body)
+		require.NoError(t, err)
+		return objects, w.Result().Header.Get("X-Next-Cursor")
+	}
+
+	visited := map[string]int{}
+	objects, next := page("limit=3")
+	require.Equal(t, "a", objects[0].Index)
+	require.Equal(t, "b", objects[1].Index)
+	for _, obj := range objects {
+		visited[obj.Index]++
+	}
+	inserted := false
+	for next != "" {
+		if !inserted {
+			// inserted mid pagination, at the end of the list
+			_, err := app.Storage.Set("items/new", json.RawMessage(`{"n":"new"}`))
+			require.NoError(t, err)
+			inserted = true
+		}
+		objects, next = page("limit=3&after=" + next)
+		require.LessOrEqual(t, len(objects), 3)
+		for _, obj := range objects {
+			visited[obj.Index]++
+		}
+	}
+	require.Len(t, visited, 13)
+	for index, count := range visited {
+		require.Equal(t, 1, count, index)
+	}
+
+	// a created time is a valid cursor
+	objects, next = page("after=1")
+	require.Len(t, objects, 11)
+	require.Equal(t, "", next)
+
+	req := httptest.NewRequest("GET", "/items/*?after=nope", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	req = httptest.NewRequest("GET", "/items/*?limit=0", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestRestLongPoll(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.LongPollTimeout = 100 * time.Millisecond
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("test", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+
+	poll := func(query string) *http.Response {
+		req := httptest.NewRequest("GET", "/test?wait=1"+query, nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// without since the current state is returned right away
+	res := poll("")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	version := res.Header.Get("X-Version")
+	require.NotEmpty(t, version)
+
+	// nothing changes
+	start := time.Now()
+	res = poll("&since=" + version)
+	require.Equal(t, http.StatusNotModified, res.StatusCode)
+	require.GreaterOrEqual(t, time.Since(start), app.LongPollTimeout)
+
+	// blocks until a write arrives
+	app.LongPollTimeout = 10 * time.Second
+	done := make(chan *http.Response)
+	go func() {
+		done <- poll("&since=" + version)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("the long poll returned before the write")
+	default:
+	}
+	_, err = app.Storage.Set("test", json.RawMessage(`{"name":"two"}`))
+	require.NoError(t, err)
+	res = <-done
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NotEqual(t, version, res.Header.Get("X-Version"))
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "two", gjson.GetBytes(body, "data.name").String())
+
+	res = poll("&since=nope")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestRestReadStorage(t *testing.T) {
+	replica := &ooo.MemoryStorage{}
+	app := ooo.Server{}
+	app.Silence = true
+	app.ReadStorage = replica
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	require.True(t, replica.Active())
+
+	req := httptest.NewRequest("POST", "/item", bytes.NewBufferString(`{"name":"primary"}`))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// the write lands in the write storage
+	raw, err := app.Storage.Get("item")
+	require.NoError(t, err)
+	require.Equal(t, "primary", gjson.GetBytes(raw, "data.name").String())
+	_, err = replica.Get("item")
+	require.Error(t, err)
+
+	read := func(path string) (int, []byte) {
+		req := httptest.NewRequest("GET", "/"+path, nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		return w.Result().StatusCode, body
+	}
+
+	// reads come from the read storage
+	status, _ := read("item")
+	require.Equal(t, http.StatusNotFound, status)
+	_, err = replica.Set("item", json.RawMessage(`{"name":"replica"}`))
+	require.NoError(t, err)
+	status, body := read("item")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "replica", gjson.GetBytes(body, "data.name").String())
+	_, body = read("")
+	require.JSONEq(t, `{"keys":["item"]}`, string(body))
+
+	local, err := ooo.GetOr(&app, "item", map[string]string{})
+	require.NoError(t, err)
+	require.Equal(t, "replica", local.Data["name"])
+}
+
+func TestRestImport(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	body := strings.Join([]string{
+		`{"created":100,"updated":200,"path":"devices/a","data":{"name":"a"}}`,
+		`{"created":300,"updated":0,"path":"devices/b","data":{"name":"b"}}`,
+		`not json`,
+		``,
+		`{"created":400,"updated":500,"path":"settings","data":{"on":true}}`,
+	}, "\n")
+	importData := func(query string, body string) (*http.Response, ooo.ImportResult) {
+		req := httptest.NewRequest(http.MethodPost, "/?api=import"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		var result ooo.ImportResult
+		json.NewDecoder(w.Result().Body).Decode(&result)
+		return w.Result(), result
+	}
+
+	resp, result := importData("", body)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 3, result.Imported)
+	require.Equal(t, 1, result.Failed)
+	require.Equal(t, 3, result.Errors[0].Line)
+
+	objs, err := app.Storage.GetN("devices/*", 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(objs))
+	raw, err := app.Storage.Get("devices/a")
+	require.NoError(t, err)
+	obj, err := meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), obj.Created)
+	require.Equal(t, int64(200), obj.Updated)
+	require.Equal(t, `{"name":"a"}`, string(obj.Data))
+	raw, err = app.Storage.Get("settings")
+	require.NoError(t, err)
+	obj, err = meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, int64(400), obj.Created)
+
+	// strict stops on the first line that fails
+	app.Storage.Clear()
+	resp, result = importData("&strict=true", body)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, 2, result.Imported)
+	require.Equal(t, 1, result.Failed)
+	_, err = app.Storage.Get("settings")
+	require.ErrorIs(t, err, ooo.ErrNotFound)
+
+	req := httptest.NewRequest(http.MethodPost, "/?api=import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnsupportedMediaType, w.Result().StatusCode)
+
+	app.MaxBodyBytes = 100
+	resp, result = importData("", body)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	require.Equal(t, 1, result.Imported)
+}
+
+func TestRestErrorStatus(t *testing.T) {
+	app := ooo.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	request := func(method string, path string, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	// patch and delete of a missing key
+	require.Equal(t, http.StatusNotFound, request(http.MethodPatch, "/test", `{"name":"a"}`))
+	require.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/test", ""))
+
+	// patch without changes
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/test", `{"name":"a"}`))
+	require.Equal(t, http.StatusNotModified, request(http.MethodPatch, "/test", `{"name":"a"}`))
+	require.Equal(t, http.StatusOK, request(http.MethodPatch, "/test", `{"name":"b"}`))
+
+	app.ErrorStatus = map[error]int{
+		ooo.ErrNotFound: http.StatusGone,
+		ooo.ErrNoop:     http.StatusOK,
+	}
+	require.Equal(t, http.StatusGone, request(http.MethodPatch, "/missing", `{"name":"a"}`))
+	require.Equal(t, http.StatusGone, request(http.MethodDelete, "/missing", ""))
+	require.Equal(t, http.StatusOK, request(http.MethodPatch, "/test", `{"name":"b"}`))
+}
+
+func TestRestKeyPolicy(t *testing.T) {
+	request := func(app *ooo.Server, method string, path string, body string) *http.Response {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	app := ooo.Server{}
+	app.Silence = true
+	app.KeyCaseInsensitive = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	require.Equal(t, http.StatusOK, request(&app, http.MethodPost, "/Things/One", `{"name":"a"}`).StatusCode)
+	require.Equal(t, http.StatusOK, request(&app, http.MethodPost, "/things/ONE", `{"name":"b"}`).StatusCode)
+	resp := request(&app, http.MethodGet, "/THINGS/one", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "b", gjson.GetBytes(body, "data.name").String())
+	keys, err := app.Storage.Keys()
+	require.NoError(t, err)
+	require.Equal(t, `{"keys":["things/one"]}`, string(keys))
+
+	// subscriptions resolve to the same key
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+app.Address+"/Things/One", nil)
+	require.NoError(t, err)
+	_, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	c.Close()
+	require.Contains(t, string(message), `"name":"b"`)
+	c, _, err = websocket.DefaultDialer.Dial("ws://"+app.Address+"/subscribe?keys=Things/One,OTHER", nil)
+	require.NoError(t, err)
+	frames := map[string]string{}
+	for len(frames) < 2 {
+		_, message, err = c.ReadMessage()
+		require.NoError(t, err)
+		frames[gjson.GetBytes(message, "key").String()] = gjson.GetBytes(message, "data.data.name").String()
+	}
+	c.Close()
+	require.Equal(t, map[string]string{"things/one": "b", "other": ""}, frames)
+
+	// strict (default) trailing slash
+	strict := ooo.Server{}
+	strict.Silence = true
+	strict.Start("localhost:0")
+	defer strict.Close(os.Interrupt)
+	require.Equal(t, http.StatusBadRequest, request(&strict, http.MethodPost, "/test/", `{"name":"a"}`).StatusCode)
+	require.Equal(t, http.StatusOK, request(&strict, http.MethodPost, "/Test", `{"name":"a"}`).StatusCode)
+	_, err = strict.Storage.Get("test")
+	require.ErrorIs(t, err, ooo.ErrNotFound)
+
+	redirect := ooo.Server{}
+	redirect.Silence = true
+	redirect.TrailingSlash = ooo.Redirect
+	redirect.Start("localhost:0")
+	defer redirect.Close(os.Interrupt)
+	resp = request(&redirect, http.MethodGet, "/test/?v=1", "")
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	require.Equal(t, "/test?v=1", resp.Header.Get("Location"))
+
+	ignore := ooo.Server{}
+	ignore.Silence = true
+	ignore.TrailingSlash = ooo.Ignore
+	ignore.Start("localhost:0")
+	defer ignore.Close(os.Interrupt)
+	require.Equal(t, http.StatusOK, request(&ignore, http.MethodPost, "/test/", `{"name":"a"}`).StatusCode)
+	require.Equal(t, http.StatusOK, request(&ignore, http.MethodGet, "/test", "").StatusCode)
+	require.Equal(t, http.StatusOK, request(&ignore, http.MethodGet, "/test/", "").StatusCode)
+}
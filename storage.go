@@ -1,24 +1,63 @@
 package ooo
 
 import (
+	"strings"
+
 	"github.com/goccy/go-json"
 
+	"github.com/benitogf/ooo/key"
 	"github.com/benitogf/ooo/meta"
 )
 
 // StorageChan an operation events channel
 type StorageChan chan StorageEvent
 
-// StorageEvent an operation event
+// StorageEvent an operation event, Created is true
+// when a "set" operation wrote a key that didn't exist
 type StorageEvent struct {
 	Key       string
 	Operation string
+	Created   bool
+	// RequestID id of the write request of the event (StorageOpt.RequestID)
+	RequestID string
+}
+
+// StorageEventCallback function called with a storage event
+type StorageEventCallback func(event StorageEvent)
+
+type eventCallback struct {
+	pattern  string
+	callback StorageEventCallback
+}
+
+type eventCallbacks []eventCallback
+
+// OnEvent registers a callback for the storage events of keys matching
+// the pattern, called after the broadcast, every matching callback is called
+func (app *Server) OnEvent(pattern string, callback StorageEventCallback) {
+	app.events = append(app.events, eventCallback{
+		pattern:  pattern,
+		callback: callback,
+	})
+}
+
+func (r eventCallbacks) check(event StorageEvent) {
+	for _, registered := range r {
+		if registered.pattern == event.Key || key.Match(registered.pattern, event.Key) {
+			registered.callback(event)
+		}
+	}
 }
 
 // StorageOpt options of the storage instance
 type StorageOpt struct {
 	NoBroadcastKeys []string
 	DbOpt           interface{}
+	// ValidKey checks the keys of the writes, defaults to key.IsValid
+	ValidKey func(key string) bool
+	// RequestID takes the id of the request writing the key, called
+	// during the write to include it in the storage event
+	RequestID func(key string) string
 }
 
 // Database interface to be implemented by storages
@@ -29,12 +68,18 @@ type StorageOpt struct {
 //
 // Close: closes the storage client
 //
-// Keys: returns a list with existing keys in the storage
+// Keys: returns a list with existing keys in the storage (ordered by DefaultKeyOrder unless changed with SetKeyOrder)
+//
+// SetKeyOrder(less): defines the order of the keys list
 //
 // Get(key): retrieve a value or list of values, the key can include a glob pattern (ascending created time order)
 //
 // GetDescending(key): retrieve a value or list of values, the key can include a glob pattern (descending created time order)
 //
+// GetMulti(paths): retrieve the objects of several keys (no glob patterns) in one call, keys not found are omitted
+//
+// Iterate(fn): calls fn with every stored object (unsorted) without building a list, stops at the first error fn returns and returns it
+//
 // GetN(path, N): retrieve N list of values matching a glob pattern (descending created time order)
 //
 // GetNAscending(path, N): retrieve N list of values matching a glob pattern (ascending created time order)
@@ -43,6 +88,8 @@ type StorageOpt struct {
 //
 // Set(key, data): store data under the provided key, key cannot not include glob pattern
 //
+// SetWithSchema(key, data, schema): same as set but tags the object with the schema version of the data
+//
 // SetWithMeta(key, data, created, updated): store data by manually providing created/updated time values
 //
 // GetAndLock(key): same as get but will lock the key mutex until SetAndUnlock is called for the same key (non glob key only)
@@ -55,19 +102,25 @@ type StorageOpt struct {
 //
 // Clear: will clear all data from the storage
 //
+// Compact: will rebuild internal structures to release memory after mass deletes (noop where irrelevant)
+//
 // Watch: returns a channel that will receive any set or del operation
 type Database interface {
 	Active() bool
 	Start(StorageOpt) error
 	Close()
 	Keys() ([]byte, error)
+	SetKeyOrder(less func(a, b string) bool)
 	KeysRange(path string, from, to int64) ([]string, error)
 	Get(key string) ([]byte, error)
 	GetDescending(key string) ([]byte, error)
+	GetMulti(paths []string) (map[string]meta.Object, error)
+	Iterate(fn func(obj meta.Object) error) error
 	GetN(path string, limit int) ([]meta.Object, error)
 	GetNAscending(path string, limit int) ([]meta.Object, error)
 	GetNRange(path string, limit int, from, to int64) ([]meta.Object, error)
 	Set(key string, data json.RawMessage) (string, error)
+	SetWithSchema(key string, data json.RawMessage, schema int) (string, error)
 	Patch(key string, data json.RawMessage) (string, error)
 	SetWithMeta(key string, data json.RawMessage, created, updated int64) (string, error)
 	GetAndLock(key string) ([]byte, error)
@@ -75,9 +128,27 @@ type Database interface {
 	Unlock(key string) error
 	Del(key string) error
 	Clear()
+	Compact()
 	Watch() StorageChan
 }
 
+// DefaultKeyOrder orders keys case insensitively, keys that only differ
+// in case are ordered by their bytes so the order is deterministic
+func DefaultKeyOrder(a, b string) bool {
+	lowerA, lowerB := strings.ToLower(a), strings.ToLower(b)
+	if lowerA != lowerB {
+		return lowerA < lowerB
+	}
+
+	return a < b
+}
+
+// KeysStreamer a database that can list its keys without building the full list
+type KeysStreamer interface {
+	KeyCount() int
+	RangeKeys(fn func(key string) bool)
+}
+
 // Storage abstraction of persistent data layer
 type Storage struct {
 	Active bool
@@ -2,6 +2,7 @@ package ooo
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -1058,6 +1059,120 @@ func StorageGetNTest(app *Server, t *testing.T, n int) {
 	require.Equal(t, strconv.Itoa(n-1), testObjectsSort[0].Index)
 }
 
+// StorageGetMultiTest testing storage GetMulti function
+func StorageGetMultiTest(app *Server, t *testing.T) {
+	app.Storage.Clear()
+	_, err := app.Storage.Set("test/0", json.RawMessage(`{"name":"zero"}`))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("test/1", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+
+	objs, err := app.Storage.GetMulti([]string{"test/0", "test/1", "test/2", "other"})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(objs))
+	require.Equal(t, "0", objs["test/0"].Index)
+	require.Equal(t, `{"name":"zero"}`, string(objs["test/0"].Data))
+	require.Equal(t, `{"name":"one"}`, string(objs["test/1"].Data))
+	_, found := objs["test/2"]
+	require.False(t, found)
+
+	objs, err = app.Storage.GetMulti([]string{})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(objs))
+
+	_, err = app.Storage.GetMulti([]string{"test/0", "test/*"})
+	require.Error(t, err)
+}
+
+// StorageSetWithSchemaTest testing storage SetWithSchema function
+func StorageSetWithSchemaTest(app *Server, t *testing.T) {
+	app.Storage.Clear()
+	_, err := app.Storage.SetWithSchema("test", json.RawMessage(`{"name":"one"}`), 2)
+	require.NoError(t, err)
+	raw, err := app.Storage.Get("test")
+	require.NoError(t, err)
+	obj, err := meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, 2, obj.Schema)
+
+	// patches keep the schema version
+	_, err = app.Storage.Patch("test", json.RawMessage(`{"name":"two"}`))
+	require.NoError(t, err)
+	raw, err = app.Storage.Get("test")
+	require.NoError(t, err)
+	obj, err = meta.Decode(raw)
+	require.NoError(t, err)
+	require.Equal(t, 2, obj.Schema)
+
+	// writes without a schema version are untagged
+	_, err = app.Storage.Set("test", json.RawMessage(`{"name":"three"}`))
+	require.NoError(t, err)
+	raw, err = app.Storage.Get("test")
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "schema")
+}
+
+// StorageKeyOrderTest testing storage keys order
+func StorageKeyOrderTest(app *Server, t *testing.T) {
+	app.Storage.Clear()
+	for _, _key := range []string{"b", "B", "a/2", "A/1", "c", "a"} {
+		_, err := app.Storage.Set(_key, json.RawMessage(`{"test":true}`))
+		require.NoError(t, err)
+	}
+	keys := func() []string {
+		raw, err := app.Storage.Keys()
+		require.NoError(t, err)
+		var stats Stats
+		err = json.Unmarshal(raw, &stats)
+		require.NoError(t, err)
+		return stats.Keys
+	}
+
+	require.Equal(t, []string{"a", "A/1", "a/2", "B", "b", "c"}, keys())
+
+	app.Storage.SetKeyOrder(func(a, b string) bool {
+		return a > b
+	})
+	require.Equal(t, []string{"c", "b", "a/2", "a", "B", "A/1"}, keys())
+
+	app.Storage.SetKeyOrder(nil)
+	require.Equal(t, []string{"a", "A/1", "a/2", "B", "b", "c"}, keys())
+}
+
+// StorageIterateTest testing storage Iterate function
+func StorageIterateTest(app *Server, t *testing.T) {
+	app.Storage.Clear()
+	stored := []string{"a", "b/1", "b/2", "c/d/e"}
+	for _, _key := range stored {
+		_, err := app.Storage.Set(_key, json.RawMessage(`{"key":"`+_key+`"}`))
+		require.NoError(t, err)
+	}
+
+	visited := map[string]int{}
+	err := app.Storage.Iterate(func(obj meta.Object) error {
+		visited[obj.Path]++
+		require.JSONEq(t, `{"key":"`+obj.Path+`"}`, string(obj.Data))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, visited, len(stored))
+	for _, _key := range stored {
+		require.Equal(t, 1, visited[_key], _key)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = app.Storage.Iterate(func(obj meta.Object) error {
+		calls++
+		if calls == 2 {
+			return errStop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, 2, calls)
+}
+
 // StorageGetNRangeTest testing storage GetN function
 func StorageGetNRangeTest(app *Server, t *testing.T, n int) {
 	app.Storage.Clear()
@@ -0,0 +1,57 @@
+package stream
+
+import "sync"
+
+// Update function that receives the broadcasts of a pool
+type Update func(patchOrSnapshot []byte, snapshot bool, version int64)
+
+// attachment in-process consumer of a pool
+type attachment struct {
+	onUpdate Update
+}
+
+// Attach registers an in-process consumer of the key pool, fn receives the current cache
+// of the pool (when it has one) and onUpdate the frames of every broadcast after it,
+// the data shouldn't be modified, the returned function detaches the consumer
+func (sm *Stream) Attach(key string, fn func(snapshot []byte, version int64), onUpdate Update) (detach func()) {
+	sm.mutex.Lock()
+	poolIndex := sm.findPool(key)
+	if poolIndex == -1 {
+		sm.pools = append(sm.pools, &Pool{
+			Key:         key,
+			connections: []*Conn{}})
+		poolIndex = len(sm.pools) - 1
+	}
+	pool := sm.pools[poolIndex]
+	sm.mutex.Unlock()
+
+	consumer := &attachment{onUpdate: onUpdate}
+	pool.mutex.Lock()
+	if len(pool.cache.Data) > 0 {
+		fn(pool.cache.Data, pool.cache.Version)
+	}
+	pool.attached = append(pool.attached, consumer)
+	pool.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pool.mutex.Lock()
+			defer pool.mutex.Unlock()
+			na := []*attachment{}
+			for _, v := range pool.attached {
+				if v != consumer {
+					na = append(na, v)
+				}
+			}
+			pool.attached = na
+		})
+	}
+}
+
+// notify the consumers attached to a pool
+func (pool *Pool) notify(data []byte, snapshot bool, version int64) {
+	for _, consumer := range pool.attached {
+		consumer.onUpdate(data, snapshot, version)
+	}
+}
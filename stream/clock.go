@@ -13,18 +13,40 @@ func (sm *Stream) BroadcastClock(data string) {
 	connections := sm.pools[0].connections
 
 	for _, client := range connections {
+		if !client.clockDue() {
+			continue
+		}
 		sm.WriteClock(client, data)
 	}
 }
 
+// SetClockInterval minimum time between the clock ticks sent to the
+// connection, zero sends every tick
+func (client *Conn) SetClockInterval(interval time.Duration) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.clockInterval = interval
+}
+
+// clockDue the clock interval of the connection has passed since the last tick
+func (client *Conn) clockDue() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.clockInterval == 0 || time.Since(client.lastClock) >= client.clockInterval
+}
+
 // WriteClock sends time to a subscriber
 func (sm *Stream) WriteClock(client *Conn, data string) {
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
-	client.conn.SetWriteDeadline(time.Now().Add(timeout))
+	client.conn.SetWriteDeadline(time.Now().Add(sm.writeTimeout(client)))
+	sm.compression(client, len(data))
 	err := client.conn.WriteMessage(websocket.BinaryMessage, []byte(data))
 	if err != nil {
 		client.conn.Close()
 		sm.Console.Log("writeTimeStreamErr: ", err)
+		return
 	}
+	client.lastClock = time.Now()
+	client.bytesOut.Add(int64(len(data)))
 }
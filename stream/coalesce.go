@@ -0,0 +1,47 @@
+package stream
+
+import "time"
+
+// pending broadcast of a pool waiting for the coalesce window to end
+type pending struct {
+	timer *time.Timer
+	opt   BroadcastOpt
+}
+
+// coalesce schedules the broadcast of a pool at the end of the window,
+// the events that arrive before it keep the scheduled broadcast
+func (sm *Stream) coalesce(pool *Pool, opt BroadcastOpt) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.pending != nil {
+		pool.pending.opt = opt
+		return
+	}
+
+	poolKey := pool.Key
+	pool.pending = &pending{opt: opt}
+	pool.pending.timer = time.AfterFunc(sm.Coalesce, func() {
+		sm.mutex.RLock()
+		defer sm.mutex.RUnlock()
+		poolIndex := sm.findPool(poolKey)
+		if poolIndex == -1 {
+			return
+		}
+		sm.firePending(poolIndex)
+	})
+}
+
+// firePending sends the scheduled broadcast of a pool (requires the stream lock)
+func (sm *Stream) firePending(poolIndex int) {
+	pool := sm.pools[poolIndex]
+	pool.mutex.Lock()
+	scheduled := pool.pending
+	pool.pending = nil
+	pool.mutex.Unlock()
+	if scheduled == nil {
+		return
+	}
+
+	scheduled.timer.Stop()
+	sm.broadcastPool(poolIndex, scheduled.opt, true)
+}
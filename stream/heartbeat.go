@@ -0,0 +1,29 @@
+package stream
+
+import (
+	"strconv"
+	"time"
+)
+
+// heartbeat writes a heartbeat frame with the version of the first key
+// of the connection every HeartbeatInterval until the connection closes
+func (sm *Stream) heartbeat(client *Conn) {
+	ticker := time.NewTicker(sm.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-ticker.C:
+			version, _ := sm.GetCacheVersion(client.keys[0])
+			message := []byte("{" +
+				"\"heartbeat\":true," +
+				"\"version\":\"" + strconv.FormatInt(version, 16) + "\"}")
+			if client.queue != nil {
+				sm.enqueue(client, message)
+				continue
+			}
+			sm.send(client, message)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package stream
+
+import "errors"
+
+// ErrMaxPools the stream reached MaxPools and no pool could be evicted
+var ErrMaxPools = errors.New("stream: too many pools")
+
+// PoolPolicy of a stream that reached MaxPools
+type PoolPolicy int
+
+const (
+	// RejectPools rejects the subscriptions to keys without a pool
+	RejectPools PoolPolicy = iota
+	// EvictEmptyPools removes the oldest pools without connections or attached consumers
+	EvictEmptyPools
+)
+
+// empty the pool has no connections, attached consumers or pending broadcast
+func (pool *Pool) empty() bool {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	return len(pool.connections) == 0 && len(pool.attached) == 0 && pool.pending == nil
+}
+
+// missing number of keys without a pool (requires the stream lock)
+func (sm *Stream) missing(keys []string) int {
+	count := 0
+	for _, key := range keys {
+		if sm.findPool(key) == -1 {
+			count++
+		}
+	}
+
+	return count
+}
+
+// room makes space for n new pools under MaxPools, evicting empty
+// pools if the policy allows it (requires the stream write lock)
+func (sm *Stream) room(n int) bool {
+	if sm.MaxPools <= 0 || n == 0 {
+		return true
+	}
+	// the clock pool doesn't count
+	over := len(sm.pools) - 1 + n - sm.MaxPools
+	if over <= 0 {
+		return true
+	}
+	if sm.OnMaxPools != EvictEmptyPools {
+		return false
+	}
+
+	evict := map[*Pool]bool{}
+	for poolIndex := 1; poolIndex < len(sm.pools) && len(evict) < over; poolIndex++ {
+		if sm.pools[poolIndex].empty() {
+			evict[sm.pools[poolIndex]] = true
+		}
+	}
+	if len(evict) < over {
+		return false
+	}
+	pools := make([]*Pool, 0, len(sm.pools)-len(evict))
+	for _, pool := range sm.pools {
+		if !evict[pool] {
+			pools = append(pools, pool)
+		}
+	}
+	sm.pools = pools
+	return true
+}
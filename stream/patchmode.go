@@ -0,0 +1,47 @@
+package stream
+
+import "github.com/benitogf/ooo/key"
+
+// PatchMode choice between patches and snapshots in the broadcasts of a pool
+type PatchMode int
+
+const (
+	// PatchAuto sends a patch unless it's bigger than the snapshot
+	PatchAuto PatchMode = iota
+	// PatchAlways sends a patch after the first snapshot even if it's bigger
+	PatchAlways
+	// PatchNever always sends snapshots
+	PatchNever
+)
+
+type patchMode struct {
+	path string
+	mode PatchMode
+}
+
+// SetPatchMode defines the patch mode of the pools that match the path, overriding
+// NoPatch and ForcePatch, the first mode registered for a matching path applies
+func (sm *Stream) SetPatchMode(path string, mode PatchMode) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.patchModes = append(sm.patchModes, patchMode{path: path, mode: mode})
+}
+
+// patchFlags the no patch and force patch flags of a pool key
+func (sm *Stream) patchFlags(poolKey string) (bool, bool) {
+	for _, m := range sm.patchModes {
+		if !key.Match(m.path, poolKey) {
+			continue
+		}
+		switch m.mode {
+		case PatchAlways:
+			return false, true
+		case PatchNever:
+			return true, false
+		default:
+			return false, false
+		}
+	}
+
+	return sm.NoPatch, sm.ForcePatch
+}
@@ -0,0 +1,48 @@
+package stream
+
+// Pause holds the broadcasts of the pool of the key (exact pool key, a paused
+// glob pool doesn't pause the pools of its items) until Resume is called,
+// only the latest broadcast is kept
+func (sm *Stream) Pause(key string) {
+	sm.pausedMutex.Lock()
+	defer sm.pausedMutex.Unlock()
+	if sm.paused == nil {
+		sm.paused = map[string]*BroadcastOpt{}
+	}
+	if _, found := sm.paused[key]; !found {
+		sm.paused[key] = nil
+	}
+}
+
+// Resume the broadcasts of the pool of the key, a broadcast
+// held while paused is sent as a snapshot of the current data
+func (sm *Stream) Resume(key string) {
+	sm.pausedMutex.Lock()
+	held, found := sm.paused[key]
+	delete(sm.paused, key)
+	sm.pausedMutex.Unlock()
+	if !found || held == nil {
+		return
+	}
+
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	poolIndex := sm.findPool(key)
+	if poolIndex == -1 {
+		return
+	}
+	opt := *held
+	opt.snapshot = true
+	sm.broadcastPool(poolIndex, opt, false)
+}
+
+// hold keeps the broadcast of a paused pool, returns false if the pool isn't paused
+func (sm *Stream) hold(poolKey string, opt BroadcastOpt) bool {
+	sm.pausedMutex.Lock()
+	defer sm.pausedMutex.Unlock()
+	if _, found := sm.paused[poolKey]; !found {
+		return false
+	}
+	sm.paused[poolKey] = &opt
+	return true
+}
@@ -0,0 +1,67 @@
+package stream
+
+// queued message waiting to be written to a connection,
+// flushed is closed when the messages before it are written
+type queued struct {
+	message []byte
+	flushed chan struct{}
+}
+
+// startQueue creates the write queue of a connection and its writer
+func (sm *Stream) startQueue(client *Conn) {
+	client.queue = make(chan queued, sm.WriteQueue)
+	go sm.writer(client)
+}
+
+// stop the writer of the connection queue
+func (client *Conn) stop() {
+	if client.done == nil {
+		return
+	}
+	client.stopOnce.Do(func() {
+		close(client.done)
+	})
+}
+
+// writer writes the queued messages of a connection in order
+func (sm *Stream) writer(client *Conn) {
+	for {
+		select {
+		case <-client.done:
+			return
+		case item := <-client.queue:
+			if item.flushed != nil {
+				close(item.flushed)
+				continue
+			}
+			sm.send(client, item.message)
+		}
+	}
+}
+
+// enqueue a message without waiting for the connection, a connection
+// with a full queue is lagging behind and gets closed (reaped)
+func (sm *Stream) enqueue(client *Conn, message []byte) {
+	select {
+	case <-client.done:
+	case client.queue <- queued{message: message}:
+	default:
+		sm.Console.Err("writeQueueFull: closing connection", client.remoteAddr)
+		client.stop()
+		client.conn.Close()
+	}
+}
+
+// drain blocks until the messages queued to the connection are written
+func (sm *Stream) drain(client *Conn) {
+	flushed := make(chan struct{})
+	select {
+	case <-client.done:
+		return
+	case client.queue <- queued{flushed: flushed}:
+	}
+	select {
+	case <-client.done:
+	case <-flushed:
+	}
+}
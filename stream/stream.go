@@ -1,10 +1,15 @@
 package stream
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/goccy/go-json"
@@ -30,11 +35,89 @@ type GetFn func(key string) ([]byte, error)
 
 type EncodeFn func(data []byte) string
 
+// Subscriber : identity of a subscription
+type Subscriber struct {
+	Principal  string
+	RemoteAddr string
+}
+
+// SubscribeCtx : monitoring or filtering of subscriptions with the subscriber identity
+type SubscribeCtx func(key string, subscriber Subscriber) error
+
+// UnsubscribeCtx : function callback on subscription closing with the subscriber identity
+type UnsubscribeCtx func(key string, subscriber Subscriber)
+
+// Principal : identify the principal of a subscription request
+type Principal func(r *http.Request) string
+
+// AuthorizeRead : define if a principal can read an object
+type AuthorizeRead func(principal, key string, obj meta.Object) bool
+
+// VersionFrom : derive the version of an object
+type VersionFrom func(obj meta.Object) int64
+
+// Meter : account the bytes read from and written to a principal
+type Meter func(principal string, bytesIn, bytesOut int64)
+
 // Conn extends the websocket connection with a mutex
 // https://godoc.org/github.com/gorilla/websocket#hdr-Concurrency
 type Conn struct {
-	mutex sync.Mutex
-	conn  *websocket.Conn
+	mutex      sync.Mutex
+	conn       *websocket.Conn
+	noPatch    bool
+	principal  string
+	remoteAddr string
+	// keys of the pools the connection belongs to, frames
+	// include the key when there's more than one
+	keys       []string
+	cacheMutex sync.Mutex
+	cache      map[string][]byte
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	// clock ticks
+	clockInterval time.Duration
+	lastClock     time.Time
+	// write timeout override (SetWriteTimeout)
+	writeTimeout time.Duration
+	// write queue (Stream.WriteQueue)
+	queue chan queued
+	// closed when the connection closes
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// authorized data last sent to the connection for a key
+func (client *Conn) getCache(key string) []byte {
+	client.cacheMutex.Lock()
+	defer client.cacheMutex.Unlock()
+	return client.cache[key]
+}
+
+func (client *Conn) setCache(key string, data []byte) {
+	client.cacheMutex.Lock()
+	defer client.cacheMutex.Unlock()
+	if client.cache == nil {
+		client.cache = map[string][]byte{}
+	}
+	client.cache[key] = data
+}
+
+// tag the frame with the key of the pool for connections subscribed to several keys
+func (client *Conn) tag(key string, extra frame) frame {
+	if len(client.keys) > 1 {
+		extra.key = key
+	}
+	return extra
+}
+
+// BytesIn read from the connection
+func (client *Conn) BytesIn() int64 {
+	return client.bytesIn.Load()
+}
+
+// BytesOut written to the connection
+func (client *Conn) BytesOut() int64 {
+	return client.bytesOut.Load()
 }
 
 // Pool of key filtered connections
@@ -43,22 +126,78 @@ type Pool struct {
 	Key         string
 	cache       Cache
 	connections []*Conn
+	attached    []*attachment
+	pending     *pending
+	changed     chan struct{}
+	// patches broadcast since the last snapshot
+	patches int
 }
 
 // Stream a group of pools
 type Stream struct {
-	mutex         sync.RWMutex
-	OnSubscribe   Subscribe
-	OnUnsubscribe Unsubscribe
-	ForcePatch    bool
-	NoPatch       bool
-	pools         []*Pool
-	Console       *coat.Console
+	mutex            sync.RWMutex
+	OnSubscribe      Subscribe
+	OnUnsubscribe    Unsubscribe
+	OnSubscribeCtx   SubscribeCtx
+	OnUnsubscribeCtx UnsubscribeCtx
+	Principal        Principal
+	AuthorizeRead    AuthorizeRead
+	VersionFrom      VersionFrom
+	ForcePatch       bool
+	NoPatch          bool
+	// MaxMessageBytes data size limit of messages and incoming frames, zero means no limit
+	MaxMessageBytes int
+	// SendReady sends a ready frame to new subscriptions before the snapshot
+	SendReady bool
+	// Tombstones includes the paths of the objects removed from list pools in broadcasts
+	Tombstones bool
+	// Meter is called with the bytes read and written by a connection when it closes
+	Meter Meter
+	// CompressMinBytes frames smaller than this size are written uncompressed when
+	// compression is negotiated (EnableCompression of the upgrader), zero compresses every frame
+	CompressMinBytes int
+	// WriteQueue size of the queue of messages of each connection, with a queue broadcasts
+	// don't wait for the writes and a connection that falls behind by more than the
+	// queue size is closed, zero writes the messages during the broadcast
+	WriteQueue int
+	// HeartbeatInterval interval of the heartbeat frames ({"heartbeat":true,"version":"..."})
+	// written to every connection, zero doesn't send heartbeats
+	HeartbeatInterval time.Duration
+	// Upgrader of the connections (buffer sizes, error handler, compression), defaults to StreamUpgrader
+	Upgrader *websocket.Upgrader
+	// Coalesce delays the broadcasts of a pool by this window, the events that arrive
+	// during it are sent as one broadcast of the net change (none when the data ends
+	// as it was, like an item created and deleted), zero broadcasts every event
+	Coalesce time.Duration
+	// SnapshotEvery sends a snapshot instead of the patch on every Nth broadcast
+	// of a pool so clients that missed a frame get the full state, zero only
+	// sends snapshots when there's no patch or it's bigger than the data
+	SnapshotEvery int
+	// MaxPools limit of pools (distinct subscribed or cached keys), once reached
+	// OnMaxPools defines if subscriptions to keys without a pool are rejected
+	// (503) or the oldest empty pools are evicted, zero means no limit
+	MaxPools   int
+	OnMaxPools PoolPolicy
+	// WriteTimeout time a write to a connection can take before the connection is
+	// closed, defaults to 15 seconds, a subscription can request its own with the
+	// writeTimeout query parameter (ws://host/key?writeTimeout=1m)
+	WriteTimeout time.Duration
+	// MaxWriteTimeout limit of the write timeouts requested by subscriptions,
+	// longer ones are lowered to it, defaults to four times the WriteTimeout
+	MaxWriteTimeout time.Duration
+	patchModes      []patchMode
+	pools           []*Pool
+	paused          map[string]*BroadcastOpt
+	pausedMutex     sync.Mutex
+	Console         *coat.Console
 }
 
 type BroadcastOpt struct {
-	Get      GetFn
-	Callback func()
+	Get       GetFn
+	Callback  func()
+	RequestID string
+	// snapshot sends the data as a snapshot instead of a patch
+	snapshot bool
 }
 
 // Cache holds version and data
@@ -95,72 +234,170 @@ func (sm *Stream) InitClock() {
 	}
 }
 
+func (sm *Stream) upgrader() *websocket.Upgrader {
+	if sm.Upgrader != nil {
+		return sm.Upgrader
+	}
+
+	return &StreamUpgrader
+}
+
 // New stream on a key
 func (sm *Stream) New(key string, w http.ResponseWriter, r *http.Request) (*Conn, error) {
-	wsClient, err := StreamUpgrader.Upgrade(w, r, nil)
+	return sm.NewMulti([]string{key}, w, r)
+}
+
+// NewMulti stream of one connection on several keys, the frames
+// of each key include it when there's more than one
+func (sm *Stream) NewMulti(keys []string, w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	// early rejection before the upgrade, new checks again with the pools lock
+	sm.mutex.Lock()
+	admitted := sm.room(sm.missing(keys))
+	sm.mutex.Unlock()
+	if !admitted {
+		sm.Console.Err("maxPools["+strings.Join(keys, ",")+"]", ErrMaxPools)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%s", ErrMaxPools)
+		return nil, ErrMaxPools
+	}
 
+	writeTimeout, err := parseWriteTimeout(r)
 	if err != nil {
-		sm.Console.Err("socketUpgradeError["+key+"]", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
 		return nil, err
 	}
 
-	err = sm.OnSubscribe(key)
+	wsClient, err := sm.upgrader().Upgrade(w, r, nil)
+
 	if err != nil {
+		sm.Console.Err("socketUpgradeError["+strings.Join(keys, ",")+"]", err)
 		return nil, err
 	}
 
-	return sm.new(key, wsClient), nil
+	subscriber := Subscriber{RemoteAddr: r.RemoteAddr}
+	if sm.Principal != nil {
+		subscriber.Principal = sm.Principal(r)
+	}
+	for _, key := range keys {
+		err = sm.OnSubscribe(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if sm.OnSubscribeCtx != nil {
+			err = sm.OnSubscribeCtx(key, subscriber)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// patch=false requests snapshots only for this connection
+	noPatch := r.URL.Query().Get("patch") == "false"
+	client, err := sm.new(keys, wsClient, noPatch, subscriber)
+	if err != nil {
+		sm.Console.Err("maxPools["+strings.Join(keys, ",")+"]", err)
+		return nil, err
+	}
+	client.SetWriteTimeout(writeTimeout)
+	return client, nil
 }
 
-// Open a connection for a key
-func (sm *Stream) new(key string, wsClient *websocket.Conn) *Conn {
+// Open a connection for keys, the connection is closed with an
+// error frame if the pools of the keys can't be created under MaxPools
+func (sm *Stream) new(keys []string, wsClient *websocket.Conn, noPatch bool, subscriber Subscriber) (*Conn, error) {
 	client := &Conn{
-		conn:  wsClient,
-		mutex: sync.Mutex{},
+		conn:       wsClient,
+		mutex:      sync.Mutex{},
+		noPatch:    noPatch,
+		principal:  subscriber.Principal,
+		remoteAddr: subscriber.RemoteAddr,
+		keys:       keys,
+	}
+	if sm.MaxMessageBytes > 0 {
+		wsClient.SetReadLimit(int64(sm.MaxMessageBytes))
 	}
+	client.done = make(chan struct{})
 
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	poolIndex := sm.findPool(key)
-	if poolIndex == -1 {
-		// create a pool
-		sm.pools = append(
-			sm.pools,
-			&Pool{
-				Key:         key,
-				connections: []*Conn{client}})
-		poolIndex = len(sm.pools) - 1
-		sm.Console.Log("connections["+key+"]: ", len(sm.pools[poolIndex].connections))
-		return client
+	if !sm.room(sm.missing(keys)) {
+		wsClient.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, ErrMaxPools.Error()),
+			time.Now().Add(time.Second))
+		wsClient.Close()
+		return nil, ErrMaxPools
+	}
+	if sm.WriteQueue > 0 {
+		sm.startQueue(client)
+	}
+	if sm.HeartbeatInterval > 0 {
+		go sm.heartbeat(client)
 	}
+	for _, key := range keys {
+		poolIndex := sm.findPool(key)
+		if poolIndex == -1 {
+			// create a pool
+			sm.pools = append(
+				sm.pools,
+				&Pool{
+					Key:         key,
+					connections: []*Conn{client}})
+			poolIndex = len(sm.pools) - 1
+			sm.Console.Log("connections["+key+"]: ", len(sm.pools[poolIndex].connections))
+			continue
+		}
 
-	// use existing pool
-	sm.pools[poolIndex].connections = append(
-		sm.pools[poolIndex].connections,
-		client)
-	sm.Console.Log("connections["+key+"]: ", len(sm.pools[poolIndex].connections))
-	return client
+		// use existing pool
+		sm.pools[poolIndex].connections = append(
+			sm.pools[poolIndex].connections,
+			client)
+		sm.Console.Log("connections["+key+"]: ", len(sm.pools[poolIndex].connections))
+	}
+	return client, nil
 }
 
-// Close client connection
+// Close client connection, removing it from the pools of all its keys
 func (sm *Stream) Close(key string, client *Conn) {
-	// auxiliar clients array
-	na := []*Conn{}
+	keys := client.keys
+	if len(keys) == 0 {
+		keys = []string{key}
+	}
 
 	// loop to remove this client
 	sm.mutex.Lock()
-	poolIndex := sm.findPool(key)
-	for _, v := range sm.pools[poolIndex].connections {
-		if v != client {
-			na = append(na, v)
+	for _, key := range keys {
+		poolIndex := sm.findPool(key)
+		if poolIndex == -1 {
+			continue
+		}
+		// auxiliar clients array
+		na := []*Conn{}
+		for _, v := range sm.pools[poolIndex].connections {
+			if v != client {
+				na = append(na, v)
+			}
 		}
-	}
 
-	// replace clients array with the auxiliar
-	sm.pools[poolIndex].connections = na
+		// replace clients array with the auxiliar
+		sm.pools[poolIndex].connections = na
+	}
 	sm.mutex.Unlock()
-	go sm.OnUnsubscribe(key)
+	for _, key := range keys {
+		go sm.OnUnsubscribe(key)
+		if sm.OnUnsubscribeCtx != nil {
+			go sm.OnUnsubscribeCtx(key, Subscriber{
+				Principal:  client.principal,
+				RemoteAddr: client.remoteAddr,
+			})
+		}
+	}
+	client.stop()
 	client.conn.Close()
+	if sm.Meter != nil {
+		sm.Meter(client.principal, client.bytesIn.Load(), client.bytesOut.Load())
+	}
 }
 
 // Broadcast will look for pools that match a path and broadcast updates
@@ -170,29 +407,228 @@ func (sm *Stream) Broadcast(path string, opt BroadcastOpt) {
 	// skip pool 0 (clock)
 	for poolIndex := 1; poolIndex < len(sm.pools); poolIndex++ {
 		if key.Peer(sm.pools[poolIndex].Key, path) {
-			data, err := opt.Get(sm.pools[poolIndex].Key)
-			// this error means that the broadcast was filtered
-			if err != nil {
+			if sm.hold(sm.pools[poolIndex].Key, opt) {
 				continue
 			}
+			if sm.Coalesce > 0 {
+				sm.coalesce(sm.pools[poolIndex], opt)
+				continue
+			}
+			sm.broadcastPool(poolIndex, opt, false)
+		}
+	}
+}
 
-			sm.pools[poolIndex].mutex.Lock()
-			modifiedData, snapshot, version := sm.Patch(poolIndex, data)
-			sm.broadcast(poolIndex, modifiedData, snapshot, version)
-			sm.pools[poolIndex].mutex.Unlock()
-			if opt.Callback != nil {
-				opt.Callback()
+// BroadcastAll broadcasts once each pool related to any of the paths, like
+// the items and lists of a batch of writes
+func (sm *Stream) BroadcastAll(paths []string, opt BroadcastOpt) {
+	sm.broadcastPools(func(poolKey string) bool {
+		for _, path := range paths {
+			if key.Peer(poolKey, path) {
+				return true
 			}
 		}
+		return false
+	}, opt, false)
+}
+
+// BroadcastPools broadcasts the pools which data changed, used when the data
+// of the pools changes without a write like a reload of the read filters
+func (sm *Stream) BroadcastPools(opt BroadcastOpt) {
+	sm.broadcastPools(func(poolKey string) bool { return true }, opt, true)
+}
+
+// broadcastPools broadcasts once each pool selected by its key
+func (sm *Stream) broadcastPools(selected func(poolKey string) bool, opt BroadcastOpt, skipUnchanged bool) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	// skip pool 0 (clock)
+	for poolIndex := 1; poolIndex < len(sm.pools); poolIndex++ {
+		if !selected(sm.pools[poolIndex].Key) || sm.hold(sm.pools[poolIndex].Key, opt) {
+			continue
+		}
+		if sm.Coalesce > 0 {
+			sm.coalesce(sm.pools[poolIndex], opt)
+			continue
+		}
+		sm.broadcastPool(poolIndex, opt, skipUnchanged)
+	}
+}
+
+// broadcastPool gets the data of a pool and writes it to the connections,
+// a coalesced broadcast or a refresh is skipped when the data didn't change
+func (sm *Stream) broadcastPool(poolIndex int, opt BroadcastOpt, skipUnchanged bool) {
+	data, err := opt.Get(sm.pools[poolIndex].Key)
+	// this error means that the broadcast was filtered
+	if err != nil {
+		return
+	}
+
+	sm.pools[poolIndex].mutex.Lock()
+	if skipUnchanged && bytes.Equal(sm.pools[poolIndex].cache.Data, data) {
+		sm.pools[poolIndex].mutex.Unlock()
+		return
+	}
+	extra := frame{requestID: opt.RequestID}
+	if sm.AuthorizeRead != nil {
+		version := sm._setCache(poolIndex, data)
+		sm.broadcastAuthorized(poolIndex, data, version, extra)
+		sm.pools[poolIndex].notify(data, true, version)
+		sm.pools[poolIndex].mutex.Unlock()
+		if opt.Callback != nil {
+			opt.Callback()
+		}
+		return
+	}
+	if sm.Tombstones {
+		extra.removed = sm.removed(sm.pools[poolIndex].Key, sm.pools[poolIndex].cache.Data, data)
+	}
+	var modifiedData []byte
+	var snapshot bool
+	var version int64
+	if opt.snapshot {
+		sm.pools[poolIndex].patches = 0
+		modifiedData, snapshot, version = data, true, sm._setCache(poolIndex, data)
+	} else {
+		modifiedData, snapshot, version = sm.Patch(poolIndex, data)
+	}
+	sm.broadcast(poolIndex, data, modifiedData, snapshot, version, extra)
+	sm.pools[poolIndex].notify(modifiedData, snapshot, version)
+	sm.pools[poolIndex].mutex.Unlock()
+	if opt.Callback != nil {
+		opt.Callback()
 	}
 }
 
-// broadcast message
-func (sm *Stream) broadcast(poolIndex int, data []byte, snapshot bool, version int64) {
-	connections := sm.pools[poolIndex].connections
-	for _, client := range connections {
-		sm.Write(client, string(data), snapshot, version)
+// Flush blocks until the messages being written to the connections of a pool are done
+func (sm *Stream) Flush(key string) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	poolIndex := sm.findPool(key)
+	if poolIndex == -1 {
+		return
 	}
+	sm.firePending(poolIndex)
+	sm.flush(sm.pools[poolIndex])
+}
+
+// FlushAll blocks until the messages being written to the connections of every pool are done
+func (sm *Stream) FlushAll() {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	for poolIndex, pool := range sm.pools {
+		sm.firePending(poolIndex)
+		sm.flush(pool)
+	}
+}
+
+func (sm *Stream) flush(pool *Pool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, client := range pool.connections {
+		if client.queue != nil {
+			sm.drain(client)
+			continue
+		}
+		client.mutex.Lock()
+		client.mutex.Unlock()
+	}
+}
+
+// broadcast message, connections that requested snapshots only
+// will receive the full data instead of the patch
+func (sm *Stream) broadcast(poolIndex int, data []byte, modifiedData []byte, snapshot bool, version int64, extra frame) {
+	pool := sm.pools[poolIndex]
+	for _, client := range pool.connections {
+		if !snapshot && client.noPatch {
+			sm.write(client, string(data), true, version, client.tag(pool.Key, extra))
+			continue
+		}
+		sm.write(client, string(modifiedData), snapshot, version, client.tag(pool.Key, extra))
+	}
+}
+
+// broadcastAuthorized sends each connection of the pool its own
+// view of the data, patches are created from the connection cache
+func (sm *Stream) broadcastAuthorized(poolIndex int, data []byte, version int64, poolExtra frame) {
+	pool := sm.pools[poolIndex]
+	noPatch, forcePatch := sm.patchFlags(pool.Key)
+	for _, client := range pool.connections {
+		filtered := sm.Authorized(client.principal, pool.Key, data)
+		previous := client.getCache(pool.Key)
+		client.setCache(pool.Key, filtered)
+		extra := client.tag(pool.Key, poolExtra)
+		if sm.Tombstones {
+			extra.removed = sm.removed(pool.Key, previous, filtered)
+		}
+		if noPatch || client.noPatch || len(previous) == 0 {
+			sm.write(client, string(filtered), true, version, extra)
+			continue
+		}
+		patch, err := jsonpatch.CreatePatch(previous, filtered)
+		if err != nil {
+			sm.write(client, string(filtered), true, version, extra)
+			continue
+		}
+		operations, err := json.Marshal(patch)
+		if err != nil || (!forcePatch && len(operations) > len(filtered)) {
+			sm.write(client, string(filtered), true, version, extra)
+			continue
+		}
+		sm.write(client, string(operations), false, version, extra)
+	}
+}
+
+// Authorized filters the data of a key to the objects that
+// the principal is allowed to read
+func (sm *Stream) Authorized(principal string, path string, data []byte) []byte {
+	if sm.AuthorizeRead == nil {
+		return data
+	}
+
+	if !strings.Contains(path, "*") {
+		obj, err := meta.Decode(data)
+		if err != nil || obj.Created == 0 || sm.AuthorizeRead(principal, obj.Path, obj) {
+			return data
+		}
+		return meta.EmptyObject
+	}
+
+	objs, err := meta.DecodeList(data)
+	if err != nil {
+		return data
+	}
+	allowed := []meta.Object{}
+	for _, obj := range objs {
+		if sm.AuthorizeRead(principal, obj.Path, obj) {
+			allowed = append(allowed, obj)
+		}
+	}
+	filtered, err := meta.Encode(allowed)
+	if err != nil {
+		return data
+	}
+
+	return filtered
+}
+
+// Snapshot filters the data for a connection and
+// stores it as the base for the connection patches
+func (sm *Stream) Snapshot(path string, client *Conn, data []byte) []byte {
+	if sm.AuthorizeRead == nil {
+		return data
+	}
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	poolIndex := sm.findPool(path)
+	if poolIndex == -1 {
+		return sm.Authorized(client.principal, path, data)
+	}
+	sm.pools[poolIndex].mutex.Lock()
+	defer sm.pools[poolIndex].mutex.Unlock()
+	filtered := sm.Authorized(client.principal, path, data)
+	client.setCache(path, filtered)
+	return filtered
 }
 
 // Patch will return either the snapshot or the patch
@@ -201,8 +637,26 @@ func (sm *Stream) broadcast(poolIndex int, data []byte, snapshot bool, version i
 //
 // snapshot, true (snapshot)
 func (sm *Stream) Patch(poolIndex int, data []byte) ([]byte, bool, int64) {
-	// no patch, only snapshot
-	if sm.NoPatch {
+	pool := sm.pools[poolIndex]
+	if sm.SnapshotEvery > 0 && pool.patches >= sm.SnapshotEvery-1 {
+		pool.patches = 0
+		version := sm._setCache(poolIndex, data)
+		return data, true, version
+	}
+	modifiedData, snapshot, version := sm.patch(poolIndex, data)
+	if snapshot {
+		pool.patches = 0
+	} else {
+		pool.patches++
+	}
+
+	return modifiedData, snapshot, version
+}
+
+func (sm *Stream) patch(poolIndex int, data []byte) ([]byte, bool, int64) {
+	noPatch, forcePatch := sm.patchFlags(sm.pools[poolIndex].Key)
+	// no patch (or no cache to patch), only snapshot
+	if noPatch || len(sm.pools[poolIndex].cache.Data) == 0 {
 		version := sm._setCache(poolIndex, data)
 		return data, true, version
 	}
@@ -219,7 +673,7 @@ func (sm *Stream) Patch(poolIndex int, data []byte) ([]byte, bool, int64) {
 		return data, true, version
 	}
 	// don't send the operations if they exceed the data size
-	if !sm.ForcePatch && len(operations) > len(data) {
+	if !forcePatch && len(operations) > len(data) {
 		// sm.Console.Err("patch operations bigger than data", string(operations))
 		return data, true, version
 	}
@@ -227,40 +681,179 @@ func (sm *Stream) Patch(poolIndex int, data []byte) ([]byte, bool, int64) {
 	return operations, false, version
 }
 
-// Write will write data to a ws connection
+// Write will write data to a ws connection, data that exceeds
+// MaxMessageBytes is replaced by an oversized sentinel
 func (sm *Stream) Write(client *Conn, data string, snapshot bool, version int64) {
+	sm.write(client, data, snapshot, version, frame{})
+}
+
+// WriteKey will write data of one of the keys of a connection, tagged
+// with the key when the connection is subscribed to several keys
+func (sm *Stream) WriteKey(client *Conn, key string, data string, snapshot bool, version int64) {
+	sm.write(client, data, snapshot, version, client.tag(key, frame{}))
+}
+
+// WriteReady will write a ready frame to a ws connection
+func (sm *Stream) WriteReady(client *Conn, version int64) {
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
-	client.conn.SetWriteDeadline(time.Now().Add(timeout))
-	err := client.conn.WriteMessage(websocket.BinaryMessage, []byte("{"+
-		"\"snapshot\":"+strconv.FormatBool(snapshot)+","+
-		"\"version\":\""+strconv.FormatInt(version, 16)+"\","+
-		"\"data\":"+data+"}"))
+	client.conn.SetWriteDeadline(time.Now().Add(sm.writeTimeout(client)))
+	message := []byte("{" +
+		"\"ready\":true," +
+		"\"version\":\"" + strconv.FormatInt(version, 16) + "\"}")
+	sm.compression(client, len(message))
+	err := client.conn.WriteMessage(websocket.BinaryMessage, message)
 
 	if err != nil {
 		client.conn.Close()
 		sm.Console.Log("writeStreamErr: ", err)
+		return
 	}
+	client.bytesOut.Add(int64(len(message)))
+}
+
+// compression of the next frame of a connection, disabled for frames under CompressMinBytes
+func (sm *Stream) compression(client *Conn, size int) {
+	if sm.CompressMinBytes > 0 {
+		client.conn.EnableWriteCompression(size >= sm.CompressMinBytes)
+	}
+}
+
+// frame extra fields of a broadcast message
+type frame struct {
+	key       string
+	requestID string
+	removed   []string
+}
+
+// fields of the frame, each field followed by a comma
+func (extra frame) fields() string {
+	fields := ""
+	if extra.key != "" {
+		key, err := json.Marshal(extra.key)
+		if err == nil {
+			fields += "\"key\":" + string(key) + ","
+		}
+	}
+	if extra.requestID != "" {
+		requestID, err := json.Marshal(extra.requestID)
+		if err == nil {
+			fields += "\"requestId\":" + string(requestID) + ","
+		}
+	}
+	if len(extra.removed) > 0 {
+		removed, err := json.Marshal(extra.removed)
+		if err == nil {
+			fields += "\"removed\":" + string(removed) + ","
+		}
+	}
+
+	return fields
+}
+
+// removed paths of a list pool, present in the previous data but not in the current
+func (sm *Stream) removed(path string, previous []byte, current []byte) []string {
+	if !strings.Contains(path, "*") || len(previous) == 0 {
+		return nil
+	}
+	previousObjs, err := meta.DecodeList(previous)
+	if err != nil {
+		return nil
+	}
+	currentObjs, err := meta.DecodeList(current)
+	if err != nil {
+		return nil
+	}
+	currentPaths := map[string]bool{}
+	for _, obj := range currentObjs {
+		currentPaths[obj.Path] = true
+	}
+	removed := []string{}
+	for _, obj := range previousObjs {
+		if !currentPaths[obj.Path] {
+			removed = append(removed, obj.Path)
+		}
+	}
+
+	return removed
+}
+
+// write data to a ws connection including the extra fields of the frame
+func (sm *Stream) write(client *Conn, data string, snapshot bool, version int64, extra frame) {
+	correlation := extra.fields()
+	message := "{" +
+		"\"snapshot\":" + strconv.FormatBool(snapshot) + "," +
+		"\"version\":\"" + strconv.FormatInt(version, 16) + "\"," +
+		correlation +
+		"\"data\":" + data + "}"
+	if sm.MaxMessageBytes > 0 && len(data) > sm.MaxMessageBytes {
+		message = "{" +
+			"\"snapshot\":true," +
+			"\"version\":\"" + strconv.FormatInt(version, 16) + "\"," +
+			correlation +
+			"\"oversized\":true," +
+			"\"data\":null}"
+	}
+	if client.queue != nil {
+		sm.enqueue(client, []byte(message))
+		return
+	}
+	sm.send(client, []byte(message))
+}
+
+// send writes a message to the connection
+func (sm *Stream) send(client *Conn, message []byte) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.conn.SetWriteDeadline(time.Now().Add(sm.writeTimeout(client)))
+	sm.compression(client, len(message))
+	err := client.conn.WriteMessage(websocket.BinaryMessage, message)
+
+	if err != nil {
+		client.conn.Close()
+		sm.Console.Log("writeStreamErr: ", err)
+		return
+	}
+	client.bytesOut.Add(int64(len(message)))
 }
 
 // Read will keep alive the ws connection
 func (sm *Stream) Read(key string, client *Conn) {
 	for {
-		_, _, err := client.conn.NextReader()
+		_, reader, err := client.conn.NextReader()
 		if err != nil {
 			sm.Console.Err("readSocketError["+key+"]", err)
 			sm.Close(key, client)
 			break
 		}
+		read, _ := io.Copy(io.Discard, reader)
+		client.bytesIn.Add(read)
 	}
 }
 
+// version of the data of a key, derived with VersionFrom for
+// single objects, defaults to the current time
+func (sm *Stream) version(key string, data []byte) int64 {
+	if sm.VersionFrom != nil && !strings.Contains(key, "*") {
+		obj, err := meta.Decode(data)
+		if err == nil {
+			version := sm.VersionFrom(obj)
+			if version != 0 {
+				return version
+			}
+		}
+	}
+
+	return time.Now().UTC().UnixNano()
+}
+
 // _setCache will store data in a pool's cache
 func (sm *Stream) _setCache(poolIndex int, data []byte) int64 {
-	now := time.Now().UTC().UnixNano()
-	sm.pools[poolIndex].cache.Version = now
+	version := sm.version(sm.pools[poolIndex].Key, data)
+	sm.pools[poolIndex].cache.Version = version
 	sm.pools[poolIndex].cache.Data = data
-	return now
+	sm.pools[poolIndex].wake()
+	return version
 }
 
 // SetCache by key
@@ -269,18 +862,22 @@ func (sm *Stream) setCache(key string, data []byte) int64 {
 	defer sm.mutex.Unlock()
 	poolIndex := sm.findPool(key)
 	if poolIndex == -1 {
-		now := time.Now().UTC().UnixNano()
+		version := sm.version(key, data)
+		// over MaxPools the data isn't cached
+		if !sm.room(1) {
+			return version
+		}
 		// create a pool
 		sm.pools = append(
 			sm.pools,
 			&Pool{
 				Key: key,
 				cache: Cache{
-					Version: now,
+					Version: version,
 					Data:    data,
 				},
 				connections: []*Conn{}})
-		return now
+		return version
 	}
 
 	return sm._setCache(poolIndex, data)
@@ -303,6 +900,23 @@ func (sm *Stream) GetCacheVersion(key string) (int64, error) {
 	return sm.pools[poolIndex].cache.Version, nil
 }
 
+// GetCache by key
+func (sm *Stream) GetCache(key string) (Cache, error) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	poolIndex := sm.findPool(key)
+	if poolIndex == -1 {
+		return Cache{}, errors.New("stream pool not found")
+	}
+	sm.pools[poolIndex].mutex.RLock()
+	defer sm.pools[poolIndex].mutex.RUnlock()
+	if len(sm.pools[poolIndex].cache.Data) == 0 {
+		return Cache{}, errors.New("stream pool cache empty")
+	}
+
+	return sm.pools[poolIndex].cache, nil
+}
+
 func (sm *Stream) Refresh(path string, getDataFn GetFn) Cache {
 	raw, _ := getDataFn(path)
 	if len(raw) == 0 {
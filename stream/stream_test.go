@@ -1,14 +1,22 @@
 package stream
 
 import (
+	"bytes"
+	"encoding/binary"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/benitogf/coat"
 	hjhttptest "github.com/getlantern/httptest"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
 
@@ -183,3 +191,586 @@ func TestConcurrentBroadcast(t *testing.T) {
 	require.Equal(t, 0, len(stream.pools[0].connections))
 	require.Equal(t, 0, len(stream.pools[1].connections))
 }
+
+// compressedFrames reads the RSV1 (per-message compression) flag of the
+// frames written after the handshake response
+func compressedFrames(t *testing.T, raw []byte) []bool {
+	start := bytes.Index(raw, []byte("\r\n\r\n"))
+	require.NotEqual(t, -1, start)
+	raw = raw[start+4:]
+	flags := []bool{}
+	for len(raw) >= 2 {
+		length := int(raw[1] & 0x7f)
+		offset := 2
+		switch length {
+		case 126:
+			length = int(binary.BigEndian.Uint16(raw[2:4]))
+			offset = 4
+		case 127:
+			length = int(binary.BigEndian.Uint64(raw[2:10]))
+			offset = 10
+		}
+		flags = append(flags, raw[0]&0x40 != 0)
+		raw = raw[offset+length:]
+	}
+	return flags
+}
+
+func compressionRequestMock(url string) (*http.Request, *hjhttptest.HijackableResponseRecorder) {
+	req, w := makeStreamRequestMock(url)
+	req.Header.Add("Sec-Websocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	return req, w
+}
+
+func TestCompressMinBytes(t *testing.T) {
+	StreamUpgrader.EnableCompression = true
+	defer func() {
+		StreamUpgrader.EnableCompression = false
+	}()
+	stream := Stream{
+		Console:          coat.NewConsole(domain, true),
+		OnSubscribe:      func(key string) error { return nil },
+		OnUnsubscribe:    func(key string) {},
+		CompressMinBytes: 256,
+	}
+
+	req, w := compressionRequestMock(domain + "/test")
+	wsConn, err := stream.New("test", w, req)
+	require.NoError(t, err)
+	stream.Write(wsConn, `{"name":"small"}`, true, 1)
+	stream.Write(wsConn, `{"name":"`+strings.Repeat("large", 100)+`"}`, true, 2)
+	stream.Write(wsConn, `{"name":"small"}`, true, 3)
+
+	require.Equal(t, []bool{false, true, false}, compressedFrames(t, w.Body().Bytes()))
+}
+
+func BenchmarkCompressMinBytes(b *testing.B) {
+	StreamUpgrader.EnableCompression = true
+	defer func() {
+		StreamUpgrader.EnableCompression = false
+	}()
+	patch := `[{"op":"replace","path":"/data/name","value":"small"}]`
+	for _, minBytes := range []int{0, 256} {
+		b.Run("min"+strconv.Itoa(minBytes), func(b *testing.B) {
+			stream := Stream{
+				Console:          coat.NewConsole(domain, true),
+				OnSubscribe:      func(key string) error { return nil },
+				OnUnsubscribe:    func(key string) {},
+				CompressMinBytes: minBytes,
+			}
+			req, w := compressionRequestMock(domain + "/test")
+			wsConn, err := stream.New("test", w, req)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				stream.Write(wsConn, patch, false, int64(i))
+				w.Body().Reset()
+			}
+		})
+	}
+}
+
+func TestNewMulti(t *testing.T) {
+	stream := Stream{
+		Console:       coat.NewConsole(domain, true),
+		OnSubscribe:   func(key string) error { return nil },
+		OnUnsubscribe: func(key string) {},
+	}
+	stream.InitClock()
+
+	req, w := makeStreamRequestMock(domain + "/subscribe?keys=a,b/*,c")
+	wsConn, err := stream.NewMulti([]string{"a", "b/*", "c"}, w, req)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(stream.pools))
+	for _, pool := range stream.pools[1:] {
+		require.Equal(t, 1, len(pool.connections))
+		require.Same(t, wsConn, pool.connections[0])
+	}
+
+	stream.Close("a", wsConn)
+	require.Equal(t, 4, len(stream.pools))
+	for _, pool := range stream.pools {
+		require.Equal(t, 0, len(pool.connections))
+	}
+}
+
+func TestAttach(t *testing.T) {
+	const testKey = "testing/*"
+	const testData = `[{"one":1}]`
+	const testDataUpdated = `[{"one":1},{"two":2}]`
+	stream := Stream{
+		Console:       coat.NewConsole(domain, true),
+		OnSubscribe:   func(key string) error { return nil },
+		OnUnsubscribe: func(key string) {},
+		ForcePatch:    true,
+	}
+	stream.InitClock()
+	stream.setCache(testKey, []byte(testData))
+
+	type update struct {
+		data     string
+		snapshot bool
+	}
+	initial := ""
+	updates := []update{}
+	detach := stream.Attach(testKey, func(snapshot []byte, version int64) {
+		require.NotZero(t, version)
+		initial = string(snapshot)
+	}, func(data []byte, snapshot bool, version int64) {
+		require.NotZero(t, version)
+		updates = append(updates, update{string(data), snapshot})
+	})
+	require.Equal(t, testData, initial)
+
+	stream.Broadcast("testing/2", BroadcastOpt{
+		Get: func(key string) ([]byte, error) { return []byte(testDataUpdated), nil },
+	})
+	require.Equal(t, []update{{`[{"op":"add","path":"/1","value":{"two":2}}]`, false}}, updates)
+
+	detach()
+	detach()
+	stream.Broadcast("testing/2", BroadcastOpt{
+		Get: func(key string) ([]byte, error) { return []byte(testData), nil },
+	})
+	require.Equal(t, 1, len(updates))
+
+	// a pool without cache starts with a snapshot
+	initial = ""
+	updates = []update{}
+	detach = stream.Attach("other", func(snapshot []byte, version int64) {
+		initial = string(snapshot)
+	}, func(data []byte, snapshot bool, version int64) {
+		updates = append(updates, update{string(data), snapshot})
+	})
+	defer detach()
+	require.Equal(t, "", initial)
+	stream.Broadcast("other", BroadcastOpt{
+		Get: func(key string) ([]byte, error) { return []byte(`{"one":1}`), nil },
+	})
+	require.Equal(t, []update{{`{"one":1}`, true}}, updates)
+}
+
+func TestWriteQueue(t *testing.T) {
+	const testKey = "big"
+	const broadcasts = 64
+	data := []byte(`"` + strings.Repeat("a", 256*1024) + `"`)
+	stream := Stream{
+		Console:       coat.NewConsole(domain, true),
+		OnSubscribe:   func(key string) error { return nil },
+		OnUnsubscribe: func(key string) {},
+		NoPatch:       true,
+		WriteQueue:    8,
+	}
+	stream.InitClock()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := stream.New(testKey, w, r)
+		if err != nil {
+			return
+		}
+		stream.Read(testKey, client)
+	}))
+	defer server.Close()
+
+	connections := func() int {
+		stream.mutex.RLock()
+		defer stream.mutex.RUnlock()
+		poolIndex := stream.findPool(testKey)
+		if poolIndex == -1 {
+			return 0
+		}
+		return len(stream.pools[poolIndex].connections)
+	}
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/" + testKey
+	stuck, _, err := websocket.DefaultDialer.Dial(u, nil)
+	require.NoError(t, err)
+	defer stuck.Close()
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Eventually(t, func() bool { return connections() == 2 }, time.Second, time.Millisecond)
+
+	received := make(chan struct{}, broadcasts)
+	go func() {
+		for {
+			_, _, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+
+	// the stuck connection doesn't delay the broadcasts
+	for i := 0; i < broadcasts; i++ {
+		stream.Broadcast(testKey, BroadcastOpt{
+			Get: func(key string) ([]byte, error) { return data, nil },
+		})
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			require.Fail(t, "broadcast not received", i)
+		}
+	}
+
+	// the connection that doesn't read is reaped
+	require.Eventually(t, func() bool { return connections() == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCoalesce(t *testing.T) {
+	const testKey = "testing/*"
+	stream := Stream{
+		Console:       coat.NewConsole(domain, true),
+		OnSubscribe:   func(key string) error { return nil },
+		OnUnsubscribe: func(key string) {},
+		Coalesce:      time.Hour,
+	}
+	stream.InitClock()
+	stream.setCache(testKey, []byte(`[]`))
+
+	var mutex sync.Mutex
+	updates := []string{}
+	detach := stream.Attach(testKey, func(snapshot []byte, version int64) {}, func(data []byte, snapshot bool, version int64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		updates = append(updates, string(data))
+	})
+	defer detach()
+	broadcast := func(data string) {
+		stream.Broadcast("testing/1", BroadcastOpt{
+			Get: func(key string) ([]byte, error) { return []byte(data), nil },
+		})
+	}
+
+	// created and deleted within the window
+	broadcast(`[{"one":1}]`)
+	broadcast(`[]`)
+	stream.FlushAll()
+	require.Equal(t, []string{}, updates)
+
+	// set twice within the window
+	broadcast(`[{"one":1}]`)
+	broadcast(`[{"one":2}]`)
+	require.Equal(t, []string{}, updates)
+	stream.Flush(testKey)
+	require.Equal(t, []string{`[{"one":2}]`}, updates)
+
+	// the window ends without a flush
+	stream.Coalesce = 10 * time.Millisecond
+	broadcast(`[{"one":3}]`)
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(updates) == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestPause(t *testing.T) {
+	stream := Stream{
+		Console:       coat.NewConsole(domain, true),
+		OnSubscribe:   func(key string) error { return nil },
+		OnUnsubscribe: func(key string) {},
+	}
+	stream.InitClock()
+	stream.setCache("testing/*", []byte(`[]`))
+	stream.setCache("other/*", []byte(`[]`))
+
+	type update struct {
+		data     string
+		snapshot bool
+	}
+	updates := map[string][]update{}
+	attach := func(key string) func() {
+		return stream.Attach(key, func(snapshot []byte, version int64) {}, func(data []byte, snapshot bool, version int64) {
+			updates[key] = append(updates[key], update{string(data), snapshot})
+		})
+	}
+	defer attach("testing/*")()
+	defer attach("other/*")()
+	broadcast := func(path string, data string) {
+		stream.Broadcast(path, BroadcastOpt{
+			Get: func(key string) ([]byte, error) { return []byte(data), nil },
+		})
+	}
+
+	stream.Pause("testing/*")
+	broadcast("testing/1", `[{"one":1}]`)
+	broadcast("testing/2", `[{"one":1},{"two":2,"name":"a name long enough to patch"}]`)
+	broadcast("other/1", `[{"other":1}]`)
+	require.Equal(t, 0, len(updates["testing/*"]))
+	require.Equal(t, 1, len(updates["other/*"]))
+
+	stream.Resume("testing/*")
+	require.Equal(t, []update{{`[{"one":1},{"two":2,"name":"a name long enough to patch"}]`, true}}, updates["testing/*"])
+
+	// resumed broadcasts are patched again
+	broadcast("testing/2", `[{"one":1},{"two":3,"name":"a name long enough to patch"}]`)
+	require.Equal(t, 2, len(updates["testing/*"]))
+	require.False(t, updates["testing/*"][1].snapshot)
+
+	// resuming without held broadcasts sends nothing
+	stream.Pause("testing/*")
+	stream.Resume("testing/*")
+	require.Equal(t, 2, len(updates["testing/*"]))
+}
+
+func TestBroadcastAll(t *testing.T) {
+	stream := Stream{
+		Console:       coat.NewConsole(domain, true),
+		OnSubscribe:   func(key string) error { return nil },
+		OnUnsubscribe: func(key string) {},
+	}
+	stream.InitClock()
+	stream.setCache("testing/*", []byte(`[]`))
+	stream.setCache("testing/1", []byte(`{}`))
+	stream.setCache("other", []byte(`{}`))
+
+	updates := map[string][]string{}
+	attach := func(key string) func() {
+		return stream.Attach(key, func(snapshot []byte, version int64) {}, func(data []byte, snapshot bool, version int64) {
+			updates[key] = append(updates[key], string(data))
+		})
+	}
+	defer attach("testing/*")()
+	defer attach("testing/1")()
+	defer attach("other")()
+
+	data := map[string]string{
+		"testing/*": `[{"one":1},{"two":2}]`,
+		"testing/1": `{"one":1}`,
+	}
+	stream.BroadcastAll([]string{"testing/1", "testing/2"}, BroadcastOpt{
+		Get: func(key string) ([]byte, error) { return []byte(data[key]), nil },
+	})
+	require.Equal(t, []string{data["testing/*"]}, updates["testing/*"])
+	require.Equal(t, []string{data["testing/1"]}, updates["testing/1"])
+	require.Equal(t, 0, len(updates["other"]))
+}
+
+func TestSnapshotEvery(t *testing.T) {
+	const testKey = "testing/*"
+	stream := Stream{
+		Console:       coat.NewConsole(domain, true),
+		OnSubscribe:   func(key string) error { return nil },
+		OnUnsubscribe: func(key string) {},
+		SnapshotEvery: 5,
+	}
+	stream.InitClock()
+	stream.setCache(testKey, []byte(`[{"count":0,"name":"a name long enough to patch"}]`))
+
+	snapshots := []bool{}
+	detach := stream.Attach(testKey, func(snapshot []byte, version int64) {}, func(data []byte, snapshot bool, version int64) {
+		snapshots = append(snapshots, snapshot)
+	})
+	defer detach()
+	for i := 1; i <= 10; i++ {
+		data := `[{"count":` + strconv.Itoa(i) + `,"name":"a name long enough to patch"}]`
+		stream.Broadcast("testing/1", BroadcastOpt{
+			Get: func(key string) ([]byte, error) { return []byte(data), nil },
+		})
+	}
+
+	require.Equal(t, []bool{false, false, false, false, true, false, false, false, false, true}, snapshots)
+}
+
+func TestMaxPools(t *testing.T) {
+	stream := Stream{
+		Console:       coat.NewConsole(domain, true),
+		OnSubscribe:   func(key string) error { return nil },
+		OnUnsubscribe: func(key string) {},
+		MaxPools:      2,
+	}
+	stream.InitClock()
+	subscribe := func(key string) (*Conn, int, error) {
+		req, w := makeStreamRequestMock(domain + "/" + key)
+		conn, err := stream.New(key, w, req)
+		return conn, w.Code(), err
+	}
+
+	// under the cap
+	a, _, err := subscribe("a")
+	require.NoError(t, err)
+	_, _, err = subscribe("b")
+	require.NoError(t, err)
+	a2, _, err := subscribe("a")
+	require.NoError(t, err)
+
+	// rejected over the cap, the reads of other keys aren't cached
+	_, status, err := subscribe("c")
+	require.ErrorIs(t, err, ErrMaxPools)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	stream.setCache("d", []byte(`{}`))
+	require.Equal(t, -1, stream.findPool("d"))
+
+	// evict the oldest empty pools
+	stream.OnMaxPools = EvictEmptyPools
+	_, _, err = subscribe("c")
+	require.ErrorIs(t, err, ErrMaxPools)
+	stream.Close("a", a)
+	stream.Close("a", a2)
+	_, _, err = subscribe("c")
+	require.NoError(t, err)
+	require.Equal(t, -1, stream.findPool("a"))
+	require.NotEqual(t, -1, stream.findPool("b"))
+	require.NotEqual(t, -1, stream.findPool("c"))
+
+	// concurrent subscriptions to new keys that passed the check
+	// before the upgrade don't go over the cap
+	var arrived sync.WaitGroup
+	arrived.Add(10)
+	concurrent := Stream{
+		Console: coat.NewConsole(domain, true),
+		OnSubscribe: func(key string) error {
+			arrived.Done()
+			arrived.Wait()
+			return nil
+		},
+		OnUnsubscribe: func(key string) {},
+		MaxPools:      5,
+	}
+	concurrent.InitClock()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			req, w := makeStreamRequestMock(domain + "/" + key)
+			_, err := concurrent.New(key, w, req)
+			if err == nil {
+				mutex.Lock()
+				admitted++
+				mutex.Unlock()
+			}
+		}("key" + strconv.Itoa(i))
+	}
+	wg.Wait()
+	require.Equal(t, 5, admitted)
+	require.Equal(t, 6, len(concurrent.pools))
+}
+
+func TestUpgrader(t *testing.T) {
+	var status int
+	upgrader := StreamUpgrader
+	upgrader.WriteBufferSize = 64
+	upgrader.EnableCompression = true
+	upgrader.Error = func(w http.ResponseWriter, r *http.Request, code int, reason error) {
+		status = code
+		w.WriteHeader(http.StatusTeapot)
+	}
+	stream := Stream{
+		Console:       coat.NewConsole(domain, true),
+		OnSubscribe:   func(key string) error { return nil },
+		OnUnsubscribe: func(key string) {},
+		Upgrader:      &upgrader,
+	}
+
+	// a bad upgrade goes through the error handler
+	w := httptest.NewRecorder()
+	_, err := stream.New("test", w, httptest.NewRequest("GET", domain+"/test", nil))
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, http.StatusTeapot, w.Code)
+
+	// compressed messages are written in frames of the buffer size
+	random := rand.New(rand.NewSource(1))
+	name := ""
+	for i := 0; i < 2000; i++ {
+		name += strconv.FormatInt(random.Int63n(16), 16)
+	}
+	req, hw := compressionRequestMock(domain + "/test")
+	wsConn, err := stream.New("test", hw, req)
+	require.NoError(t, err)
+	stream.Write(wsConn, `{"name":"`+name+`"}`, true, 1)
+	frames := compressedFrames(t, hw.Body().Bytes())
+	require.Greater(t, len(frames), 1)
+	require.True(t, frames[0])
+
+	// the default upgrader doesn't compress
+	stream.Upgrader = nil
+	req, hw = compressionRequestMock(domain + "/test")
+	wsConn, err = stream.New("test", hw, req)
+	require.NoError(t, err)
+	stream.Write(wsConn, `{"name":"`+name+`"}`, true, 1)
+	require.Equal(t, []bool{false}, compressedFrames(t, hw.Body().Bytes()))
+}
+
+func TestWriteTimeout(t *testing.T) {
+	stream := Stream{
+		Console:         coat.NewConsole(domain, true),
+		OnSubscribe:     func(key string) error { return nil },
+		OnUnsubscribe:   func(key string) {},
+		WriteTimeout:    50 * time.Millisecond,
+		MaxWriteTimeout: 10 * time.Second,
+	}
+	connections := make(chan *Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := stream.New("test", w, r)
+		if err != nil {
+			return
+		}
+		connections <- client
+		stream.Read("test", client)
+	}))
+	defer server.Close()
+	// big enough to fill the socket buffers so the write waits for the client to read
+	data := `"` + strings.Repeat("a", 16*1024*1024) + `"`
+
+	// a slow client that reads after the write started
+	slowRead := func(query string) error {
+		wsClient, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/test"+query, nil)
+		require.NoError(t, err)
+		defer wsClient.Close()
+		client := <-connections
+		written := make(chan struct{})
+		go func() {
+			stream.Write(client, data, true, 1)
+			close(written)
+		}()
+		time.Sleep(200 * time.Millisecond)
+		wsClient.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, message, err := wsClient.ReadMessage()
+		<-written
+		if err == nil {
+			require.True(t, bytes.Contains(message, []byte(data)))
+		}
+		return err
+	}
+
+	// without an override the default trips
+	require.Error(t, slowRead(""))
+
+	// a longer override survives the slow write
+	require.NoError(t, slowRead("?writeTimeout=5s"))
+
+	// invalid overrides are rejected
+	req, w := makeStreamRequestMock(domain + "/test?writeTimeout=-1s")
+	_, err := stream.New("test", w, req)
+	require.ErrorIs(t, err, ErrInvalidWriteTimeout)
+	require.Equal(t, http.StatusBadRequest, w.Code())
+
+	// overrides are limited by MaxWriteTimeout
+	client := &Conn{}
+	client.SetWriteTimeout(time.Minute)
+	require.Equal(t, stream.MaxWriteTimeout, stream.writeTimeout(client))
+	client.SetWriteTimeout(0)
+	require.Equal(t, stream.WriteTimeout, stream.writeTimeout(client))
+
+	// by default to four times the write timeout
+	stream.MaxWriteTimeout = 0
+	client.SetWriteTimeout(1000 * time.Hour)
+	require.Equal(t, 4*stream.WriteTimeout, stream.writeTimeout(client))
+	stream.WriteTimeout = 0
+	require.Equal(t, 4*timeout, stream.writeTimeout(client))
+}
+
+func TestFrameFields(t *testing.T) {
+	extra := frame{key: `a"b`, requestID: `id"\`, removed: []string{"list/1"}}
+	var fields map[string]interface{}
+	err := json.Unmarshal([]byte("{"+strings.TrimSuffix(extra.fields(), ",")+"}"), &fields)
+	require.NoError(t, err)
+	require.Equal(t, `a"b`, fields["key"])
+	require.Equal(t, `id"\`, fields["requestId"])
+}
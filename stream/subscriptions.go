@@ -0,0 +1,41 @@
+package stream
+
+import "strconv"
+
+// SubscriptionInfo subscribers of a pool
+type SubscriptionInfo struct {
+	Key         string   `json:"key"`
+	Subscribers int      `json:"subscribers"`
+	Version     string   `json:"version"`
+	RemoteAddrs []string `json:"remoteAddrs"`
+}
+
+// Subscriptions lists the pools that have subscribed connections (the clock
+// pool is not included), each pool is copied under its read lock so a
+// broadcast in progress is waited for but none is held for the whole listing
+func (sm *Stream) Subscriptions() []SubscriptionInfo {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	subscriptions := []SubscriptionInfo{}
+	for poolIndex := 1; poolIndex < len(sm.pools); poolIndex++ {
+		pool := sm.pools[poolIndex]
+		pool.mutex.RLock()
+		if len(pool.connections) == 0 {
+			pool.mutex.RUnlock()
+			continue
+		}
+		info := SubscriptionInfo{
+			Key:         pool.Key,
+			Subscribers: len(pool.connections),
+			Version:     strconv.FormatInt(pool.cache.Version, 16),
+			RemoteAddrs: make([]string, len(pool.connections)),
+		}
+		for i, client := range pool.connections {
+			info.RemoteAddrs[i] = client.remoteAddr
+		}
+		pool.mutex.RUnlock()
+		subscriptions = append(subscriptions, info)
+	}
+
+	return subscriptions
+}
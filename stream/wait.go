@@ -0,0 +1,51 @@
+package stream
+
+import (
+	"context"
+	"time"
+)
+
+// Wait blocks until the version of the pool cache of a key differs from since, the
+// timeout elapses or the context is done, returns the cache and whether it changed
+func (sm *Stream) Wait(ctx context.Context, key string, since int64, timeout time.Duration) (Cache, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		sm.mutex.RLock()
+		poolIndex := sm.findPool(key)
+		if poolIndex == -1 {
+			sm.mutex.RUnlock()
+			return Cache{}, false
+		}
+		pool := sm.pools[poolIndex]
+		pool.mutex.Lock()
+		if len(pool.cache.Data) > 0 && pool.cache.Version != since {
+			cache := pool.cache
+			pool.mutex.Unlock()
+			sm.mutex.RUnlock()
+			return cache, true
+		}
+		if pool.changed == nil {
+			pool.changed = make(chan struct{})
+		}
+		changed := pool.changed
+		pool.mutex.Unlock()
+		sm.mutex.RUnlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return Cache{}, false
+		case <-ctx.Done():
+			return Cache{}, false
+		}
+	}
+}
+
+// wake the waiters of a pool after its cache changed (requires the pool lock)
+func (pool *Pool) wake() {
+	if pool.changed != nil {
+		close(pool.changed)
+		pool.changed = nil
+	}
+}
@@ -0,0 +1,56 @@
+package stream
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrInvalidWriteTimeout the writeTimeout query parameter isn't a positive duration
+var ErrInvalidWriteTimeout = errors.New("ooo: invalid write timeout")
+
+// parseWriteTimeout write timeout requested by a subscription, zero when not requested
+func parseWriteTimeout(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("writeTimeout")
+	if value == "" {
+		return 0, nil
+	}
+	writeTimeout, err := time.ParseDuration(value)
+	if err != nil || writeTimeout <= 0 {
+		return 0, ErrInvalidWriteTimeout
+	}
+	return writeTimeout, nil
+}
+
+// SetWriteTimeout overrides the write timeout of the stream for the
+// connection (limited by MaxWriteTimeout), zero uses the stream default
+func (client *Conn) SetWriteTimeout(writeTimeout time.Duration) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.writeTimeout = writeTimeout
+}
+
+// defaultWriteTimeout of the connections without an override
+func (sm *Stream) defaultWriteTimeout() time.Duration {
+	if sm.WriteTimeout > 0 {
+		return sm.WriteTimeout
+	}
+	return timeout
+}
+
+// maxWriteTimeout limit of the overrides, broadcasts without a write queue
+// wait for each write so a dead connection blocks its pool up to this time
+func (sm *Stream) maxWriteTimeout() time.Duration {
+	if sm.MaxWriteTimeout > 0 {
+		return sm.MaxWriteTimeout
+	}
+	return 4 * sm.defaultWriteTimeout()
+}
+
+// writeTimeout of a write to the connection, requires the connection lock
+func (sm *Stream) writeTimeout(client *Conn) time.Duration {
+	if client.writeTimeout <= 0 {
+		return sm.defaultWriteTimeout()
+	}
+	return min(client.writeTimeout, sm.maxWriteTimeout())
+}
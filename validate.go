@@ -0,0 +1,87 @@
+package ooo
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/benitogf/ooo/key"
+	"github.com/gorilla/mux"
+)
+
+// ErrFilterConflict the registered filters can't be resolved
+var ErrFilterConflict = errors.New("ooo: conflicting filters")
+
+var routeVar = regexp.MustCompile(`\{[^}]*\}`)
+
+// reservedPaths the paths of the routes that take precedence over
+// the key routes (custom routes, endpoint groups and the subscribe route)
+func (app *Server) reservedPaths() []string {
+	reserved := []string{"subscribe"}
+	if app.Router == nil {
+		return reserved
+	}
+
+	app.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || strings.Contains(template, "{key:") {
+			return nil
+		}
+		path := routeVar.ReplaceAllString(strings.Trim(template, "/"), "*")
+		if path != "" && !key.Contains(reserved, path) {
+			reserved = append(reserved, path)
+		}
+		return nil
+	})
+
+	return reserved
+}
+
+// validateFilters finds the filter registrations that conflict, a filter path
+// registered twice for the same kind or equal to a reserved path is an error, a
+// glob that overlaps a reserved path or a filter shadowed by a glob is a warning
+func (app *Server) validateFilters() ([]string, error) {
+	set := app.filterSet()
+	reserved := app.reservedPaths()
+	warnings := []string{}
+	for _, kind := range set.kinds() {
+		for i, path := range kind.paths {
+			if !app.validKey(path) {
+				return warnings, fmt.Errorf("%w: %s filter path %s is not valid", ErrFilterConflict, kind.name, path)
+			}
+			for _, route := range reserved {
+				if path == route {
+					return warnings, fmt.Errorf("%w: %s filter path %s collides with the route /%s", ErrFilterConflict, kind.name, path, route)
+				}
+				if key.Peer(path, route) {
+					warnings = append(warnings, fmt.Sprintf("ooo: %s filter %s overlaps the route /%s", kind.name, path, route))
+				}
+			}
+			for _, previous := range kind.paths[:i] {
+				if previous == path {
+					return warnings, fmt.Errorf("%w: %s filter registered twice for %s", ErrFilterConflict, kind.name, path)
+				}
+				if key.Match(previous, path) {
+					warnings = append(warnings, fmt.Sprintf("ooo: %s filter %s is shadowed by %s", kind.name, path, previous))
+				}
+			}
+		}
+	}
+
+	return warnings, nil
+}
+
+// ValidateFilters checks the registered filters for conflicts (a path registered twice
+// for the same kind of filter, like OpenFilter and DeleteFilter on the same path) and
+// collisions with the paths of other routes, logs the overlapping globs
+func (app *Server) ValidateFilters() error {
+	warnings, err := app.validateFilters()
+	if app.Console != nil {
+		for _, warning := range warnings {
+			app.Console.Err(warning)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,58 @@
+package ooo
+
+import (
+	"sync/atomic"
+
+	"github.com/benitogf/ooo/key"
+	"github.com/benitogf/ooo/stream"
+)
+
+// WarmCaches fetches the paths (glob or object keys) into their pool caches
+// when the server starts (right away if it's already active), subscriptions
+// to a warmed path get the cached snapshot without reading the storage,
+// the cache is kept by the broadcasts so NoBroadcastKeys shouldn't be warmed
+func (app *Server) WarmCaches(paths []string) {
+	app.warmMutex.Lock()
+	for _, path := range paths {
+		if !key.Contains(app.warm, path) {
+			app.warm = append(app.warm, path)
+		}
+	}
+	app.warmMutex.Unlock()
+	if atomic.LoadInt64(&app.active) == 1 {
+		app.warmCaches(paths)
+	}
+}
+
+func (app *Server) warmCaches(paths []string) {
+	for _, path := range paths {
+		_, err := app.fetch(path)
+		if err != nil {
+			app.Console.Err("ooo: failed to warm the cache of", path, err)
+		}
+	}
+}
+
+func (app *Server) warmPaths() []string {
+	app.warmMutex.RLock()
+	defer app.warmMutex.RUnlock()
+	return append([]string{}, app.warm...)
+}
+
+func (app *Server) warmed(path string) bool {
+	app.warmMutex.RLock()
+	defer app.warmMutex.RUnlock()
+	return key.Contains(app.warm, path)
+}
+
+// cached returns the pool cache of a warmed path, other paths are fetched
+func (app *Server) cached(path string) (stream.Cache, error) {
+	if app.warmed(path) {
+		cache, err := app.Stream.GetCache(path)
+		if err == nil {
+			return cache, nil
+		}
+	}
+
+	return app.fetch(path)
+}
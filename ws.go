@@ -1,30 +1,116 @@
 package ooo
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/benitogf/ooo/key"
+	"github.com/benitogf/ooo/stream"
 	"github.com/gorilla/mux"
 )
 
+// ErrTooManyUpgrades the subscription didn't get an upgrade slot in time
+var ErrTooManyUpgrades = errors.New("ooo: too many concurrent subscriptions, retry later")
+
+// acquireUpgrade waits for an upgrade slot when MaxConcurrentUpgrades
+// is defined, returns the function that releases the slot
+func (app *Server) acquireUpgrade() (func(), bool) {
+	upgrades := app.upgrades
+	if upgrades == nil {
+		return func() {}, true
+	}
+
+	timer := time.NewTimer(app.UpgradeWait)
+	defer timer.Stop()
+	select {
+	case upgrades <- struct{}{}:
+		return func() { <-upgrades }, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
 func (app *Server) ws(w http.ResponseWriter, r *http.Request) {
 	_key := mux.Vars(r)["key"]
-	version := r.FormValue("v")
+	app.subscribe(w, r, []string{_key}, r.FormValue("v"))
+}
 
-	client, err := app.Stream.New(_key, w, r)
-	if err != nil {
+// wsMulti subscribes one connection to the comma separated keys
+// of the keys query param, frames include the key they belong to
+func (app *Server) wsMulti(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "websocket" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", errors.New("ooo: subscribe requires a websocket upgrade"))
 		return
 	}
 
-	// send initial msg
-	entry, err := app.fetch(_key)
+	if !app.Audit(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", ErrNotAuthorized)
+		return
+	}
+
+	keys := []string{}
+	for _, _key := range strings.Split(r.FormValue("keys"), ",") {
+		if !app.validKey(_key) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", errors.New("ooo: pathKeyError key is not valid"))
+			return
+		}
+		if !key.Contains(keys, _key) {
+			keys = append(keys, _key)
+		}
+	}
+
+	app.subscribe(w, r, keys, "")
+}
+
+// subscribe a connection to keys and send the initial snapshots, with
+// a single key the snapshot is skipped when the version matches
+func (app *Server) subscribe(w http.ResponseWriter, r *http.Request, keys []string, version string) {
+	releaseUpgrade, ok := app.acquireUpgrade()
+	if !ok {
+		app.Console.Err("ooo: upgrade slots exhausted", keys)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%s", ErrTooManyUpgrades)
+		return
+	}
+
+	client, err := app.Stream.NewMulti(keys, w, r)
 	if err != nil {
-		app.Console.Err("ooo: filtered route", err)
+		releaseUpgrade()
 		return
 	}
 
-	if version != strconv.FormatInt(entry.Version, 16) {
-		go app.Stream.Write(client, string(entry.Data), true, entry.Version)
+	// send initial msg
+	entries := make([]stream.Cache, len(keys))
+	snapshots := make([][]byte, len(keys))
+	for i, _key := range keys {
+		entries[i], err = app.cached(_key)
+		if err != nil {
+			releaseUpgrade()
+			app.Console.Err("ooo: filtered route", err)
+			app.Stream.Close(_key, client)
+			return
+		}
+		snapshots[i] = app.Stream.Snapshot(_key, client, entries[i].Data)
 	}
-	app.Stream.Read(_key, client)
+
+	go func() {
+		defer releaseUpgrade()
+		if app.Stream.SendReady {
+			app.Stream.WriteReady(client, entries[0].Version)
+		}
+		for i, _key := range keys {
+			if version != strconv.FormatInt(entries[i].Version, 16) {
+				app.Stream.WriteKey(client, _key, string(snapshots[i]), true, entries[i].Version)
+			}
+		}
+	}()
+	app.Stream.Read(keys[0], client)
 }
@@ -1,14 +1,25 @@
 package ooo
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/goccy/go-json"
+
+	"github.com/benitogf/ooo/messages"
+	"github.com/benitogf/ooo/meta"
+	"github.com/benitogf/ooo/stream"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
 )
 
 func TestWsTime(t *testing.T) {
@@ -54,3 +65,340 @@ func TestWsTime(t *testing.T) {
 	err = c1.Close()
 	require.NoError(t, err)
 }
+
+func TestMaxConcurrentUpgrades(t *testing.T) {
+	release := make(chan struct{})
+	app := Server{}
+	app.Silence = true
+	app.MaxConcurrentUpgrades = 1
+	app.UpgradeWait = 100 * time.Millisecond
+	app.ReadFilter("slow", func(index string, data json.RawMessage) (json.RawMessage, error) {
+		<-release
+		return data, nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// the slow subscription holds the only slot until its snapshot is sent
+	slow := url.URL{Scheme: "ws", Host: app.Address, Path: "/slow"}
+	c1, _, err := websocket.DefaultDialer.Dial(slow.String(), nil)
+	require.NoError(t, err)
+	defer c1.Close()
+	require.Eventually(t, func() bool {
+		return len(app.upgrades) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	other := url.URL{Scheme: "ws", Host: app.Address, Path: "/other"}
+	_, resp, err := websocket.DefaultDialer.Dial(other.String(), nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	close(release)
+	_, _, err = c1.ReadMessage()
+	require.NoError(t, err)
+
+	c2, _, err := websocket.DefaultDialer.Dial(other.String(), nil)
+	require.NoError(t, err)
+	defer c2.Close()
+	_, _, err = c2.ReadMessage()
+	require.NoError(t, err)
+}
+
+func TestWsMultiKey(t *testing.T) {
+	unsubscribed := make(chan string, 3)
+	app := Server{}
+	app.Silence = true
+	app.OnUnsubscribe = func(key string) {
+		unsubscribed <- key
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	_, err := app.Storage.Set("a", json.RawMessage(`{"name":"a"}`))
+	require.NoError(t, err)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/subscribe", RawQuery: "keys=a,b/*,c"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+
+	caches := map[string][]byte{}
+	read := func() string {
+		_, raw, err := c.ReadMessage()
+		require.NoError(t, err)
+		msg, err := messages.DecodeBuffer(raw)
+		require.NoError(t, err)
+		cache := caches[msg.Key]
+		if cache == nil {
+			cache = []byte{}
+		}
+		caches[msg.Key], err = messages.PatchCache(raw, cache)
+		require.NoError(t, err)
+		return msg.Key
+	}
+
+	snapshots := []string{read(), read(), read()}
+	require.ElementsMatch(t, []string{"a", "b/*", "c"}, snapshots)
+
+	_, err = app.Storage.Set("b/1", json.RawMessage(`{"name":"b1"}`))
+	require.NoError(t, err)
+	require.Equal(t, "b/*", read())
+	objs, err := meta.DecodeList(caches["b/*"])
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, `{"name":"b1"}`, string(objs[0].Data))
+
+	_, err = app.Storage.Set("c", json.RawMessage(`{"name":"c"}`))
+	require.NoError(t, err)
+	require.Equal(t, "c", read())
+	obj, err := meta.Decode(caches["c"])
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"c"}`, string(obj.Data))
+
+	_, err = app.Storage.Set("a", json.RawMessage(`{"name":"a2"}`))
+	require.NoError(t, err)
+	require.Equal(t, "a", read())
+	obj, err = meta.Decode(caches["a"])
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"a2"}`, string(obj.Data))
+
+	// closing the connection leaves every pool
+	c.Close()
+	closed := []string{}
+	for i := 0; i < 3; i++ {
+		select {
+		case key := <-unsubscribed:
+			closed = append(closed, key)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for unsubscribe")
+		}
+	}
+	require.ElementsMatch(t, []string{"a", "b/*", "c"}, closed)
+
+	u = url.URL{Scheme: "ws", Host: app.Address, Path: "/subscribe", RawQuery: "keys=a,b//c"}
+	_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPatchMode(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.PatchMode("never/*", stream.PatchNever)
+	app.PatchMode("always/*", stream.PatchAlways)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	subscribe := func(path string) *websocket.Conn {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: path}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		require.NoError(t, err)
+		_, message, err := c.ReadMessage()
+		require.NoError(t, err)
+		require.True(t, gjson.GetBytes(message, "snapshot").Bool())
+		return c
+	}
+	snapshots := func(c *websocket.Conn, path string) []bool {
+		res := []bool{}
+		for i := 0; i < 2; i++ {
+			_, err := app.Storage.Set(path+"/"+strconv.Itoa(i), json.RawMessage(`{"name":"`+strings.Repeat("x", 8)+`"}`))
+			require.NoError(t, err)
+			_, message, err := c.ReadMessage()
+			require.NoError(t, err)
+			res = append(res, gjson.GetBytes(message, "snapshot").Bool())
+		}
+		return res
+	}
+
+	never := subscribe("never/*")
+	defer never.Close()
+	always := subscribe("always/*")
+	defer always.Close()
+	global := subscribe("global/*")
+	defer global.Close()
+
+	require.Equal(t, []bool{true, true}, snapshots(never, "never"))
+	require.Equal(t, []bool{false, false}, snapshots(always, "always"))
+	// ForcePatch applies to the paths without a mode
+	require.Equal(t, []bool{false, false}, snapshots(global, "global"))
+}
+
+type countingStorage struct {
+	*MemoryStorage
+	gets atomic.Int64
+}
+
+func (db *countingStorage) Get(key string) ([]byte, error) {
+	db.gets.Add(1)
+	return db.MemoryStorage.Get(key)
+}
+
+func TestWarmCaches(t *testing.T) {
+	storage := &countingStorage{MemoryStorage: &MemoryStorage{}}
+	app := Server{}
+	app.Silence = true
+	app.Storage = storage
+	app.WarmCaches([]string{"hot/*", "config"})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("hot/1", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("config", json.RawMessage(`{"name":"config"}`))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("cold/1", json.RawMessage(`{"name":"cold"}`))
+	require.NoError(t, err)
+	app.Sync()
+
+	snapshot := func(path string) []byte {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: path}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		require.NoError(t, err)
+		defer c.Close()
+		_, message, err := c.ReadMessage()
+		require.NoError(t, err)
+		msg, err := messages.DecodeBuffer(message)
+		require.NoError(t, err)
+		require.True(t, msg.Snapshot)
+		return msg.Data
+	}
+
+	storage.gets.Store(0)
+	require.Equal(t, "one", gjson.GetBytes(snapshot("hot/*"), "0.data.name").String())
+	require.Equal(t, "config", gjson.GetBytes(snapshot("config"), "data.name").String())
+	require.Equal(t, int64(0), storage.gets.Load())
+
+	// un-warmed keys are fetched on subscribe
+	require.Equal(t, "cold", gjson.GetBytes(snapshot("cold/*"), "0.data.name").String())
+	require.Greater(t, storage.gets.Load(), int64(0))
+
+	// warming an active server fetches right away
+	app.WarmCaches([]string{"cold/1"})
+	storage.gets.Store(0)
+	require.Equal(t, "cold", gjson.GetBytes(snapshot("cold/1"), "data.name").String())
+	require.Equal(t, int64(0), storage.gets.Load())
+}
+
+func TestHeartbeat(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Stream.HeartbeatInterval = 50 * time.Millisecond
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "test"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	_, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	require.True(t, gjson.GetBytes(message, "snapshot").Bool())
+
+	heartbeats := []time.Time{}
+	for len(heartbeats) < 4 {
+		_, message, err = c.ReadMessage()
+		require.NoError(t, err)
+		if messages.IsHeartbeat(message) {
+			heartbeats = append(heartbeats, time.Now())
+			if len(heartbeats) == 2 {
+				_, err = app.Storage.Set("test", json.RawMessage(`{"name":"one"}`))
+				require.NoError(t, err)
+			}
+			continue
+		}
+		// data frames are written whole between the heartbeats
+		msg, err := messages.DecodeBuffer(message)
+		require.NoError(t, err)
+		require.False(t, msg.Heartbeat)
+		require.Contains(t, string(msg.Data), "one")
+	}
+	for i := 1; i < len(heartbeats); i++ {
+		require.Greater(t, heartbeats[i].Sub(heartbeats[i-1]), 25*time.Millisecond)
+	}
+
+	// the heartbeat carries the version of the key
+	version, err := app.Stream.GetCacheVersion("test")
+	require.NoError(t, err)
+	for {
+		_, message, err = c.ReadMessage()
+		require.NoError(t, err)
+		if messages.IsHeartbeat(message) {
+			require.Equal(t, strconv.FormatInt(version, 16), gjson.GetBytes(message, "version").String())
+			break
+		}
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	require.Equal(t, 0, len(app.Subscriptions()))
+
+	_, err := app.Storage.Set("test", json.RawMessage(`{"name":"one"}`))
+	require.NoError(t, err)
+	dial := func(path string) *websocket.Conn {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: path}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		require.NoError(t, err)
+		_, _, err = c.ReadMessage()
+		require.NoError(t, err)
+		return c
+	}
+	c1 := dial("test")
+	c2 := dial("test")
+	c3 := dial("things/*")
+	defer c3.Close()
+
+	find := func(key string) (stream.SubscriptionInfo, bool) {
+		for _, info := range app.Subscriptions() {
+			if info.Key == key {
+				return info, true
+			}
+		}
+		return stream.SubscriptionInfo{}, false
+	}
+	info, found := find("test")
+	require.True(t, found)
+	require.Equal(t, 2, info.Subscribers)
+	require.Equal(t, 2, len(info.RemoteAddrs))
+	version, err := app.Stream.GetCacheVersion("test")
+	require.NoError(t, err)
+	require.Equal(t, strconv.FormatInt(version, 16), info.Version)
+	info, found = find("things/*")
+	require.True(t, found)
+	require.Equal(t, 1, info.Subscribers)
+
+	// the version follows the broadcasts
+	_, err = app.Storage.Set("test", json.RawMessage(`{"name":"two"}`))
+	require.NoError(t, err)
+	app.Sync()
+	version, err = app.Stream.GetCacheVersion("test")
+	require.NoError(t, err)
+	info, _ = find("test")
+	require.Equal(t, strconv.FormatInt(version, 16), info.Version)
+
+	c1.Close()
+	require.Eventually(t, func() bool {
+		info, _ := find("test")
+		return info.Subscribers == 1
+	}, time.Second, 10*time.Millisecond)
+	c2.Close()
+	require.Eventually(t, func() bool {
+		_, found := find("test")
+		return !found
+	}, time.Second, 10*time.Millisecond)
+
+	// served to audited requests at ?api=subscriptions
+	req := httptest.NewRequest(http.MethodGet, "/?api=subscriptions", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "things/*", gjson.Get(w.Body.String(), "0.key").String())
+	require.Equal(t, int64(1), gjson.Get(w.Body.String(), "0.subscribers").Int())
+	app.Audit = func(r *http.Request) bool { return false }
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}